@@ -0,0 +1,91 @@
+// Command decrypt decrypts files written by the exporters with the
+// encryption block of config.yaml, or of the named exporter instance.
+// It only needs the keys to decrypt, not the recipients.
+//
+//	decrypt [-exporter name] [-identity file] [-decompress] [-o output] file
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func main() {
+	exporter := flag.String("exporter", "", "name of the exporter instance whose encryption block to use")
+	identity := flag.String("identity", "", "age identities or OpenPGP secret key ring, overrides identity_file")
+	decompress := flag.Bool("decompress", false, "also decompress the decrypted content")
+	output := flag.String("o", "-", "output file, - for stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	filename := flag.Arg(0)
+
+	var conf utils.Conf
+	if err := conf.LoadConfig(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	enc := conf.Encryption
+	if *exporter != "" {
+		instances, err := conf.ExporterInstances()
+		if err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		found := false
+		for _, instance := range instances {
+			if instance.Name == *exporter {
+				enc, found = instance.Encryption, true
+			}
+		}
+		if !found {
+			log.Fatalf("No exporter instance named %q", *exporter)
+		}
+	}
+	if *identity != "" {
+		enc.IdentityFile = *identity
+	}
+
+	e, err := metric_exporter.ParseDecryption(enc)
+	if err != nil {
+		log.Fatalf("Invalid encryption: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("Cannot read file: %v", err)
+	}
+
+	content, err = e.Decrypt(content)
+	if err != nil {
+		log.Fatalf("Cannot decrypt %s: %v", filename, err)
+	}
+
+	if *decompress {
+		name := strings.TrimSuffix(filename, metric_exporter.EncryptionExt(enc.Mode))
+		content, err = metric_exporter.Decompress(content, metric_exporter.CompressionOf(name))
+		if err != nil {
+			log.Fatalf("Cannot decompress %s: %v", filename, err)
+		}
+	}
+
+	if *output == "-" {
+		os.Stdout.Write(content)
+		return
+	}
+	if err := ioutil.WriteFile(*output, content, 0644); err != nil {
+		log.Fatalf("Cannot write file: %v", err)
+	}
+}
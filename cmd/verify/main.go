@@ -0,0 +1,46 @@
+// Command verify checks the exported files against their manifests, like
+// the /verify handler, and exits with status 1 when any check fails.
+//
+//	verify [-date yyyy-mm-dd] [-project id]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"stackdriver-monitoring-exporter/pkg/service"
+)
+
+func main() {
+	date := flag.String("date", "", "export day, defaults to the latest run")
+	project := flag.String("project", "", "project ID, defaults to every discovered project")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	results := service.NewExportService(ctx).Verify(ctx, *date, *project)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(results); err != nil {
+		log.Fatalf("Cannot write results: %v", err)
+	}
+
+	for i := range results {
+		if !results[i].OK {
+			os.Exit(1)
+		}
+	}
+}
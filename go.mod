@@ -4,9 +4,15 @@ go 1.14
 
 require (
 	cloud.google.com/go v0.30.0
+	filippo.io/age v1.0.0
 	github.com/googleapis/gax-go v2.0.0+incompatible // indirect
+	github.com/klauspost/compress v1.11.13
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkg/sftp v1.8.3
 	go.opencensus.io v0.17.0 // indirect
-	golang.org/x/net v0.0.0-20181017193950-04a2e542c03f
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	golang.org/x/oauth2 v0.0.0-20181017192945-9dcd33a902f4
 	google.golang.org/api v0.0.0-20181019000435-7fb5a8353b60
 	google.golang.org/appengine v1.2.0
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"google.golang.org/appengine"
 	"log"
 	"net/http"
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
 	"stackdriver-monitoring-exporter/pkg/service"
 	"strings"
 )
 
 func main() {
+	if _, err := service.LoadConf(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/cron/metrics-export", jobHandler)
+	http.HandleFunc("/cron/quality-report", qualityReportHandler)
+	http.HandleFunc("/cron/prune", pruneHandler)
+	http.HandleFunc("/verify", verifyHandler)
 	http.HandleFunc("/export", exportMetricPointsHandler)
+	http.HandleFunc("/finalize", finalizeHandler)
 
 	appengine.Main()
 }
@@ -31,39 +41,145 @@ func jobHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Done")
 }
 
+// Summarise the data quality of the latest export run
+func qualityReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	exportService := service.NewExportService(ctx)
+	if _, err := exportService.Report(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "Done")
+}
+
+// Delete exports older than the retention, "?dry_run=true" only lists them
+func pruneHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	exportService := service.NewExportService(ctx)
+	results := exportService.Prune(r.FormValue("dry_run") == "true")
+
+	status := http.StatusOK
+	for i := range results {
+		if results[i].Error != "" {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// Check exported files against their manifest, "?date=2018-10-18" defaults to
+// the latest run, "?project_id=" to every project
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	exportService := service.NewExportService(ctx)
+	results := exportService.Verify(ctx, r.FormValue("date"), r.FormValue("project_id"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
 // Export Metric Points to CSV
 func exportMetricPointsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%v, %v, %v, %v, %v, %v",
+	log.Printf("%v, %v, %v, %v, %v, %v, %v, %v, %v, %v, %v, %v, %v",
 		r.FormValue("projectID"),
 		r.FormValue("metric"),
 		r.FormValue("aligner"),
 		r.FormValue("filter"),
+		r.FormValue("zone"),
+		r.FormValue("instanceID"),
 		r.FormValue("instanceName"),
 		strings.Split(r.FormValue("attendNames"), "|"),
+		r.FormValue("group"),
+		r.FormValue("labels"),
+		r.FormValue("runID"),
+		r.FormValue("exporters"),
+		r.FormValue("routes"),
 	)
 
 	ctx := appengine.NewContext(r)
-	exportService := service.NewExportService(ctx)
+	exportService := service.NewExportService(ctx).WithRunID(r.FormValue("runID"))
+
+	series := metric_exporter.Series{
+		ProjectID:    r.FormValue("projectID"),
+		Metric:       r.FormValue("metric"),
+		Zone:         r.FormValue("zone"),
+		InstanceID:   r.FormValue("instanceID"),
+		InstanceName: r.FormValue("instanceName"),
+		Group:        r.FormValue("group"),
+	}
 
 	attendNamesStr := r.FormValue("attendNames")
-	if attendNamesStr == "" {
-		exportService.Export(
-			r.FormValue("projectID"),
-			r.FormValue("metric"),
-			r.FormValue("aligner"),
-			r.FormValue("filter"),
-			r.FormValue("instanceName"),
-		)
-	} else {
-		exportService.Export(
-			r.FormValue("projectID"),
-			r.FormValue("metric"),
-			r.FormValue("aligner"),
-			r.FormValue("filter"),
-			r.FormValue("instanceName"),
-			strings.Split(attendNamesStr, "|")...,
-		)
+	if attendNamesStr != "" {
+		series.AttendNames = strings.Split(attendNamesStr, "|")
+	}
+
+	// Instance labels of the label columns, planned from the inventory
+	if labels := r.FormValue("labels"); labels != "" {
+		if err := json.Unmarshal([]byte(labels), &series.Labels); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid labels: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Every exporter instance writes the series on its default route when
+	// the task names none. A failed instance fails the task, which is retried.
+	results := exportService.Export(series, r.FormValue("aligner"), r.FormValue("filter"), taskTargets(r))
+
+	status := http.StatusOK
+	for i := range results {
+		if !results[i].OK {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// Write the consolidated file of a project once its series are exported,
+// answering 503 so the task is retried while they are running
+func finalizeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%v, %v, %v, %v", r.FormValue("projectID"), r.FormValue("runID"), r.FormValue("exporters"), r.FormValue("routes"))
+
+	ctx := appengine.NewContext(r)
+	exportService := service.NewExportService(ctx).WithRunID(r.FormValue("runID"))
+
+	complete, err := exportService.Finalize(r.FormValue("projectID"), taskTargets(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !complete {
+		http.Error(w, "Series still running", http.StatusServiceUnavailable)
+		return
 	}
 
 	fmt.Fprint(w, "Done")
 }
+
+// taskTargets returns the exporter instances and routes named by a task.
+func taskTargets(r *http.Request) (targets []service.ExportTarget) {
+	if r.FormValue("exporters") == "" && r.FormValue("routes") == "" {
+		return
+	}
+
+	exporters := strings.Split(r.FormValue("exporters"), "|")
+	routes := strings.Split(r.FormValue("routes"), "|")
+	for i := range exporters {
+		target := service.ExportTarget{Exporter: exporters[i]}
+		if i < len(routes) {
+			target.Route = routes[i]
+		}
+		targets = append(targets, target)
+	}
+
+	return
+}
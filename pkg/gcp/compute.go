@@ -0,0 +1,146 @@
+package gcp
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// InstanceInfo is the inventory record of one Compute Engine instance.
+type InstanceInfo struct {
+	Zone         string            `json:"zone"`
+	InstanceID   string            `json:"instance_id"`
+	InstanceName string            `json:"instance_name"`
+	MachineType  string            `json:"machine_type"`
+	VCPUs        int64             `json:"vcpus"`
+	MemoryMB     int64             `json:"memory_mb"`
+	Preemptible  bool              `json:"preemptible"`
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+const InstanceInventoryCSVHeader = "zone,instance_id,instance_name,machine_type,vcpus,memory_mb,preemptible,status,labels"
+
+// CSVRow renders the record under InstanceInventoryCSVHeader. Labels are
+// joined as key=value pairs separated by semicolons.
+func (i InstanceInfo) CSVRow() string {
+	keys := make([]string, 0, len(i.Labels))
+	for key := range i.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := make([]string, len(keys))
+	for k := range keys {
+		labels[k] = keys[k] + "=" + i.Labels[keys[k]]
+	}
+
+	return fmt.Sprintf("%s,%s,%s,%s,%d,%d,%t,%s,%s", i.Zone, i.InstanceID, i.InstanceName, i.MachineType, i.VCPUs, i.MemoryMB, i.Preemptible, i.Status, strings.Join(labels, ";"))
+}
+
+// GetInstanceInventory lists the instances of projectID with their machine
+// shape. endpoint overrides the Compute Engine API base path when set, its
+// requests are sent without credentials.
+func GetInstanceInventory(ctx context.Context, projectID, endpoint string) (inventory []InstanceInfo, err error) {
+	client := http.DefaultClient
+	if endpoint == "" {
+		client, err = google.DefaultClient(ctx, compute.ComputeReadonlyScope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	svc, err := compute.New(client)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != "" {
+		svc.BasePath = strings.TrimSuffix(endpoint, "/") + "/"
+	}
+
+	machineTypes, err := getMachineTypes(ctx, svc, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("machine types: %v", err)
+	}
+
+	err = svc.Instances.AggregatedList(projectID).Pages(ctx, func(listResp *compute.InstanceAggregatedList) error {
+		for scope := range listResp.Items {
+			instances := listResp.Items[scope].Instances
+			for i := range instances {
+				inventory = append(inventory, newInstanceInfo(instances[i], machineTypes))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("instances: %v", err)
+	}
+
+	sort.Slice(inventory, func(i, j int) bool {
+		return inventory[i].InstanceID < inventory[j].InstanceID
+	})
+
+	return inventory, nil
+}
+
+func newInstanceInfo(instance *compute.Instance, machineTypes map[string]*compute.MachineType) InstanceInfo {
+	info := InstanceInfo{
+		Zone:         path.Base(instance.Zone),
+		InstanceID:   strconv.FormatUint(instance.Id, 10),
+		InstanceName: instance.Name,
+		MachineType:  path.Base(instance.MachineType),
+		Status:       instance.Status,
+		Labels:       instance.Labels,
+	}
+	if instance.Scheduling != nil {
+		info.Preemptible = instance.Scheduling.Preemptible
+	}
+
+	if machineType, ok := machineTypes[info.Zone+"/"+info.MachineType]; ok {
+		info.VCPUs = machineType.GuestCpus
+		info.MemoryMB = machineType.MemoryMb
+	} else {
+		info.VCPUs, info.MemoryMB = parseCustomMachineType(info.MachineType)
+	}
+
+	return info
+}
+
+// getMachineTypes returns the predefined machine types keyed by "zone/name".
+func getMachineTypes(ctx context.Context, svc *compute.Service, projectID string) (map[string]*compute.MachineType, error) {
+	machineTypes := make(map[string]*compute.MachineType)
+
+	err := svc.MachineTypes.AggregatedList(projectID).Pages(ctx, func(listResp *compute.MachineTypeAggregatedList) error {
+		for scope := range listResp.Items {
+			types := listResp.Items[scope].MachineTypes
+			for i := range types {
+				machineTypes[types[i].Zone+"/"+types[i].Name] = types[i]
+			}
+		}
+		return nil
+	})
+
+	return machineTypes, err
+}
+
+// parseCustomMachineType reads the shape of custom machine types such as
+// "custom-4-16384" or "n2-custom-8-32768-ext".
+func parseCustomMachineType(machineType string) (vcpus, memoryMB int64) {
+	parts := strings.Split(strings.TrimSuffix(machineType, "-ext"), "-")
+	if len(parts) < 3 || parts[len(parts)-3] != "custom" {
+		return
+	}
+
+	vcpus, _ = strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	memoryMB, _ = strconv.ParseInt(parts[len(parts)-1], 10, 64)
+
+	return
+}
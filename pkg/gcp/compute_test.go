@@ -0,0 +1,97 @@
+package gcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGetInstanceInventory(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/p/aggregated/machineTypes", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": map[string]interface{}{
+			"zones/asia-east1-a": map[string]interface{}{"machineTypes": []map[string]interface{}{
+				{"name": "n1-standard-2", "zone": "asia-east1-a", "guestCpus": 2, "memoryMb": 7680},
+			}},
+		}})
+	})
+	mux.HandleFunc("/p/aggregated/instances", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("pageToken") == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"items": map[string]interface{}{"zones/asia-east1-a": map[string]interface{}{"instances": []map[string]interface{}{{
+					"id":          "22",
+					"name":        "web",
+					"zone":        "https://www.googleapis.com/compute/v1/projects/p/zones/asia-east1-a",
+					"machineType": "https://www.googleapis.com/compute/v1/projects/p/zones/asia-east1-a/machineTypes/n1-standard-2",
+					"status":      "RUNNING",
+					"labels":      map[string]string{"env": "prod"},
+				}}}},
+				"nextPageToken": "next",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"items": map[string]interface{}{"zones/asia-east1-b": map[string]interface{}{"instances": []map[string]interface{}{{
+				"id":          "11",
+				"name":        "batch",
+				"zone":        "zones/asia-east1-b",
+				"machineType": "zones/asia-east1-b/machineTypes/n2-custom-8-32768-ext",
+				"status":      "TERMINATED",
+				"scheduling":  map[string]interface{}{"preemptible": true},
+			}}}},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	inventory, err := GetInstanceInventory(context.Background(), "p", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []InstanceInfo{
+		{Zone: "asia-east1-b", InstanceID: "11", InstanceName: "batch", MachineType: "n2-custom-8-32768-ext", VCPUs: 8, MemoryMB: 32768, Preemptible: true, Status: "TERMINATED"},
+		{Zone: "asia-east1-a", InstanceID: "22", InstanceName: "web", MachineType: "n1-standard-2", VCPUs: 2, MemoryMB: 7680, Status: "RUNNING", Labels: map[string]string{"env": "prod"}},
+	}
+	if !reflect.DeepEqual(inventory, want) {
+		t.Errorf("got inventory %+v, want %+v", inventory, want)
+	}
+
+	if got, want := inventory[1].CSVRow(), "asia-east1-a,22,web,n1-standard-2,2,7680,false,RUNNING,env=prod"; got != want {
+		t.Errorf("got CSV row %q, want %q", got, want)
+	}
+}
+
+func TestGetInstanceInventoryError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 403, "message": "Compute Engine API has not been used"}}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	inventory, err := GetInstanceInventory(context.Background(), "p", server.URL)
+	if err == nil || inventory != nil {
+		t.Errorf("got inventory %+v and error %v, want an error", inventory, err)
+	}
+}
+
+func TestParseCustomMachineType(t *testing.T) {
+	tests := []struct {
+		machineType     string
+		vcpus, memoryMB int64
+	}{
+		{"custom-4-16384", 4, 16384},
+		{"n2-custom-8-32768-ext", 8, 32768},
+		{"n1-standard-1", 0, 0},
+	}
+
+	for _, test := range tests {
+		vcpus, memoryMB := parseCustomMachineType(test.machineType)
+		if vcpus != test.vcpus || memoryMB != test.memoryMB {
+			t.Errorf("parseCustomMachineType(%q) = %d, %d, want %d, %d", test.machineType, vcpus, memoryMB, test.vcpus, test.memoryMB)
+		}
+	}
+}
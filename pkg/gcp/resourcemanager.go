@@ -1,15 +1,27 @@
 package gcp
 
 import (
-
+	"fmt"
 	"log"
+	"net/http"
+	"sort"
+	"strings"
+
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 
 	"google.golang.org/api/cloudresourcemanager/v1beta1"
+	cloudresourcemanager2 "google.golang.org/api/cloudresourcemanager/v2"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
 )
 
-func GetProjects(ctx context.Context) ([]string) {
+const LifecycleStateActive = "ACTIVE"
+
+// GetProjects lists the IDs of the projects matched by conf. Projects are
+// searched under the configured organization and folders (and their
+// sub-folders when recursive), or everywhere the service account can see.
+func GetProjects(ctx context.Context, conf utils.ProjectsConf) []string {
 	client, err := google.DefaultClient(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
 	if err != nil {
 		log.Fatal("SetContext: ", err.Error())
@@ -20,17 +32,170 @@ func GetProjects(ctx context.Context) ([]string) {
 		log.Fatal("GetProjects: ", err.Error())
 	}
 
+	var projects []*cloudresourcemanager.Project
+	parents := getParents(ctx, client, conf)
+	if len(parents) == 0 {
+		projects = listProjects(ctx, svc, projectsFilter("", "", conf.Labels))
+	}
+	for i := range parents {
+		parentType, parentID := splitParent(parents[i])
+		projects = append(projects, listProjects(ctx, svc, projectsFilter(parentType, parentID, conf.Labels))...)
+	}
+
+	return selectProjects(projects, conf)
+}
+
+// selectProjects returns the sorted IDs of projects in the lifecycle states
+// of conf and passing its include and exclude lists, once each.
+func selectProjects(projects []*cloudresourcemanager.Project, conf utils.ProjectsConf) (projectIDs []string) {
+	lifecycleStates := conf.LifecycleStates
+	if len(lifecycleStates) == 0 {
+		lifecycleStates = []string{LifecycleStateActive}
+	}
+
+	seen := make(map[string]bool)
+	for i := range projects {
+		projectID := projects[i].ProjectId
+		if seen[projectID] {
+			continue
+		}
+		seen[projectID] = true
+
+		if !containsString(lifecycleStates, projects[i].LifecycleState) {
+			continue
+		}
+		if !conf.MatchProjectID(projectID) {
+			continue
+		}
+
+		projectIDs = append(projectIDs, projectID)
+	}
+	sort.Strings(projectIDs)
+
+	return
+}
+
+// GetProjectInfo returns the labels of projectID and the resource names of
+// its ancestors ("folders/123", "organizations/456"), parent first.
+func GetProjectInfo(ctx context.Context, projectID string) (labels map[string]string, ancestors []string) {
+	client, err := google.DefaultClient(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+	if err != nil {
+		log.Fatal("GetProjectInfo: ", err.Error())
+	}
+
+	svc, err := cloudresourcemanager.New(client)
+	if err != nil {
+		log.Fatal("GetProjectInfo: ", err.Error())
+	}
+
+	project, err := svc.Projects.Get(projectID).Context(ctx).Do()
+	if err != nil {
+		log.Fatal("GetProjectInfo: ", err.Error())
+	}
+
+	ancestry, err := svc.Projects.GetAncestry(projectID, &cloudresourcemanager.GetAncestryRequest{}).Context(ctx).Do()
+	if err != nil {
+		log.Fatal("GetProjectInfo: ", err.Error())
+	}
+	for i := range ancestry.Ancestor {
+		id := ancestry.Ancestor[i].ResourceId
+		if id == nil || id.Type == "project" {
+			continue
+		}
+		ancestors = append(ancestors, id.Type+"s/"+id.Id)
+	}
+
+	return project.Labels, ancestors
+}
+
+func listProjects(ctx context.Context, svc *cloudresourcemanager.Service, filter string) (projects []*cloudresourcemanager.Project) {
 	projectsListCall := svc.Projects.List()
-	listResp, err := projectsListCall.Do()
+	if filter != "" {
+		projectsListCall.Filter(filter)
+	}
+
+	err := projectsListCall.Pages(ctx, func(listResp *cloudresourcemanager.ListProjectsResponse) error {
+		projects = append(projects, listResp.Projects...)
+		return nil
+	})
 	if err != nil {
 		log.Fatal("GetProjects: ", err.Error())
 	}
 
-	projects := listResp.Projects
-	projectIDs := make([]string, len(projects))
-	for i := range projects {
-		projectIDs[i] = projects[i].ProjectId
+	return
+}
+
+func projectsFilter(parentType, parentID string, labels map[string]string) string {
+	var terms []string
+	if parentType != "" {
+		terms = append(terms, fmt.Sprintf("parent.type:%s parent.id:%s", parentType, parentID))
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i := range keys {
+		terms = append(terms, fmt.Sprintf("labels.%s:%s", keys[i], labels[keys[i]]))
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// getParents returns the resource names ("organizations/123", "folders/456")
+// whose direct child projects should be listed.
+func getParents(ctx context.Context, client *http.Client, conf utils.ProjectsConf) (parents []string) {
+	if conf.Organization != "" {
+		parents = append(parents, "organizations/"+strings.TrimPrefix(conf.Organization, "organizations/"))
+	}
+	for i := range conf.Folders {
+		parents = append(parents, "folders/"+strings.TrimPrefix(conf.Folders[i], "folders/"))
+	}
+
+	if !conf.Recursive || len(parents) == 0 {
+		return
+	}
+
+	svc, err := cloudresourcemanager2.New(client)
+	if err != nil {
+		log.Fatal("GetProjects: ", err.Error())
+	}
+
+	for i := 0; i < len(parents); i++ {
+		parents = append(parents, listFolders(ctx, svc, parents[i])...)
+	}
+
+	return
+}
+
+func listFolders(ctx context.Context, svc *cloudresourcemanager2.Service, parent string) (folders []string) {
+	err := svc.Folders.List().Parent(parent).Pages(ctx, func(listResp *cloudresourcemanager2.ListFoldersResponse) error {
+		for i := range listResp.Folders {
+			if listResp.Folders[i].LifecycleState == LifecycleStateActive {
+				folders = append(folders, listResp.Folders[i].Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("GetProjects listFolders: ", err.Error())
+	}
+
+	return
+}
+
+func splitParent(parent string) (parentType, parentID string) {
+	parts := strings.SplitN(parent, "/", 2)
+	return strings.TrimSuffix(parts[0], "s"), parts[1]
+}
+
+func containsString(values []string, value string) bool {
+	for i := range values {
+		if values[i] == value {
+			return true
+		}
 	}
 
-	return projectIDs
-}
\ No newline at end of file
+	return false
+}
@@ -0,0 +1,140 @@
+package gcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/cloudresourcemanager/v1beta1"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// serverTransport sends every request to a test server.
+type serverTransport struct {
+	server *httptest.Server
+}
+
+func (t serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, _ := url.Parse(t.server.URL)
+	r := req.Clone(req.Context())
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestProjectsFilter(t *testing.T) {
+	tests := []struct {
+		parentType, parentID string
+		labels               map[string]string
+		want                 string
+	}{
+		{"", "", nil, ""},
+		{"organization", "123", nil, "parent.type:organization parent.id:123"},
+		{"folder", "456", map[string]string{"team": "ops", "env": "prod"}, "parent.type:folder parent.id:456 labels.env:prod labels.team:ops"},
+		{"", "", map[string]string{"env": "prod"}, "labels.env:prod"},
+	}
+
+	for _, test := range tests {
+		if got := projectsFilter(test.parentType, test.parentID, test.labels); got != test.want {
+			t.Errorf("projectsFilter(%q, %q, %v) = %q, want %q", test.parentType, test.parentID, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestSelectProjects(t *testing.T) {
+	projects := []*cloudresourcemanager.Project{
+		{ProjectId: "web-prod", LifecycleState: "ACTIVE"},
+		{ProjectId: "web-dev", LifecycleState: "ACTIVE"},
+		{ProjectId: "old", LifecycleState: "DELETE_REQUESTED"},
+		{ProjectId: "db-prod", LifecycleState: "ACTIVE"},
+		{ProjectId: "web-prod", LifecycleState: "ACTIVE"},
+	}
+
+	tests := []struct {
+		conf utils.ProjectsConf
+		want []string
+	}{
+		{utils.ProjectsConf{}, []string{"db-prod", "web-dev", "web-prod"}},
+		{utils.ProjectsConf{LifecycleStates: []string{"ACTIVE", "DELETE_REQUESTED"}}, []string{"db-prod", "old", "web-dev", "web-prod"}},
+		{utils.ProjectsConf{Include: []string{"web-*"}}, []string{"web-dev", "web-prod"}},
+		{utils.ProjectsConf{Exclude: []string{"*-dev"}}, []string{"db-prod", "web-prod"}},
+		{utils.ProjectsConf{Include: []string{"*-prod"}, Exclude: []string{"db-prod"}}, []string{"web-prod"}},
+	}
+
+	for _, test := range tests {
+		if got := selectProjects(projects, test.conf); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("selectProjects with %+v = %v, want %v", test.conf, got, test.want)
+		}
+	}
+}
+
+func TestGetParents(t *testing.T) {
+	// folders/1 holds folders/2, which holds folders/3 and the deleted
+	// folders/4
+	children := map[string][]map[string]string{
+		"organizations/9": {{"name": "folders/1", "lifecycleState": "ACTIVE"}},
+		"folders/1":       {{"name": "folders/2", "lifecycleState": "ACTIVE"}},
+		"folders/2": {
+			{"name": "folders/3", "lifecycleState": "ACTIVE"},
+			{"name": "folders/4", "lifecycleState": "DELETE_REQUESTED"},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"folders": children[r.FormValue("parent")]})
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: serverTransport{server}}
+
+	tests := []struct {
+		conf utils.ProjectsConf
+		want []string
+	}{
+		{utils.ProjectsConf{}, nil},
+		{utils.ProjectsConf{Organization: "9", Folders: []string{"folders/5"}}, []string{"organizations/9", "folders/5"}},
+		{utils.ProjectsConf{Folders: []string{"1"}, Recursive: true}, []string{"folders/1", "folders/2", "folders/3"}},
+		{utils.ProjectsConf{Organization: "organizations/9", Recursive: true}, []string{"organizations/9", "folders/1", "folders/2", "folders/3"}},
+	}
+
+	for _, test := range tests {
+		if got := getParents(context.Background(), client, test.conf); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getParents with %+v = %v, want %v", test.conf, got, test.want)
+		}
+	}
+}
+
+func TestListProjects(t *testing.T) {
+	var filters []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.FormValue("filter"))
+		if r.FormValue("pageToken") == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"projects":      []map[string]string{{"projectId": "a", "lifecycleState": "ACTIVE"}},
+				"nextPageToken": "next",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"projects": []map[string]string{{"projectId": "b", "lifecycleState": "ACTIVE"}},
+		})
+	}))
+	defer server.Close()
+
+	svc, err := cloudresourcemanager.New(&http.Client{Transport: serverTransport{server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projects := listProjects(context.Background(), svc, "parent.type:folder parent.id:1")
+	if len(projects) != 2 || projects[0].ProjectId != "a" || projects[1].ProjectId != "b" {
+		t.Errorf("got projects %+v, want a and b", projects)
+	}
+	if want := []string{"parent.type:folder parent.id:1", "parent.type:folder parent.id:1"}; !reflect.DeepEqual(filters, want) {
+		t.Errorf("got filters %q, want %q", filters, want)
+	}
+}
@@ -4,23 +4,46 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 
 	"google.golang.org/api/monitoring/v3"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
 )
 
-const PointCSVHeader = "timestamp,datetime,value"
+const PointTimeCSVHeader = "timestamp,datetime"
+const PointCSVHeader = PointTimeCSVHeader + ",value"
 const AggregationAlignmentPeriod = "60s"
 const AggregationPerSeriesAlignerRate = "ALIGN_RATE"
 const AggregationPerSeriesAlignerMean = "ALIGN_MEAN"
 const MinutesOneDay = 60 * 24
 
 const InstanceNameKey = "instanceName"
+const InstanceIDKey = "instanceID"
+const ZoneKey = "zone"
 const DeviceNameKey = "deviceName"
 
+// Instance identifies a VM. The instance ID is unique even when names are
+// reused across zones or by recreated VMs.
+type Instance struct {
+	Zone         string
+	InstanceID   string
+	InstanceName string
+}
+
+func timeSeriesInstance(ts *monitoring.TimeSeries) Instance {
+	return Instance{
+		Zone:         ts.Resource.Labels["zone"],
+		InstanceID:   ts.Resource.Labels["instance_id"],
+		InstanceName: ts.Metric.Labels["instance_name"],
+	}
+}
+
 type MonitoringClient struct {
 	TimeZone          int
 	StartTime         time.Time
@@ -101,7 +124,11 @@ func (c *MonitoringClient) pointsToMetricPoints(points []*monitoring.Point) (met
 	for metricIdx := range metricPoints {
 		pointTime = pointTime.Add(time.Second * 60)
 
-		t, _ := time.Parse("2006-01-02T15:04:05Z", points[pointIdx].Interval.StartTime)
+		// Points may run out before the end of the day
+		var t time.Time
+		if pointIdx >= 0 {
+			t, _ = time.Parse("2006-01-02T15:04:05Z", points[pointIdx].Interval.StartTime)
+		}
 
 		if pointTime.Equal(t) {
 			t = t.Add(time.Hour * (time.Duration)(c.TimeZone))
@@ -117,25 +144,113 @@ func (c *MonitoringClient) pointsToMetricPoints(points []*monitoring.Point) (met
 	return
 }
 
-func MakeInstanceFilter(metric, instanceName string) string {
-	return fmt.Sprintf(`metric.type="%s" AND metric.labels.instance_name="%s"`, metric, instanceName)
+func MakeInstanceFilter(metric, instanceID string) string {
+	return fmt.Sprintf(`metric.type="%s" AND resource.labels.instance_id="%s"`, metric, instanceID)
 }
 
 // Only query instance used memory from agent
-func MakeAgentMemoryFilter(metric, instanceName string) string {
-	return fmt.Sprintf(`metric.type="%s" AND metadata.user_labels.name="%s" AND metric.labels.state="%s"`, metric, instanceName, "used")
+func MakeAgentMemoryFilter(metric, instanceID string) string {
+	return fmt.Sprintf(`metric.type="%s" AND resource.labels.instance_id="%s" AND metric.labels.state="%s"`, metric, instanceID, "used")
 }
 
-func MakeDiskFilter(metric, instanceName, deviceName string) string {
-	return fmt.Sprintf(`metric.type="%s" AND metric.labels.instance_name="%s" AND metric.labels.device_name="%s"`, metric, instanceName, deviceName)
+func MakeDiskFilter(metric, instanceID, deviceName string) string {
+	return fmt.Sprintf(`metric.type="%s" AND resource.labels.instance_id="%s" AND metric.labels.device_name="%s"`, metric, instanceID, deviceName)
 }
 
-func (c *MonitoringClient) RetrieveMetricPoints(projectID, metric, aligner, filter string) (metricPoints []string) {
+// MakeSelectorFilter compiles the parts of selector the Monitoring API can
+// evaluate into the filter of metric. The name regexes, compiled with the config, are matched client-side.
+func MakeSelectorFilter(metric string, selector utils.InstanceSelector) string {
+	terms := []string{fmt.Sprintf(`metric.type="%s"`, metric)}
+
+	keys := make([]string, 0, len(selector.UserLabels))
+	for key := range selector.UserLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i := range keys {
+		terms = append(terms, fmt.Sprintf(`metadata.user_labels."%s"="%s"`, keys[i], selector.UserLabels[keys[i]]))
+	}
+
+	if len(selector.Zones) > 0 {
+		terms = append(terms, fmt.Sprintf(`resource.labels.zone=one_of(%s)`, quoteJoin(selector.Zones)))
+	}
+
+	if len(selector.Regions) > 0 {
+		regions := make([]string, len(selector.Regions))
+		for i := range selector.Regions {
+			regions[i] = fmt.Sprintf(`resource.labels.zone=starts_with("%s-")`, selector.Regions[i])
+		}
+		terms = append(terms, "("+strings.Join(regions, " OR ")+")")
+	}
+
+	if selector.GroupID != "" {
+		terms = append(terms, fmt.Sprintf(`group.id="%s"`, selector.GroupID))
+	}
+
+	if len(selector.MachineTypes) > 0 {
+		terms = append(terms, fmt.Sprintf(`metadata.system_labels.machine_type=one_of(%s)`, quoteJoin(selector.MachineTypes)))
+	}
+
+	return strings.Join(terms, " AND ")
+}
+
+func quoteJoin(values []string) string {
+	quoted := make([]string, len(values))
+	for i := range values {
+		quoted[i] = fmt.Sprintf(`"%s"`, values[i])
+	}
+
+	return strings.Join(quoted, ",")
+}
+
+// TimeSeries is one retrieved series with the labels describing it.
+type TimeSeries struct {
+	ResourceLabels map[string]string
+	MetricLabels   map[string]string
+	UserLabels     map[string]string
+	Points         []string
+}
+
+// Label returns the value of a long-format column. "user_labels.<key>" reads
+// the instance user labels, other columns the resource then metric labels.
+func (ts TimeSeries) Label(column string) string {
+	if strings.HasPrefix(column, UserLabelsColumnPrefix) {
+		return ts.UserLabels[strings.TrimPrefix(column, UserLabelsColumnPrefix)]
+	}
+	if value, ok := ts.ResourceLabels[column]; ok {
+		return value
+	}
+
+	return ts.MetricLabels[column]
+}
+
+const UserLabelsColumnPrefix = "user_labels."
+
+// LongRows appends the metric type and the given label columns to the points
+// of every series, so several series can share one file.
+func LongRows(metric string, timeSeries []TimeSeries, columns []string) (rows []string) {
+	for i := range timeSeries {
+		values := make([]string, len(columns))
+		for j := range columns {
+			values[j] = timeSeries[i].Label(columns[j])
+		}
+		suffix := "," + strings.Join(append([]string{metric}, values...), ",")
+
+		for j := range timeSeries[i].Points {
+			rows = append(rows, timeSeries[i].Points[j]+suffix)
+		}
+	}
+
+	return
+}
+
+// RetrieveTimeSeries returns every series matching filter.
+func (c *MonitoringClient) RetrieveTimeSeries(projectID, metric, aligner, filter string) (timeSeries []TimeSeries) {
 	client := c.getClient()
 
 	svc, err := monitoring.New(client)
 	if err != nil {
-		log.Fatal("RetrieveMetricPoints: ", err.Error())
+		log.Fatal("RetrieveTimeSeries: ", err.Error())
 	}
 
 	project := "projects/" + projectID
@@ -147,53 +262,80 @@ func (c *MonitoringClient) RetrieveMetricPoints(projectID, metric, aligner, filt
 	projectsTimeSeriesListCall.AggregationPerSeriesAligner(aligner)
 	projectsTimeSeriesListCall.AggregationAlignmentPeriod(AggregationAlignmentPeriod)
 
-	listResp, err := projectsTimeSeriesListCall.Do()
+	err = projectsTimeSeriesListCall.Pages(context.Background(), func(listResp *monitoring.ListTimeSeriesResponse) error {
+		for i := range listResp.TimeSeries {
+			ts := listResp.TimeSeries[i]
+
+			series := TimeSeries{
+				ResourceLabels: ts.Resource.Labels,
+				MetricLabels:   ts.Metric.Labels,
+				Points:         c.pointsToMetricPoints(ts.Points),
+			}
+			if ts.Metadata != nil {
+				series.UserLabels = ts.Metadata.UserLabels
+			}
+
+			timeSeries = append(timeSeries, series)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Fatal("RetrieveMetricPoints projectsTimeSeriesListCall: ", err.Error())
+		log.Fatal("RetrieveTimeSeries projectsTimeSeriesListCall: ", err.Error())
 	}
 
+	return
+}
+
+func (c *MonitoringClient) RetrieveMetricPoints(projectID, metric, aligner, filter string) (metricPoints []string) {
+	timeSeries := c.RetrieveTimeSeries(projectID, metric, aligner, filter)
+
 	// Only get the first timeseries
-	if len(listResp.TimeSeries) == 0 {
-		metricPoints = []string{}	
+	if len(timeSeries) == 0 {
+		metricPoints = []string{}
 		return
 	}
 
-	timeSeries := listResp.TimeSeries[0]
-	metricPoints = c.pointsToMetricPoints(timeSeries.Points)
+	metricPoints = timeSeries[0].Points
 
 	return
 }
 
-func (c *MonitoringClient) GetInstanceNames(projectID, metric string) (instanceNames []string) {
+func (c *MonitoringClient) GetInstances(projectID, metric string, selector utils.InstanceSelector) (instances []Instance) {
 	client := c.getClient()
 
 	svc, err := monitoring.New(client)
 	if err != nil {
-		log.Fatal("GetInstanceNames: ", err.Error())
+		log.Fatal("GetInstances: ", err.Error())
 	}
 
 	project := "projects/" + projectID
 
 	projectsTimeSeriesListCall := svc.Projects.TimeSeries.List(project)
 	projectsTimeSeriesListCall.View("HEADERS")
-	projectsTimeSeriesListCall.Filter(`metric.type="` + metric + `"`)
+	projectsTimeSeriesListCall.Filter(MakeSelectorFilter(metric, selector))
 	projectsTimeSeriesListCall.IntervalStartTime(c.IntervalStartTime)
 	projectsTimeSeriesListCall.IntervalEndTime(c.IntervalEndTime)
 
 	listResp, err := projectsTimeSeriesListCall.Do()
 	if err != nil {
-		log.Fatal("GetInstanceNames: ", err.Error())
+		log.Fatal("GetInstances: ", err.Error())
 	}
 
-	instanceNames = make([]string, len(listResp.TimeSeries))
+	seen := make(map[string]bool)
+	instances = make([]Instance, 0, len(listResp.TimeSeries))
 	for i := range listResp.TimeSeries {
-		instanceNames[i] = listResp.TimeSeries[i].Metric.Labels["instance_name"]
+		instance := timeSeriesInstance(listResp.TimeSeries[i])
+		if seen[instance.InstanceID] || !selector.MatchName(instance.InstanceName) {
+			continue
+		}
+		seen[instance.InstanceID] = true
+		instances = append(instances, instance)
 	}
 
 	return
 }
 
-func (c *MonitoringClient) GetInstanceAndDiskMaps(projectID, diskMetric string) (instanceAndDiskMaps []map[string]string) {
+func (c *MonitoringClient) GetInstanceAndDiskMaps(projectID, diskMetric string, selector utils.InstanceSelector) (instanceAndDiskMaps []map[string]string) {
 	client := c.getClient()
 
 	svc, err := monitoring.New(client)
@@ -205,7 +347,7 @@ func (c *MonitoringClient) GetInstanceAndDiskMaps(projectID, diskMetric string)
 
 	projectsTimeSeriesListCall := svc.Projects.TimeSeries.List(project)
 	projectsTimeSeriesListCall.View("HEADERS")
-	projectsTimeSeriesListCall.Filter(`metric.type="` + diskMetric + `"`)
+	projectsTimeSeriesListCall.Filter(MakeSelectorFilter(diskMetric, selector))
 	projectsTimeSeriesListCall.IntervalStartTime(c.IntervalStartTime)
 	projectsTimeSeriesListCall.IntervalEndTime(c.IntervalEndTime)
 
@@ -214,12 +356,85 @@ func (c *MonitoringClient) GetInstanceAndDiskMaps(projectID, diskMetric string)
 		log.Fatal("GetInstanceAndDiskMaps: ", err.Error())
 	}
 
-	instanceAndDiskMaps = make([]map[string]string, len(listResp.TimeSeries))
+	instanceAndDiskMaps = make([]map[string]string, 0, len(listResp.TimeSeries))
 	for i := range listResp.TimeSeries {
+		instance := timeSeriesInstance(listResp.TimeSeries[i])
+
 		m := make(map[string]string)
-		m[InstanceNameKey] = listResp.TimeSeries[i].Metric.Labels["instance_name"]
+		m[InstanceNameKey] = instance.InstanceName
+		m[InstanceIDKey] = instance.InstanceID
+		m[ZoneKey] = instance.Zone
 		m[DeviceNameKey] = listResp.TimeSeries[i].Metric.Labels["device_name"]
-		instanceAndDiskMaps[i] = m
+		if !selector.MatchName(m[InstanceNameKey]) {
+			continue
+		}
+		instanceAndDiskMaps = append(instanceAndDiskMaps, m)
+	}
+
+	return
+}
+
+// GapStats counts the runs of consecutive empty slots in metric points
+// produced by RetrieveMetricPoints and the length of the longest run.
+func GapStats(metricPoints []string) (gaps, longestGap int) {
+	run := 0
+	for i := range metricPoints {
+		if strings.HasSuffix(metricPoints[i], ",") {
+			run = run + 1
+			continue
+		}
+
+		if run > 0 {
+			gaps = gaps + 1
+			if run > longestGap {
+				longestGap = run
+			}
+		}
+		run = 0
+	}
+
+	if run > 0 {
+		gaps = gaps + 1
+		if run > longestGap {
+			longestGap = run
+		}
+	}
+
+	return
+}
+
+type Group struct {
+	ID          string
+	DisplayName string
+}
+
+// GetGroups returns the groups of projectID referenced by ID or display name.
+func (c *MonitoringClient) GetGroups(projectID string, references []string) (groups []Group) {
+	client := c.getClient()
+
+	svc, err := monitoring.New(client)
+	if err != nil {
+		log.Fatal("GetGroups: ", err.Error())
+	}
+
+	project := "projects/" + projectID
+
+	err = svc.Projects.Groups.List(project).Pages(context.Background(), func(listResp *monitoring.ListGroupsResponse) error {
+		for i := range listResp.Group {
+			g := listResp.Group[i]
+			id := g.Name[strings.LastIndex(g.Name, "/")+1:]
+
+			for j := range references {
+				if references[j] == id || references[j] == g.Name || references[j] == g.DisplayName {
+					groups = append(groups, Group{ID: id, DisplayName: g.DisplayName})
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("GetGroups: ", err.Error())
 	}
 
 	return
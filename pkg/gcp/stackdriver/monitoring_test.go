@@ -0,0 +1,205 @@
+package stackdriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// newTestClient returns a client sending every Monitoring request to
+// handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *MonitoringClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	c := &MonitoringClient{}
+	c.client = &http.Client{Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+		r := req.Clone(req.Context())
+		r.URL.Scheme = u.Scheme
+		r.URL.Host = u.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	return c
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func headers(instances ...[3]string) map[string]interface{} {
+	var timeSeries []map[string]interface{}
+	for _, instance := range instances {
+		timeSeries = append(timeSeries, map[string]interface{}{
+			"metric":   map[string]interface{}{"labels": map[string]string{"instance_name": instance[0]}},
+			"resource": map[string]interface{}{"labels": map[string]string{"instance_id": instance[1], "zone": instance[2]}},
+		})
+	}
+
+	return map[string]interface{}{"timeSeries": timeSeries}
+}
+
+func TestGapStats(t *testing.T) {
+	tests := []struct {
+		points     []string
+		gaps       int
+		longestGap int
+	}{
+		{nil, 0, 0},
+		{[]string{"1,a,1", "2,b,2"}, 0, 0},
+		{[]string{"1,a,", "2,b,2"}, 1, 1},
+		{[]string{"1,a,1", "2,b,", "3,c,", "4,d,4", "5,e,"}, 2, 2},
+		{[]string{"1,a,", "2,b,", "3,c,"}, 1, 3},
+	}
+
+	for _, test := range tests {
+		gaps, longestGap := GapStats(test.points)
+		if gaps != test.gaps || longestGap != test.longestGap {
+			t.Errorf("GapStats(%q) = %d, %d, want %d, %d", test.points, gaps, longestGap, test.gaps, test.longestGap)
+		}
+	}
+}
+
+func TestMakeSelectorFilter(t *testing.T) {
+	metric := "compute.googleapis.com/instance/cpu/usage_time"
+	tests := []struct {
+		selector utils.InstanceSelector
+		want     string
+	}{
+		{utils.InstanceSelector{}, `metric.type="` + metric + `"`},
+		{
+			utils.InstanceSelector{
+				UserLabels:   map[string]string{"team": "ops", "env": "prod"},
+				Zones:        []string{"asia-east1-a", "asia-east1-b"},
+				Regions:      []string{"us-central1", "europe-west1"},
+				MachineTypes: []string{"n1-standard-1"},
+				NameRegex:    "^web-",
+				GroupID:      "123",
+			},
+			`metric.type="` + metric + `" AND metadata.user_labels."env"="prod" AND metadata.user_labels."team"="ops"` +
+				` AND resource.labels.zone=one_of("asia-east1-a","asia-east1-b")` +
+				` AND (resource.labels.zone=starts_with("us-central1-") OR resource.labels.zone=starts_with("europe-west1-"))` +
+				` AND group.id="123" AND metadata.system_labels.machine_type=one_of("n1-standard-1")`,
+		},
+	}
+
+	for _, test := range tests {
+		if got := MakeSelectorFilter(metric, test.selector); got != test.want {
+			t.Errorf("MakeSelectorFilter(%+v) =\n%s\nwant\n%s", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestGetInstancesMatchesNames(t *testing.T) {
+	var filter string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		filter = r.FormValue("filter")
+		json.NewEncoder(w).Encode(headers(
+			[3]string{"web-1", "1", "asia-east1-a"},
+			[3]string{"web-1", "1", "asia-east1-a"},
+			[3]string{"web-canary", "2", "asia-east1-a"},
+			[3]string{"db-1", "3", "asia-east1-b"},
+		))
+	})
+
+	selector := utils.InstanceSelector{Zones: []string{"asia-east1-a"}, NameRegex: "^web-", ExcludeNameRegex: "canary"}
+	if err := selector.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	metric := "compute.googleapis.com/instance/cpu/usage_time"
+	instances := c.GetInstances("p", metric, selector)
+	if len(instances) != 1 || instances[0] != (Instance{Zone: "asia-east1-a", InstanceID: "1", InstanceName: "web-1"}) {
+		t.Errorf("got instances %+v, want web-1 once", instances)
+	}
+	if want := MakeSelectorFilter(metric, selector); filter != want {
+		t.Errorf("got filter %q, want %q", filter, want)
+	}
+}
+
+func TestGetGroups(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("pageToken") == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"group":         []map[string]string{{"name": "projects/p/groups/1", "displayName": "web"}, {"name": "projects/p/groups/2", "displayName": "db"}},
+				"nextPageToken": "next",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"group": []map[string]string{{"name": "projects/p/groups/3", "displayName": "cache"}},
+		})
+	})
+
+	groups := c.GetGroups("p", []string{"web", "projects/p/groups/2", "3", "missing"})
+	want := []Group{{"1", "web"}, {"2", "db"}, {"3", "cache"}}
+	if len(groups) != len(want) {
+		t.Fatalf("got groups %+v, want %+v", groups, want)
+	}
+	for i := range want {
+		if groups[i] != want[i] {
+			t.Errorf("got group %+v, want %+v", groups[i], want[i])
+		}
+	}
+}
+
+func TestRetrieveTimeSeriesLongRows(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// Points come newest first
+		point := func(start string, value float64) map[string]interface{} {
+			return map[string]interface{}{"interval": map[string]string{"startTime": start}, "value": map[string]float64{"doubleValue": value}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"timeSeries": []map[string]interface{}{
+			{
+				"metric":   map[string]interface{}{"labels": map[string]string{"state": "used", "instance_name": "web"}},
+				"resource": map[string]interface{}{"labels": map[string]string{"instance_id": "1", "zone": "asia-east1-a"}},
+				"metadata": map[string]interface{}{"userLabels": map[string]string{"env": "prod"}},
+				"points":   []map[string]interface{}{point("2018-10-18T00:03:00Z", 3), point("2018-10-18T00:01:00Z", 1)},
+			},
+			{
+				"metric":   map[string]interface{}{"labels": map[string]string{"state": "free", "instance_name": "web"}},
+				"resource": map[string]interface{}{"labels": map[string]string{"instance_id": "1", "zone": "asia-east1-a"}},
+				"points":   []map[string]interface{}{point("2018-10-18T00:02:00Z", 2)},
+			},
+		}})
+	})
+	c.StartTime = time.Date(2018, 10, 18, 0, 0, 0, 0, time.UTC)
+	c.TimeZone = 8
+
+	metric := "agent.googleapis.com/memory/bytes_used"
+	timeSeries := c.RetrieveTimeSeries("p", metric, AggregationPerSeriesAlignerMean, "")
+	if len(timeSeries) != 2 || len(timeSeries[0].Points) != MinutesOneDay {
+		t.Fatalf("got %d series, want 2 of one point per minute", len(timeSeries))
+	}
+
+	// Slots are shifted to the timezone, missing points left empty
+	want := []string{
+		"1539849660,2018-10-18 08:01:00,1.000000",
+		"1539849720,2018-10-18 08:02:00,",
+		"1539849780,2018-10-18 08:03:00,3.000000",
+	}
+	for i := range want {
+		if timeSeries[0].Points[i] != want[i] {
+			t.Errorf("got point %q, want %q", timeSeries[0].Points[i], want[i])
+		}
+	}
+
+	rows := LongRows(metric, timeSeries, []string{"zone", "instance_id", "state", "user_labels.env", "missing"})
+	if len(rows) != 2*MinutesOneDay {
+		t.Fatalf("got %d rows, want %d", len(rows), 2*MinutesOneDay)
+	}
+	if want := "1539849660,2018-10-18 08:01:00,1.000000," + metric + ",asia-east1-a,1,used,prod,"; rows[0] != want {
+		t.Errorf("got row %q, want %q", rows[0], want)
+	}
+	if want := "1539849720,2018-10-18 08:02:00,2.000000," + metric + ",asia-east1-a,1,free,,"; rows[MinutesOneDay+1] != want {
+		t.Errorf("got row %q, want %q", rows[MinutesOneDay+1], want)
+	}
+}
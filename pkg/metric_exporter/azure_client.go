@@ -0,0 +1,358 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the Blob service REST API version of every request.
+const azureAPIVersion = "2021-08-06"
+
+// azureClient sends requests to the Blob service of an account, signed with
+// its shared key or authorized by a SAS token.
+type azureClient struct {
+	endpoint    *url.URL
+	accountName string
+	accountKey  []byte
+	sasToken    url.Values
+
+	http *http.Client
+}
+
+func newAzureClient(c AzureConf) *azureClient {
+	client, err := parseAzureClient(c)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return client
+}
+
+// parseAzureClient returns the client of c, failing on an invalid endpoint,
+// account key or SAS token.
+func parseAzureClient(c AzureConf) (*azureClient, error) {
+	client := &azureClient{accountName: c.AccountName, http: azureHTTPClient}
+
+	accountKey := c.AccountKey
+	sasToken := c.SASToken
+	if client.accountName == "" {
+		client.accountName = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if accountKey == "" && sasToken == "" {
+		accountKey = os.Getenv("AZURE_STORAGE_KEY")
+		sasToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + client.accountName + ".blob.core.windows.net"
+	}
+	u, err := parseEndpoint("Azure", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client.endpoint = u
+
+	if accountKey != "" {
+		if client.accountKey, err = base64.StdEncoding.DecodeString(accountKey); err != nil {
+			return nil, fmt.Errorf("Azure account_key is not base64: %v", err)
+		}
+	}
+	if sasToken != "" {
+		if client.sasToken, err = url.ParseQuery(strings.TrimPrefix(sasToken, "?")); err != nil {
+			return nil, fmt.Errorf("invalid Azure sas_token: %v", err)
+		}
+	}
+
+	return client, nil
+}
+
+// azureHTTPClient is shared by the exporters of a process, so connections
+// are reused across files. Blobs are read as stored.
+var azureHTTPClient = &http.Client{Timeout: 5 * time.Minute, Transport: s3Transport()}
+
+// azureRequest is one request on a container, or one of its blobs when
+// name is set.
+type azureRequest struct {
+	method string
+	name   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// azureError is the error document of a failed request.
+type azureError struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("Azure %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// isAzureStatus reports whether err is an Azure error of status.
+func isAzureStatus(err error, status int) bool {
+	e, ok := err.(*azureError)
+	return ok && e.StatusCode == status
+}
+
+// do sends r, retrying server errors, and returns the response of the last
+// attempt. Responses with an error status are returned as *azureError.
+func (c *azureClient) do(container string, r azureRequest) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		res, err = c.http.Do(c.newRequest(container, r, time.Now().UTC()))
+		if err != nil {
+			continue
+		}
+		if res.StatusCode < 300 {
+			return res, nil
+		}
+
+		err = readAzureError(res)
+		if res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+	}
+
+	return res, err
+}
+
+func readAzureError(res *http.Response) error {
+	defer res.Body.Close()
+
+	e := &azureError{StatusCode: res.StatusCode, Code: res.Header.Get("X-Ms-Error-Code")}
+	content, _ := ioutil.ReadAll(res.Body)
+	xml.Unmarshal(content, e)
+	if e.Code == "" {
+		e.Code = http.StatusText(res.StatusCode)
+	}
+
+	return e
+}
+
+// newRequest returns r addressed to container and authorized at now.
+func (c *azureClient) newRequest(container string, r azureRequest, now time.Time) *http.Request {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + container
+	if r.name != "" {
+		u.Path = u.Path + "/" + r.name
+	}
+	u.RawPath = uriEscape(u.Path, false)
+
+	query := url.Values{}
+	for key, values := range r.query {
+		query[key] = values
+	}
+	for key, values := range c.sasToken {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(r.method, u.String(), bytes.NewReader(r.body))
+	if err != nil {
+		log.Fatalf("Invalid Azure request: %v", err)
+	}
+	for key, values := range r.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", now.Format(http.TimeFormat))
+
+	if c.accountKey != nil {
+		c.sign(req, len(r.body))
+	}
+
+	return req
+}
+
+// sign adds the shared key authorization of req, whose content is
+// contentLength bytes long.
+func (c *azureClient) sign(req *http.Request, contentLength int) {
+	length := ""
+	if contentLength > 0 {
+		length = fmt.Sprint(contentLength)
+	}
+
+	// Metadata headers are set as written, to keep the case of their names
+	headerValues := make(map[string]string)
+	var headers []string
+	for key := range req.Header {
+		if name := strings.ToLower(key); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+			headerValues[name] = strings.TrimSpace(strings.Join(req.Header[key], ","))
+		}
+	}
+	sort.Strings(headers)
+
+	var canonicalHeaders strings.Builder
+	for i := range headers {
+		canonicalHeaders.WriteString(headers[i] + ":" + headerValues[headers[i]] + "\n")
+	}
+
+	var canonicalResource strings.Builder
+	canonicalResource.WriteString("/" + c.accountName + req.URL.EscapedPath())
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := range names {
+		values := query[names[i]]
+		sort.Strings(values)
+		canonicalResource.WriteString("\n" + strings.ToLower(names[i]) + ":" + strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-Md5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is signed instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders.String() + canonicalResource.String(),
+	}, "\n")
+
+	h := hmac.New(sha256.New, c.accountKey)
+	h.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+c.accountName+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// azureUpload buffers what is written to it into blocks of blockSize: one
+// Put Blob when the content fits a block, blocks committed by Put Block
+// List otherwise. The blob is only written, with header's conditions, when
+// the upload is closed.
+type azureUpload struct {
+	client    *azureClient
+	container string
+	name      string
+	header    http.Header
+	blockSize int
+
+	buf      bytes.Buffer
+	size     int64
+	blockIDs []string
+
+	// token tells the blocks of this upload from those staged for the same
+	// blob by a concurrent or failed one
+	token string
+}
+
+func (u *azureUpload) Write(p []byte) (int, error) {
+	u.buf.Write(p)
+	u.size += int64(len(p))
+
+	for u.buf.Len() >= u.blockSize*2 {
+		if err := u.putBlock(u.buf.Next(u.blockSize)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// putBlock stages block, uncommitted blocks are dropped by the service
+// after a week.
+func (u *azureUpload) putBlock(block []byte) error {
+	if u.token == "" {
+		u.token = hex.EncodeToString(randomBytes(8))
+	}
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%08d", u.token, len(u.blockIDs))))
+	query := url.Values{"comp": {"block"}, "blockid": {id}}
+	res, err := u.client.do(u.container, azureRequest{method: http.MethodPut, name: u.name, query: query, body: block})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	u.blockIDs = append(u.blockIDs, id)
+
+	return nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Cannot read random bytes: %v", err)
+	}
+
+	return b
+}
+
+// Close writes the blob, an *azureError of status 412 or 409 when a
+// condition failed.
+func (u *azureUpload) Close() error {
+	if len(u.blockIDs) == 0 {
+		header := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}
+		for key, values := range u.header {
+			header[key] = values
+		}
+		res, err := u.client.do(u.container, azureRequest{method: http.MethodPut, name: u.name, header: header, body: u.buf.Bytes()})
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+
+	if err := u.putBlock(u.buf.Next(u.buf.Len())); err != nil {
+		return err
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(xml.Header + "<BlockList>")
+	for i := range u.blockIDs {
+		blockList.WriteString("<Latest>" + u.blockIDs[i] + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	// Properties of the blob are set by the block list
+	header := http.Header{}
+	for key, values := range u.header {
+		switch key {
+		case "Content-Type":
+			header["X-Ms-Blob-Content-Type"] = values
+		case "Content-Encoding":
+			header["X-Ms-Blob-Content-Encoding"] = values
+		default:
+			header[key] = values
+		}
+	}
+	header.Set("Content-Type", "application/xml")
+
+	res, err := u.client.do(u.container, azureRequest{method: http.MethodPut, name: u.name, query: url.Values{"comp": {"blocklist"}}, header: header, body: blockList.Bytes()})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
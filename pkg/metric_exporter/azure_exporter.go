@@ -0,0 +1,397 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+type AzureBlobExporter struct {
+	ContainerName string
+	Prefix        string
+	Paths         PathBuilder
+	LabelColumns  []string
+	Overwrite     string
+	Compression   string
+	Encryption    Encryption
+
+	AccessTier string
+	Metadata   map[string]string
+	RunID      string
+	BlockSize  int
+
+	client *azureClient
+}
+
+const defaultAzureBlockSize = 16 << 20
+
+// AzureConf sets the Azure Blob Storage account written by the
+// AzureBlobExporter, the container is the destination.
+type AzureConf struct {
+	// Endpoint is the blob service URL, https://<account>.blob.core.windows.net
+	// when unset, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	Endpoint string `yaml:"endpoint"`
+
+	// AccountName with AccountKey signs requests with the shared key, or
+	// SASToken is added to them. They default to AZURE_STORAGE_ACCOUNT,
+	// AZURE_STORAGE_KEY and AZURE_STORAGE_SAS_TOKEN.
+	AccountName string `yaml:"account_name"`
+	AccountKey  string `yaml:"account_key"`
+	SASToken    string `yaml:"sas_token"`
+
+	// AccessTier of uploaded blobs: "Hot", "Cool", "Cold" or "Archive",
+	// the account default when unset.
+	AccessTier string `yaml:"access_tier"`
+
+	// BlockSize in bytes, larger files are uploaded as blocks, 16 MiB
+	// when unset.
+	BlockSize int `yaml:"block_size"`
+
+	// Metadata is added to the metadata describing every blob.
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+func init() {
+	Register(ExporterType{
+		Name:   "AzureBlobExporter",
+		Block:  "azure",
+		Config: AzureConf{},
+		Validate: func(c utils.Conf, config interface{}) error {
+			_, err := parseAzureClient(config.(AzureConf))
+			return err
+		},
+		New: func(c utils.Conf, config interface{}) MetricExporter {
+			return NewAzureBlobExporter(c, config.(AzureConf))
+		},
+	})
+}
+
+func NewAzureBlobExporter(c utils.Conf, azure AzureConf) MetricExporter {
+	exporter := AzureBlobExporter{}
+	exporter.ContainerName = c.Destination
+	if c.Prefix != "" {
+		exporter.Prefix = strings.Trim(c.Prefix, "/") + "/"
+	}
+	exporter.Paths = NewPathBuilder(c)
+	exporter.Overwrite = overwritePolicy(c.Overwrite)
+	exporter.Compression = compressionPolicy(c.Compression)
+	exporter.Encryption = NewEncryption(c.Encryption)
+	exporter.AccessTier = azure.AccessTier
+	exporter.Metadata = azure.Metadata
+	exporter.RunID = c.RunID
+	exporter.LabelColumns = c.LabelColumns
+
+	exporter.BlockSize = azure.BlockSize
+	if exporter.BlockSize <= 0 {
+		exporter.BlockSize = defaultAzureBlockSize
+	}
+
+	exporter.client = newAzureClient(azure)
+
+	return exporter
+}
+
+// azureMetadataName returns key as a blob metadata name, which must be a C#
+// identifier.
+func azureMetadataName(key string) string {
+	return "x-ms-meta-" + strings.Replace(key, "-", "_", -1)
+}
+
+func (a AzureBlobExporter) saveTimeSeriesToCSV(filename string, series Series, metricPoints []string, metadata map[string]string) (string, string, int64, error) {
+	log.Printf("Points len: %d", len(metricPoints))
+
+	header, rows := csvContent(series, metricPoints, a.LabelColumns)
+
+	return a.saveToBlob(filename, newCSVBody(header, StringRows(rows)), metadata)
+}
+
+// saveToBlob uploads body under the overwrite policy, conditional writes
+// keep concurrent writers from clobbering each other. It returns the name of
+// the blob holding body, its SHA-256 and size, an empty SHA-256 when an
+// existing blob was kept.
+func (a AzureBlobExporter) saveToBlob(filename string, body csvBody, metadata map[string]string) (string, string, int64, error) {
+	points := body.points
+	ifNoneMatch := http.Header{"If-None-Match": {"*"}}
+
+	switch a.Overwrite {
+	case OverwriteNever:
+		sum, size, ok, err := a.upload(filename, body, points, metadata, ifNoneMatch)
+		if err == nil && !ok {
+			log.Printf("Keep existing blob %s", filename)
+		}
+		return filename, sum, size, err
+	case OverwriteIfMoreComplete:
+		conditions := ifNoneMatch
+		header, ok, err := a.head(filename)
+		if err != nil {
+			return "", "", 0, err
+		}
+		if ok {
+			complete, err := a.blobCompleteness(filename, header)
+			if err != nil {
+				return "", "", 0, err
+			}
+			if complete >= points {
+				log.Printf("Keep existing blob %s, it is as complete", filename)
+				return filename, "", 0, nil
+			}
+			conditions = http.Header{"If-Match": {header.Get("ETag")}}
+		}
+		sum, size, ok, err := a.upload(filename, body, points, metadata, conditions)
+		if err == nil && !ok {
+			log.Printf("Blob %s changed during export, keep it", filename)
+		}
+		return filename, sum, size, err
+	case OverwriteVersioned:
+		name := filename
+		for version := 2; ; version++ {
+			sum, size, ok, err := a.upload(name, body, points, metadata, ifNoneMatch)
+			if err != nil || ok {
+				return name, sum, size, err
+			}
+			existing, err := a.ReadObject(name)
+			if err != nil && err != ErrObjectNotExist {
+				return "", "", 0, err
+			}
+			if err == nil && sameContent(existing, a.Compression, a.Encryption, body) {
+				log.Printf("Keep existing blob %s, it holds the same content", name)
+				return name, "", 0, nil
+			}
+			name = versionedName(filename, version)
+		}
+	default:
+		sum, size, _, err := a.upload(filename, body, points, metadata, nil)
+		return filename, sum, size, err
+	}
+}
+
+// blobHeader returns the headers of an upload: custom metadata and access
+// tier.
+func (a AzureBlobExporter) blobHeader(metadata map[string]string) http.Header {
+	header := http.Header{}
+	for key, value := range metadata {
+		header[azureMetadataName(key)] = []string{value}
+	}
+	if a.AccessTier != "" {
+		header.Set("X-Ms-Access-Tier", a.AccessTier)
+	}
+
+	return header
+}
+
+// upload streams body to name and returns the SHA-256 and size of the blob,
+// or false when one of conditions failed. Blocks of a failed upload are
+// never committed.
+func (a AzureBlobExporter) upload(name string, body csvBody, points int, metadata map[string]string, conditions http.Header) (string, int64, bool, error) {
+	header := a.blobHeader(metadata)
+	header[azureMetadataName(completenessMetadataKey)] = []string{strconv.Itoa(points)}
+	contentType, contentEncoding := contentType(a.Compression, a.Encryption)
+	header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		header.Set("Content-Encoding", contentEncoding)
+	}
+	for key, values := range conditions {
+		header[key] = values
+	}
+
+	u := &azureUpload{client: a.client, container: a.ContainerName, name: a.Prefix + name, header: header, blockSize: a.BlockSize}
+	h := sha256.New()
+	cw := newEncodeWriter(io.MultiWriter(u, h), a.Compression, a.Encryption)
+	err := body.writeTo(cw)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return "", 0, false, fmt.Errorf("cannot upload blob: %v", err)
+	}
+	if err := u.Close(); err != nil {
+		// Concurrent conditional writes of the same blob conflict
+		if isAzureStatus(err, http.StatusPreconditionFailed) || isAzureStatus(err, http.StatusConflict) {
+			return "", 0, false, nil
+		}
+		return "", 0, false, fmt.Errorf("cannot upload blob: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), u.size, true, nil
+}
+
+// head returns the properties of name, false when it does not exist.
+func (a AzureBlobExporter) head(name string) (http.Header, bool, error) {
+	res, err := a.client.do(a.ContainerName, azureRequest{method: http.MethodHead, name: a.Prefix + name})
+	if isAzureStatus(err, http.StatusNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot read blob: %v", err)
+	}
+	res.Body.Close()
+
+	return res.Header, true, nil
+}
+
+// blobCompleteness reads the completeness recorded on a blob, or counts it
+// for blobs written before it was recorded.
+func (a AzureBlobExporter) blobCompleteness(name string, header http.Header) (int, error) {
+	if points, err := strconv.Atoi(header.Get(azureMetadataName(completenessMetadataKey))); err == nil {
+		return points, nil
+	}
+
+	existing, err := a.ReadObject(name)
+	if err == ErrObjectNotExist {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	content, ok := decodeContent(existing, a.Compression, a.Encryption)
+	if !ok {
+		return 0, nil
+	}
+
+	return completeness(content), nil
+}
+
+// exportedFile describes the blob name, reading it back when an existing
+// blob was kept.
+func (a AzureBlobExporter) exportedFile(name, sum string, size int64, rows int) (ExportedFile, error) {
+	if sum == "" {
+		existing, err := a.ReadObject(name)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		sum = SHA256(existing)
+		size = int64(len(existing))
+		rows = keptRows(existing, a.Compression, a.Encryption)
+	}
+
+	return ExportedFile{Name: name, Size: size, Rows: rows, SHA256: sum, KeyIDs: a.Encryption.KeyIDs}, nil
+}
+
+func (a AzureBlobExporter) Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error) {
+	output := a.Paths.SeriesPath(dateTime, series)
+
+	metadata := exportMetadata(a.Metadata, a.Encryption, a.RunID, dateTime, series.ProjectID, series.Metric)
+	output, sum, size, err := a.saveTimeSeriesToCSV(output, series, metricPoints, metadata)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return a.exportedFile(output, sum, size, len(metricPoints))
+}
+
+func (a AzureBlobExporter) ExportProject(dateTime time.Time, projectID string, columns []string, rows RowSource) (ExportedFile, error) {
+	output := a.Paths.ProjectPath(dateTime, projectID)
+
+	body := newCSVBody(stackdriver.PointCSVHeader+","+strings.Join(columns, ","), rows)
+	log.Printf("Rows len: %d", body.rows)
+	if body.err != nil {
+		return ExportedFile{}, body.err
+	}
+	metadata := exportMetadata(a.Metadata, a.Encryption, a.RunID, dateTime, projectID, "")
+	output, sum, size, err := a.saveToBlob(output, body, metadata)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return a.exportedFile(output, sum, size, body.rows)
+}
+
+func (a AzureBlobExporter) WriteObject(name string, content []byte) error {
+	return a.WriteObjectFrom(name, bytes.NewReader(content))
+}
+
+// WriteObjectFrom leaves the blocks staged before r failed uncommitted.
+func (a AzureBlobExporter) WriteObjectFrom(name string, r io.Reader) error {
+	metadata := make(map[string]string)
+	for key, value := range a.Metadata {
+		metadata[key] = value
+	}
+	if a.RunID != "" {
+		metadata[runIDMetadataKey] = a.RunID
+	}
+
+	u := &azureUpload{client: a.client, container: a.ContainerName, name: a.Prefix + name, header: a.blobHeader(metadata), blockSize: a.BlockSize}
+	if _, err := io.Copy(u, r); err != nil {
+		return fmt.Errorf("cannot write blob: %v", err)
+	}
+	if err := u.Close(); err != nil {
+		return fmt.Errorf("cannot write blob: %v", err)
+	}
+
+	return nil
+}
+
+func (a AzureBlobExporter) ReadObject(name string) ([]byte, error) {
+	res, err := a.client.do(a.ContainerName, azureRequest{method: http.MethodGet, name: a.Prefix + name})
+	if isAzureStatus(err, http.StatusNotFound) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob: %v", err)
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob: %v", err)
+	}
+
+	return content, nil
+}
+
+func (a AzureBlobExporter) DeleteObject(name string) error {
+	res, err := a.client.do(a.ContainerName, azureRequest{method: http.MethodDelete, name: a.Prefix + name})
+	if isAzureStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot delete blob: %v", err)
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+func (a AzureBlobExporter) ListObjects(prefix string) (names []string, err error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {a.Prefix + prefix}}
+	for {
+		res, err := a.client.do(a.ContainerName, azureRequest{method: http.MethodGet, query: query})
+		if err != nil {
+			return nil, fmt.Errorf("cannot list blobs: %v", err)
+		}
+
+		var result struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list blobs: %v", err)
+		}
+
+		for i := range result.Blobs {
+			names = append(names, strings.TrimPrefix(result.Blobs[i].Name, a.Prefix))
+		}
+
+		if result.NextMarker == "" {
+			return names, nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
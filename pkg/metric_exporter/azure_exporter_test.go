@@ -0,0 +1,275 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// azuriteAccountKey is the key of devstoreaccount1, the well-known account
+// of Azurite and the storage emulator.
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// Requests sent by the Azure SDK for Go (azblob v1.6.4) with the shared key
+// of azuriteAccountKey, and the authorization it signed them with.
+func TestAzureSign(t *testing.T) {
+	blob := "/metrics/p%2F2018%2F10%2F18%2Fweb_1%2F2018-10-18%5Bweb_1%5D%5Bcpu_usage_time%5D.csv"
+	date := "Mon, 19 Oct 2026 14:22:50 GMT"
+
+	tests := []struct {
+		method        string
+		url           string
+		header        http.Header
+		contentLength int
+		authorization string
+	}{
+		{
+			http.MethodPut, "http://127.0.0.1:10000/devstoreaccount1" + blob,
+			http.Header{
+				"Content-Type":               {"application/octet-stream"},
+				"If-None-Match":              {"*"},
+				"X-Ms-Blob-Content-Encoding": {"gzip"},
+				"X-Ms-Blob-Content-Type":     {"text/csv"},
+				"X-Ms-Blob-Type":             {"BlockBlob"},
+				"x-ms-meta-RunID":            {"run"},
+				"x-ms-meta-points":           {"1"},
+			},
+			37, "SharedKey devstoreaccount1:8hsar5uILhAQbHC9DYCIsJxCDVtyXnbxBBArjreZyxE=",
+		},
+		{
+			http.MethodPut, "http://127.0.0.1:10000/devstoreaccount1" + blob + "?blockid=YmxvY2stMDAwMDAwMDA%3D&comp=block",
+			http.Header{"Content-Type": {"application/octet-stream"}},
+			100, "SharedKey devstoreaccount1:mChXWbwBl0yK3lOHZpNm/OAP7g3Hx3M1j/m+3rU/V7M=",
+		},
+		{
+			http.MethodPut, "http://127.0.0.1:10000/devstoreaccount1" + blob + "?comp=blocklist",
+			http.Header{"Content-Type": {"application/xml"}, "If-Match": {`"0x8D9"`}, "X-Ms-Blob-Content-Type": {"text/csv"}},
+			99, "SharedKey devstoreaccount1:awf1022zyYbCQsQHHuS2fGgC6TzqkQjd4a8DTBKkEWQ=",
+		},
+		{
+			http.MethodGet, "http://127.0.0.1:10000/devstoreaccount1/metrics?comp=list&marker=2%2192%21MDAw&prefix=_reports%2F2018-10-18%2F&restype=container",
+			http.Header{},
+			0, "SharedKey devstoreaccount1:RDDOtdD2yD1wTw+s1S/sEqhnMHxLTtSWcAewjsyTyY0=",
+		},
+		{
+			http.MethodPut, "https://myaccount.blob.core.windows.net" + blob,
+			http.Header{
+				"Content-Type":               {"application/octet-stream"},
+				"If-None-Match":              {"*"},
+				"X-Ms-Blob-Content-Encoding": {"gzip"},
+				"X-Ms-Blob-Content-Type":     {"text/csv"},
+				"X-Ms-Blob-Type":             {"BlockBlob"},
+				"x-ms-meta-RunID":            {"run"},
+				"x-ms-meta-points":           {"1"},
+			},
+			37, "SharedKey myaccount:bK3xZGm92TwwKWHbGr3g91JkEjjfNn5EcTH3DBNiW2M=",
+		},
+		{
+			http.MethodGet, "https://myaccount.blob.core.windows.net" + blob,
+			http.Header{},
+			0, "SharedKey myaccount:T0q0nWiDEh0Ye9ZlyQWvna4DAouoQsu8HEXKGuCt4b4=",
+		},
+		{
+			http.MethodDelete, "https://myaccount.blob.core.windows.net" + blob,
+			http.Header{},
+			0, "SharedKey myaccount:BfMW+u0AhEbor8a24QPwMMVOQ/9/02aK+k6WWtcjQFU=",
+		},
+		{
+			http.MethodPut, "https://myaccount.blob.core.windows.net/metrics?restype=container",
+			http.Header{},
+			0, "SharedKey myaccount:qeXvFMwhLu2iteHHgMBu1By4HtBmbSzkqHvLE8p5q0o=",
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, values := range test.header {
+			req.Header[key] = values
+		}
+		req.Header.Set("X-Ms-Date", date)
+		req.Header.Set("X-Ms-Version", "2026-02-06")
+
+		account := strings.SplitN(strings.TrimPrefix(test.authorization, "SharedKey "), ":", 2)[0]
+		c := newAzureClient(AzureConf{Endpoint: test.url, AccountName: account, AccountKey: azuriteAccountKey})
+		c.sign(req, test.contentLength)
+		if got := req.Header.Get("Authorization"); got != test.authorization {
+			t.Errorf("%s %s: got %s, want %s", test.method, test.url, got, test.authorization)
+		}
+	}
+}
+
+func TestAzureBlockIDs(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.URL.Query().Get("blockid"); id != "" {
+			mu.Lock()
+			ids = append(ids, id)
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := newAzureClient(AzureConf{Endpoint: server.URL, AccountName: "devstoreaccount1", AccountKey: azuriteAccountKey})
+	for i := 0; i < 2; i++ {
+		u := &azureUpload{client: client, container: "c", name: "a.csv", blockSize: 4}
+		if _, err := u.Write(bytes.Repeat([]byte("a"), 16)); err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two uploads of 4 blocks each, every ID of a blob as long
+	seen := make(map[string]bool)
+	for i := range ids {
+		decoded, err := base64.StdEncoding.DecodeString(ids[i])
+		if err != nil || len(decoded) != 25 || seen[ids[i]] {
+			t.Errorf("got block ID %q, %s", ids[i], decoded)
+		}
+		seen[ids[i]] = true
+	}
+	if len(ids) != 8 {
+		t.Errorf("got %d blocks, want 8", len(ids))
+	}
+}
+
+// testAzureExporter returns an exporter of a new container of the blob
+// service at AZURE_TEST_ENDPOINT, e.g. Azurite at
+// http://127.0.0.1:10000/devstoreaccount1, and skips the test without it.
+// The account defaults to the well-known account of Azurite.
+func testAzureExporter(t *testing.T, c utils.Conf, azure AzureConf) AzureBlobExporter {
+	t.Helper()
+
+	azure.Endpoint = os.Getenv("AZURE_TEST_ENDPOINT")
+	if azure.Endpoint == "" {
+		t.Skip("AZURE_TEST_ENDPOINT is not set")
+	}
+	if os.Getenv("AZURE_STORAGE_ACCOUNT") == "" {
+		azure.AccountName, azure.AccountKey = "devstoreaccount1", azuriteAccountKey
+	}
+
+	c.Destination = fmt.Sprintf("test-%d", time.Now().UnixNano())
+	a := NewAzureBlobExporter(c, azure).(AzureBlobExporter)
+	res, err := a.client.do(a.ContainerName, azureRequest{method: http.MethodPut, query: url.Values{"restype": {"container"}}})
+	if err != nil {
+		t.Fatalf("Cannot create container: %v", err)
+	}
+	res.Body.Close()
+
+	return a
+}
+
+func TestAzureSaveToBlob(t *testing.T) {
+	partial := testBody("60,00:01,1.0", "120,00:02,")
+	complete := testBody("60,00:01,1.0", "120,00:02,2.0")
+
+	tests := []struct {
+		policy  string
+		first   csvBody
+		second  csvBody
+		name    string
+		kept    bool
+		content csvBody
+	}{
+		{OverwriteAlways, complete, partial, "a.csv", false, partial},
+		{OverwriteNever, partial, complete, "a.csv", true, partial},
+		{OverwriteIfMoreComplete, partial, complete, "a.csv", false, complete},
+		{OverwriteIfMoreComplete, complete, partial, "a.csv", true, complete},
+		{OverwriteVersioned, partial, complete, "a.v2.csv", false, complete},
+		{OverwriteVersioned, complete, complete, "a.csv", true, complete},
+	}
+
+	for _, test := range tests {
+		// Blocks of 16 bytes, so both the single and block list writes
+		// are conditional
+		for _, blockSize := range []int{defaultAzureBlockSize, 16} {
+			a := testAzureExporter(t, utils.Conf{Overwrite: test.policy}, AzureConf{BlockSize: blockSize})
+
+			if _, _, _, err := a.saveToBlob("a.csv", test.first, nil); err != nil {
+				t.Fatal(err)
+			}
+			name, sum, _, err := a.saveToBlob("a.csv", test.second, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if name != test.name || (sum == "") != test.kept {
+				t.Errorf("%s, blocks of %d: got %s, kept %v, want %s, kept %v", test.policy, blockSize, name, sum == "", test.name, test.kept)
+			}
+			if content, _ := a.ReadObject(name); string(content) != readBody(t, test.content) {
+				t.Errorf("%s, blocks of %d: %s holds %q", test.policy, blockSize, name, content)
+			}
+		}
+	}
+}
+
+func TestAzureConcurrentBlocks(t *testing.T) {
+	a := testAzureExporter(t, utils.Conf{}, AzureConf{BlockSize: 16})
+
+	// Uploads of the same blob staging blocks at once commit their own
+	// blocks. A commit drops the blocks left uncommitted, so the other may
+	// fail, but the blob never mixes both.
+	contents := []string{strings.Repeat("a", 100), strings.Repeat("b", 100)}
+	var wg sync.WaitGroup
+	for i := range contents {
+		wg.Add(1)
+		go func(content string) {
+			defer wg.Done()
+			a.WriteObject("a.csv", []byte(content))
+		}(contents[i])
+	}
+	wg.Wait()
+
+	if content, err := a.ReadObject("a.csv"); err != nil || string(content) != contents[0] && string(content) != contents[1] {
+		t.Errorf("blob holds %q, %v", content, err)
+	}
+}
+
+func TestAzureObjects(t *testing.T) {
+	a := testAzureExporter(t, utils.Conf{Prefix: "exports", RunID: "run"}, AzureConf{Metadata: map[string]string{"team": "ops"}})
+
+	want := []string{"_reports/a.json", "_reports/b.json", "p/c.csv"}
+	for _, name := range want {
+		if err := a.WriteObject(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if names, err := a.ListObjects(""); err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %v, %v", names, err)
+	}
+	if names, err := a.ListObjects("_reports/"); err != nil || len(names) != 2 {
+		t.Errorf("listed %v under _reports/, %v", names, err)
+	}
+
+	header, ok, err := a.head("p/c.csv")
+	if !ok || err != nil || header.Get("X-Ms-Meta-Team") != "ops" || header.Get(azureMetadataName(runIDMetadataKey)) != "run" {
+		t.Errorf("got properties %v, %v", header, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := a.DeleteObject("p/c.csv"); err != nil {
+			t.Errorf("delete: %v", err)
+		}
+	}
+	if _, err := a.ReadObject("p/c.csv"); err != ErrObjectNotExist {
+		t.Errorf("read a deleted object: %v", err)
+	}
+}
@@ -0,0 +1,693 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// BigQueryExporter loads every series into a table partitioned by day and
+// clustered by project, metric and instance, one row per point. Series are
+// streamed into a staging table, then merged into the table once per
+// project and day.
+type BigQueryExporter struct {
+	ProjectID string
+	DatasetID string
+	TableID   string
+	Location  string
+	Overwrite string
+	RunID     string
+
+	PartitionExpiration time.Duration
+
+	client *bigquery.Client
+}
+
+// bigQuerySchema is the schema of the table. A series is identified by
+// date, project_id, metric and series, each of its loads by load_id.
+var bigQuerySchema = bigquery.Schema{
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "timestamp", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "project_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "metric", Type: bigquery.StringFieldType, Required: true},
+	{Name: "series", Type: bigquery.StringFieldType, Required: true},
+	{Name: "zone", Type: bigquery.StringFieldType},
+	{Name: "instance_id", Type: bigquery.StringFieldType},
+	{Name: "instance_name", Type: bigquery.StringFieldType},
+	{Name: "attend", Type: bigquery.StringFieldType},
+	{Name: "group_name", Type: bigquery.StringFieldType},
+	{Name: "value", Type: bigquery.FloatFieldType},
+	{Name: "columns", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "name", Type: bigquery.StringFieldType},
+		{Name: "value", Type: bigquery.StringFieldType},
+	}},
+	{Name: "labels", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "key", Type: bigquery.StringFieldType},
+		{Name: "value", Type: bigquery.StringFieldType},
+	}},
+	{Name: "run_id", Type: bigquery.StringFieldType},
+	{Name: "load_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "exported_at", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+var bigQueryClustering = []string{"project_id", "metric", "instance_id"}
+
+// bigQueryPlanSchema is the schema of the plans table, the number of series
+// each run plans for a project and day.
+var bigQueryPlanSchema = bigquery.Schema{
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "project_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "run_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "series_count", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "planned_at", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+// bigQueryStagedSchema is the schema of the series table, a row per series
+// each run staged, points or not.
+var bigQueryStagedSchema = bigquery.Schema{
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "project_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "run_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "metric", Type: bigquery.StringFieldType, Required: true},
+	{Name: "series", Type: bigquery.StringFieldType, Required: true},
+	{Name: "load_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "staged_at", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+// Tables next to the destination table, named after it, whose rows are only
+// needed until the run is merged.
+const (
+	bigQueryStagingSuffix = "_staging"
+	bigQueryPlansSuffix   = "_plans"
+	bigQuerySeriesSuffix  = "_series"
+	bigQueryStagingExpiry = 7 * 24 * time.Hour
+)
+
+// bigQueryInsertTimeout bounds the streaming insert of a series, which the
+// client otherwise retries indefinitely.
+const bigQueryInsertTimeout = 5 * time.Minute
+
+// BigQueryConf sets where the BigQueryExporter loads series, the destination
+// is the "dataset.table" or "project.dataset.table" written.
+type BigQueryConf struct {
+	// Project runs the load and query jobs and holds the dataset unless the
+	// destination names another, GOOGLE_CLOUD_PROJECT when unset.
+	Project string `yaml:"project"`
+
+	// Location of the dataset and jobs, e.g. "US" or "asia-east1".
+	Location string `yaml:"location"`
+
+	// PartitionExpirationDays drops daily partitions that much older, kept
+	// forever when unset.
+	PartitionExpirationDays int `yaml:"partition_expiration_days"`
+
+	// Endpoint sends every BigQuery request to another server, e.g. a local
+	// BigQuery emulator, without credentials.
+	Endpoint string `yaml:"endpoint"`
+}
+
+func init() {
+	Register(ExporterType{
+		Name:   "BigQueryExporter",
+		Block:  "bigquery",
+		Config: BigQueryConf{},
+		Validate: func(c utils.Conf, config interface{}) error {
+			return validateBigQuery(c, config.(BigQueryConf))
+		},
+		New: func(c utils.Conf, config interface{}) MetricExporter {
+			return NewBigQueryExporter(c, config.(BigQueryConf))
+		},
+	})
+}
+
+func NewBigQueryExporter(c utils.Conf, bq BigQueryConf) MetricExporter {
+	exporter := BigQueryExporter{}
+	exporter.ProjectID = bq.Project
+	if exporter.ProjectID == "" {
+		exporter.ProjectID = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+
+	parts, err := parseBigQueryDestination(c.Destination)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if len(parts) == 3 {
+		exporter.ProjectID, parts = parts[0], parts[1:]
+	}
+	exporter.DatasetID, exporter.TableID = parts[0], parts[1]
+
+	exporter.Location = bq.Location
+	exporter.Overwrite = overwritePolicy(c.Overwrite)
+	exporter.RunID = c.RunID
+	exporter.PartitionExpiration = time.Duration(bq.PartitionExpirationDays) * 24 * time.Hour
+	exporter.client = sharedBigQueryClient(exporter.ProjectID, bq.Endpoint)
+
+	return exporter
+}
+
+// validateBigQuery checks the destination table and the endpoint.
+func validateBigQuery(c utils.Conf, bq BigQueryConf) error {
+	if _, err := parseBigQueryDestination(c.Destination); err != nil {
+		return err
+	}
+
+	if bq.Endpoint != "" {
+		if _, err := parseEndpoint("BigQuery", bq.Endpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseBigQueryDestination splits a dataset.table or project.dataset.table
+// destination.
+func parseBigQueryDestination(destination string) ([]string, error) {
+	parts := strings.Split(destination, ".")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("BigQuery destination %q is not dataset.table or project.dataset.table", destination)
+	}
+	for i := range parts {
+		if parts[i] == "" {
+			return nil, fmt.Errorf("BigQuery destination %q has an empty part", destination)
+		}
+	}
+
+	return parts, nil
+}
+
+var bigQueryClients = struct {
+	sync.Mutex
+	byProject map[[2]string]*bigquery.Client
+
+	// tables already checked to exist
+	tables map[string]bool
+}{byProject: make(map[[2]string]*bigquery.Client), tables: make(map[string]bool)}
+
+// sharedBigQueryClient returns the client of projectID, created on first
+// use and kept for the process lifetime. An endpoint sends the requests to
+// another server.
+func sharedBigQueryClient(projectID, endpoint string) *bigquery.Client {
+	bigQueryClients.Lock()
+	defer bigQueryClients.Unlock()
+
+	key := [2]string{projectID, endpoint}
+	if client, ok := bigQueryClients.byProject[key]; ok {
+		return client
+	}
+
+	var opts []option.ClientOption
+	if endpoint != "" {
+		u, err := parseEndpoint("BigQuery", endpoint)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: endpointTransport{u}}))
+	}
+
+	client, err := bigquery.NewClient(context.Background(), projectID, opts...)
+	if err != nil {
+		log.Fatalf("Failed to create BigQuery client: %v", err)
+	}
+	bigQueryClients.byProject[key] = client
+
+	return client
+}
+
+func (b BigQueryExporter) table() *bigquery.Table {
+	return b.client.DatasetInProject(b.ProjectID, b.DatasetID).Table(b.TableID)
+}
+
+func (b BigQueryExporter) stagingTable() *bigquery.Table {
+	return b.client.DatasetInProject(b.ProjectID, b.DatasetID).Table(b.TableID + bigQueryStagingSuffix)
+}
+
+func (b BigQueryExporter) plansTable() *bigquery.Table {
+	return b.client.DatasetInProject(b.ProjectID, b.DatasetID).Table(b.TableID + bigQueryPlansSuffix)
+}
+
+func (b BigQueryExporter) seriesTable() *bigquery.Table {
+	return b.client.DatasetInProject(b.ProjectID, b.DatasetID).Table(b.TableID + bigQuerySeriesSuffix)
+}
+
+// loadName names a load of the table in export results.
+func (b BigQueryExporter) loadName(loadID string) string {
+	return fmt.Sprintf("%s.%s.%s/%s", b.ProjectID, b.DatasetID, b.TableID, loadID)
+}
+
+// tableName is the standard SQL name of the table, or of the table next to
+// it with suffix.
+func (b BigQueryExporter) tableName(suffix string) string {
+	return fmt.Sprintf("`%s.%s.%s%s`", b.ProjectID, b.DatasetID, b.TableID, suffix)
+}
+
+// ensureTable creates the dataset, the table and the staging, plans and
+// series tables next to it when missing, once per process. The tables next
+// to it are partitioned by when rows were written, so they expire whatever
+// day is exported.
+func (b BigQueryExporter) ensureTable(ctx context.Context) error {
+	bigQueryClients.Lock()
+	defer bigQueryClients.Unlock()
+
+	name := b.tableName("")
+	if bigQueryClients.tables[name] {
+		return nil
+	}
+
+	dataset := b.client.DatasetInProject(b.ProjectID, b.DatasetID)
+	if _, err := dataset.Metadata(ctx); isGoogleAPIStatus(err, http.StatusNotFound) {
+		err = dataset.Create(ctx, &bigquery.DatasetMetadata{Location: b.Location})
+		if err != nil && !isGoogleAPIStatus(err, http.StatusConflict) {
+			return fmt.Errorf("cannot create dataset: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("cannot read dataset: %v", err)
+	}
+
+	tables := []struct {
+		table    *bigquery.Table
+		metadata *bigquery.TableMetadata
+	}{
+		{b.table(), &bigquery.TableMetadata{
+			Schema:           bigQuerySchema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "date", Expiration: b.PartitionExpiration},
+			Clustering:       &bigquery.Clustering{Fields: bigQueryClustering},
+		}},
+		{b.stagingTable(), &bigquery.TableMetadata{
+			Schema:           bigQuerySchema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "exported_at", Expiration: bigQueryStagingExpiry},
+			Clustering:       &bigquery.Clustering{Fields: []string{"project_id", "run_id"}},
+		}},
+		{b.plansTable(), &bigquery.TableMetadata{
+			Schema:           bigQueryPlanSchema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "planned_at", Expiration: bigQueryStagingExpiry},
+		}},
+		{b.seriesTable(), &bigquery.TableMetadata{
+			Schema:           bigQueryStagedSchema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "staged_at", Expiration: bigQueryStagingExpiry},
+		}},
+	}
+	for i := range tables {
+		if _, err := tables[i].table.Metadata(ctx); isGoogleAPIStatus(err, http.StatusNotFound) {
+			err = tables[i].table.Create(ctx, tables[i].metadata)
+			// Export tasks of the same run race to create it
+			if err != nil && !isGoogleAPIStatus(err, http.StatusConflict) {
+				return fmt.Errorf("cannot create table %s: %v", tables[i].table.TableID, err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("cannot read table %s: %v", tables[i].table.TableID, err)
+		}
+	}
+
+	bigQueryClients.tables[name] = true
+
+	return nil
+}
+
+func isGoogleAPIStatus(err error, status int) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == status
+}
+
+// bigQueryRow is one point of a series, as loaded.
+type bigQueryRow struct {
+	Date         string           `json:"date"`
+	Timestamp    string           `json:"timestamp"`
+	ProjectID    string           `json:"project_id"`
+	Metric       string           `json:"metric"`
+	Series       string           `json:"series"`
+	Zone         string           `json:"zone,omitempty"`
+	InstanceID   string           `json:"instance_id,omitempty"`
+	InstanceName string           `json:"instance_name,omitempty"`
+	Attend       string           `json:"attend,omitempty"`
+	GroupName    string           `json:"group_name,omitempty"`
+	Value        *float64         `json:"value"`
+	Columns      []bigQueryColumn `json:"columns,omitempty"`
+	Labels       []bigQueryLabel  `json:"labels,omitempty"`
+	RunID        string           `json:"run_id,omitempty"`
+	LoadID       string           `json:"load_id"`
+	ExportedAt   string           `json:"exported_at"`
+}
+
+type bigQueryColumn struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type bigQueryLabel struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// bigQuerySeries names the series within its project and metric: the
+// instance, then the attend names and group it was selected through.
+func bigQuerySeries(series Series) string {
+	name := series.InstanceLabel(false)
+	if len(series.AttendNames) > 0 {
+		name = fmt.Sprintf("%s[%s]", name, strings.Join(series.AttendNames, "-"))
+	}
+	if series.Group != "" {
+		name = fmt.Sprintf("%s[%s]", name, series.Group)
+	}
+
+	return name
+}
+
+func parseBigQueryValue(value string) *float64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &v
+}
+
+// bigQueryRows converts metricPoints, "timestamp,datetime,value" CSV rows
+// followed by the series columns, to the rows of the table.
+func bigQueryRows(dateTime time.Time, series Series, metricPoints []string) (rows []bigQueryRow) {
+	var labels []bigQueryLabel
+	keys := make([]string, 0, len(series.Labels))
+	for key := range series.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i := range keys {
+		labels = append(labels, bigQueryLabel{keys[i], series.Labels[keys[i]]})
+	}
+
+	for i := range metricPoints {
+		fields := strings.Split(metricPoints[i], ",")
+		if len(fields) < 3 {
+			continue
+		}
+
+		seconds, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		row := bigQueryRow{
+			Date:         dateTime.Format("2006-01-02"),
+			Timestamp:    time.Unix(seconds, 0).UTC().Format(time.RFC3339),
+			ProjectID:    series.ProjectID,
+			Metric:       series.Metric,
+			Series:       bigQuerySeries(series),
+			Zone:         series.Zone,
+			InstanceID:   series.InstanceID,
+			InstanceName: series.InstanceName,
+			Attend:       strings.Join(series.AttendNames, "-"),
+			GroupName:    series.Group,
+			Labels:       labels,
+		}
+
+		row.Value = parseBigQueryValue(fields[2])
+
+		for j := range series.Columns {
+			if 3+j < len(fields) {
+				row.Columns = append(row.Columns, bigQueryColumn{series.Columns[j], fields[3+j]})
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return
+}
+
+// bigQuerySaver streams a row, deduplicated by insertID on a best-effort
+// basis.
+type bigQuerySaver struct {
+	row      bigQueryRow
+	insertID string
+}
+
+func (s bigQuerySaver) Save() (map[string]bigquery.Value, string, error) {
+	content, err := json.Marshal(s.row)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var row map[string]bigquery.Value
+	if err := json.Unmarshal(content, &row); err != nil {
+		return nil, "", err
+	}
+
+	return row, s.insertID, nil
+}
+
+// Export stages the points of series, they are merged into the table by
+// LoadProject once every series of the project is staged. Loads are
+// identified by their content, so exporting the same points again changes
+// nothing.
+func (b BigQueryExporter) Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error) {
+	ctx := context.Background()
+	if err := b.ensureTable(ctx); err != nil {
+		return ExportedFile{}, err
+	}
+
+	rows := bigQueryRows(dateTime, series, metricPoints)
+
+	// The load ID hashes the series and its points, not when they were
+	// exported
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", dateTime.Format("2006-01-02"), series.ProjectID, series.Metric, bigQuerySeries(series))
+	for i := range metricPoints {
+		fmt.Fprintf(h, "%s\n", metricPoints[i])
+	}
+	loadID := "stackdriver_" + hex.EncodeToString(h.Sum(nil))[:40]
+
+	// Attempts are told apart by exported_at, the merge takes one
+	exportedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	savers := make([]bigquery.ValueSaver, len(rows))
+	for i := range rows {
+		rows[i].RunID = b.RunID
+		rows[i].LoadID = loadID
+		rows[i].ExportedAt = exportedAt
+		if err := encoder.Encode(rows[i]); err != nil {
+			return ExportedFile{}, fmt.Errorf("cannot encode rows: %v", err)
+		}
+		// Retries of the run are deduplicated, later runs stage their own
+		savers[i] = bigQuerySaver{rows[i], fmt.Sprintf("%s_%s_%d", b.RunID, loadID, i)}
+	}
+
+	// One request, which fails as a whole on an invalid row, so a series
+	// is staged entirely or not at all
+	ctx, cancel := context.WithTimeout(ctx, bigQueryInsertTimeout)
+	defer cancel()
+	if len(savers) > 0 {
+		if err := b.stagingTable().Uploader().Put(ctx, savers); err != nil {
+			return ExportedFile{}, fmt.Errorf("cannot stage series: %v", err)
+		}
+	}
+
+	// Then the series is counted as staged, even without points
+	staged := &bigquery.ValuesSaver{
+		Schema:   bigQueryStagedSchema,
+		InsertID: fmt.Sprintf("%s_%s", b.RunID, loadID),
+		Row:      []bigquery.Value{civil.DateOf(dateTime), series.ProjectID, b.RunID, series.Metric, bigQuerySeries(series), loadID, time.Now()},
+	}
+	if err := b.seriesTable().Uploader().Put(ctx, staged); err != nil {
+		return ExportedFile{}, fmt.Errorf("cannot record the staged series: %v", err)
+	}
+
+	return ExportedFile{Name: b.loadName(loadID), Size: int64(content.Len()), Rows: len(rows), SHA256: SHA256(content.Bytes())}, nil
+}
+
+// PlanProject records the number of series the run plans for projectID on
+// dateTime's day, LoadProject waits for as many.
+func (b BigQueryExporter) PlanProject(dateTime time.Time, projectID string, planned []Series) error {
+	ctx := context.Background()
+	if err := b.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	saver := &bigquery.ValuesSaver{
+		Schema:   bigQueryPlanSchema,
+		InsertID: fmt.Sprintf("%s_%s_%s", dateTime.Format("2006-01-02"), projectID, b.RunID),
+		Row:      []bigquery.Value{civil.DateOf(dateTime), projectID, b.RunID, len(planned), time.Now()},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bigQueryInsertTimeout)
+	defer cancel()
+	if err := b.plansTable().Uploader().Put(ctx, saver); err != nil {
+		return fmt.Errorf("cannot write the plan: %v", err)
+	}
+
+	return nil
+}
+
+func (b BigQueryExporter) projectParameters(dateTime time.Time, projectID string) []bigquery.QueryParameter {
+	return []bigquery.QueryParameter{
+		{Name: "date", Value: civil.DateOf(dateTime)},
+		{Name: "project_id", Value: projectID},
+		{Name: "run_id", Value: b.RunID},
+	}
+}
+
+// stagedSeries returns the number of series the run planned and staged for
+// projectID on dateTime's day, no plan planning none. Staged series are
+// counted in the series table, which also records those without points.
+func (b BigQueryExporter) stagedSeries(ctx context.Context, dateTime time.Time, projectID string) (planned, staged int64, err error) {
+	q := b.client.Query(`SELECT
+  (SELECT MAX(series_count) FROM ` + b.tableName(bigQueryPlansSuffix) + `
+    WHERE date = @date AND project_id = @project_id AND run_id = @run_id),
+  (SELECT COUNT(*) FROM (
+    SELECT DISTINCT metric, series FROM ` + b.tableName(bigQuerySeriesSuffix) + `
+    WHERE date = @date AND project_id = @project_id AND run_id = @run_id))`)
+	q.Parameters = b.projectParameters(dateTime, projectID)
+	q.Location = b.Location
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot query staged series: %v", err)
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		return 0, 0, fmt.Errorf("cannot query staged series: %v", err)
+	}
+
+	if row[0] != nil {
+		planned = row[0].(int64)
+	}
+	return planned, row[1].(int64), nil
+}
+
+// bigQueryRanks orders the loads of a series under each overwrite policy,
+// the first is kept. The versioned policy keeps them all.
+var bigQueryRanks = map[string]string{
+	OverwriteAlways:         "exported_at DESC, load_id",
+	OverwriteNever:          "loaded DESC, exported_at, load_id",
+	OverwriteIfMoreComplete: "points DESC, loaded DESC, exported_at DESC, load_id",
+}
+
+// mergeQuery returns the MERGE replacing, in one statement, the rows of
+// every series the run staged for a project and day by those of the load
+// the overwrite policy keeps among the staged and loaded ones. Running it
+// again, or at once with another, keeps the same load.
+func (b BigQueryExporter) mergeQuery() string {
+	columns := make([]string, len(bigQuerySchema))
+	values := make([]string, len(bigQuerySchema))
+	for i := range bigQuerySchema {
+		columns[i] = bigQuerySchema[i].Name
+		values[i] = "S.point." + bigQuerySchema[i].Name
+	}
+
+	kept := `SELECT * FROM candidates`
+	removed := ``
+	if rank, ok := bigQueryRanks[b.Overwrite]; ok {
+		kept = `SELECT * EXCEPT (n) FROM (
+      SELECT *, ROW_NUMBER() OVER (PARTITION BY metric, series ORDER BY ` + rank + `) AS n
+      FROM candidates)
+    WHERE n = 1`
+		removed = `
+  UNION ALL
+  SELECT metric, series, load_id, NULL FROM kept`
+	}
+
+	return `MERGE ` + b.tableName("") + ` T
+USING (
+  WITH staged AS (
+    SELECT * FROM ` + b.tableName(bigQueryStagingSuffix) + `
+    WHERE date = @date AND project_id = @project_id AND IFNULL(run_id, '') = @run_id
+  ),
+  attempts AS (
+    SELECT metric, series, load_id, exported_at, COUNT(*) AS total_rows,
+      COUNTIF(value IS NOT NULL) AS points
+    FROM staged
+    GROUP BY metric, series, load_id, exported_at
+  ),
+  staged_loads AS (
+    SELECT * EXCEPT (n) FROM (
+      SELECT *, ROW_NUMBER() OVER (PARTITION BY metric, series, load_id ORDER BY total_rows DESC, exported_at DESC) AS n
+      FROM attempts)
+    WHERE n = 1
+  ),
+  table_loads AS (
+    SELECT metric, series, load_id, MAX(exported_at) AS exported_at,
+      COUNTIF(value IS NOT NULL) AS points
+    FROM ` + b.tableName("") + ` t
+    WHERE date = @date AND project_id = @project_id
+      AND EXISTS (SELECT 1 FROM staged_loads s WHERE s.metric = t.metric AND s.series = t.series)
+    GROUP BY metric, series, load_id
+  ),
+  candidates AS (
+    SELECT metric, series, load_id, s.exported_at AS attempt,
+      l.points IS NOT NULL AS loaded,
+      GREATEST(IFNULL(s.exported_at, l.exported_at), IFNULL(l.exported_at, s.exported_at)) AS exported_at,
+      IFNULL(s.points, l.points) AS points
+    FROM staged_loads s FULL JOIN table_loads l USING (metric, series, load_id)
+  ),
+  kept AS (
+    ` + kept + `
+  )
+  SELECT k.metric, k.series, CAST(NULL AS STRING) AS keep_load_id, s AS point
+  FROM kept k JOIN staged s
+    ON s.metric = k.metric AND s.series = k.series AND s.load_id = k.load_id AND s.exported_at = k.attempt
+  WHERE NOT k.loaded` + removed + `
+) S
+ON S.point IS NULL AND T.date = @date AND T.project_id = @project_id
+  AND T.metric = S.metric AND T.series = S.series
+WHEN MATCHED AND T.load_id != S.keep_load_id THEN
+  DELETE
+WHEN NOT MATCHED BY TARGET AND S.point IS NOT NULL THEN
+  INSERT (` + strings.Join(columns, ", ") + `)
+  VALUES (` + strings.Join(values, ", ") + `)`
+}
+
+// LoadProject merges the series the run staged for projectID on dateTime's
+// day into the table, once all those planned are staged, and reports
+// whether it did. A project costs one query job whatever its number of
+// series.
+func (b BigQueryExporter) LoadProject(dateTime time.Time, projectID string) (bool, error) {
+	ctx := context.Background()
+	if err := b.ensureTable(ctx); err != nil {
+		return false, err
+	}
+
+	planned, staged, err := b.stagedSeries(ctx, dateTime, projectID)
+	if err != nil {
+		return false, err
+	}
+	if planned == 0 || staged < planned {
+		log.Printf("Staged %d of %d series of project ID: %s", staged, planned, projectID)
+		return false, nil
+	}
+
+	q := b.client.Query(b.mergeQuery())
+	q.Parameters = b.projectParameters(dateTime, projectID)
+	q.Location = b.Location
+
+	job, err := q.Run(ctx)
+	if err == nil {
+		var status *bigquery.JobStatus
+		status, err = job.Wait(ctx)
+		if err == nil {
+			err = status.Err()
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot merge series: %v", err)
+	}
+	log.Printf("Merge %d series of project ID %s into %s", staged, projectID, b.tableName(""))
+
+	return true, nil
+}
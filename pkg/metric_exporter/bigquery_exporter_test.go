@@ -0,0 +1,330 @@
+package metric_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"google.golang.org/api/iterator"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestBigQueryRows(t *testing.T) {
+	series := testSeries("compute.googleapis.com/instance/disk/write_ops_count", "disk", "sda")
+	series.Columns = []string{"device"}
+	series.Labels = map[string]string{"team": "ops", "env": "prod"}
+
+	rows := bigQueryRows(testDate, series, []string{"1539820860,00:01,1.5,sda", "1539820920,00:02,", "bad"})
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+
+	want := bigQueryRow{
+		Date:         "2018-10-18",
+		Timestamp:    "2018-10-18T00:01:00Z",
+		ProjectID:    "p",
+		Metric:       series.Metric,
+		Series:       "web_1234[disk-sda]",
+		Zone:         "asia-east1-a",
+		InstanceID:   "1234",
+		InstanceName: "web",
+		Attend:       "disk-sda",
+		Value:        rows[0].Value,
+		Columns:      []bigQueryColumn{{"device", "sda"}},
+		Labels:       []bigQueryLabel{{"env", "prod"}, {"team", "ops"}},
+	}
+	if !reflect.DeepEqual(rows[0], want) || *rows[0].Value != 1.5 {
+		t.Errorf("got %+v, want %+v", rows[0], want)
+	}
+	if rows[1].Value != nil {
+		t.Errorf("got value %v of a point without data", *rows[1].Value)
+	}
+}
+
+// TestBigQueryStage checks Export streams a series in one insert request,
+// under insert IDs derived from its run and content, then records it in the
+// series table.
+func TestBigQueryStage(t *testing.T) {
+	var mu sync.Mutex
+	var inserts, staged []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/insertAll") {
+			var req map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			if strings.Contains(r.URL.Path, "/series"+bigQuerySeriesSuffix+"/") {
+				staged = append(staged, req)
+			} else {
+				inserts = append(inserts, req)
+			}
+			mu.Unlock()
+		}
+		// Every dataset and table exists
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	b := NewBigQueryExporter(utils.Conf{Destination: "x.metrics.series", RunID: "run"}, BigQueryConf{Endpoint: server.URL}).(BigQueryExporter)
+	cpu := testSeries("compute.googleapis.com/instance/cpu/usage_time")
+	for _, points := range [][]string{
+		{"1539820860,00:01,1.0", "1539820920,00:02,"},
+		{"1539820860,00:01,1.0", "1539820920,00:02,"},
+		{"1539820860,00:01,1.0", "1539820920,00:02,2.0"},
+	} {
+		if _, err := b.Export(testDate, cpu, points); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(inserts) != 3 || len(staged) != 3 {
+		t.Fatalf("got %d insert requests and %d staged series, want 3", len(inserts), len(staged))
+	}
+	var ids [3][]string
+	for i := range inserts {
+		rows := inserts[i]["rows"].([]interface{})
+		for j := range rows {
+			row := rows[j].(map[string]interface{})
+			fields := row["json"].(map[string]interface{})
+			if fields["run_id"] != "run" || fields["series"] != "web_1234" || !strings.HasPrefix(row["insertId"].(string), "run_"+fields["load_id"].(string)) {
+				t.Errorf("insert %d staged %v", i, row)
+			}
+			ids[i] = append(ids[i], row["insertId"].(string))
+		}
+	}
+
+	// The same points are staged under the same IDs, other points not
+	if len(ids[0]) != 2 || !reflect.DeepEqual(ids[0], ids[1]) || reflect.DeepEqual(ids[0], ids[2]) {
+		t.Errorf("got insert IDs %v", ids)
+	}
+
+	// Nor the same points of another run
+	b.RunID = "rerun"
+	if _, err := b.Export(testDate, cpu, []string{"1539820860,00:01,1.0", "1539820920,00:02,"}); err != nil {
+		t.Fatal(err)
+	}
+	if id := inserts[3]["rows"].([]interface{})[0].(map[string]interface{})["insertId"]; id == ids[0][0] {
+		t.Errorf("rerun staged under insert ID %v", id)
+	}
+
+	// A series without points stages no row but is still recorded
+	file, err := b.Export(testDate, cpu, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserts) != 4 || len(staged) != 5 || file.Rows != 0 {
+		t.Fatalf("got %d insert requests and %d staged series", len(inserts), len(staged))
+	}
+	row := staged[4]["rows"].([]interface{})[0].(map[string]interface{})
+	fields := row["json"].(map[string]interface{})
+	if fields["run_id"] != "rerun" || fields["series"] != "web_1234" || fields["metric"] != cpu.Metric || row["insertId"] != "rerun_"+testLoad(t, file) {
+		t.Errorf("staged %v", row)
+	}
+}
+
+// testBigQueryExporter returns an exporter of a new dataset of the BigQuery
+// emulator at BIGQUERY_TEST_ENDPOINT, started with --project=test, and skips
+// the test without it.
+func testBigQueryExporter(t *testing.T, c utils.Conf) BigQueryExporter {
+	t.Helper()
+
+	endpoint := os.Getenv("BIGQUERY_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("BIGQUERY_TEST_ENDPOINT is not set")
+	}
+
+	if c.Destination == "" {
+		c.Destination = fmt.Sprintf("test.test_%d.metrics", time.Now().UnixNano())
+	}
+	return NewBigQueryExporter(c, BigQueryConf{Endpoint: endpoint}).(BigQueryExporter)
+}
+
+// withRun returns the exporter of b for the run runID.
+func (b BigQueryExporter) withRun(runID string) BigQueryExporter {
+	b.RunID = runID
+	return b
+}
+
+// testLoads returns the loads in the table of each series on testDate, with
+// their number of rows.
+func testLoads(t *testing.T, b BigQueryExporter) map[string]map[string]int64 {
+	t.Helper()
+
+	q := b.client.Query(`SELECT series, load_id, COUNT(*) FROM ` + b.tableName("") + `
+WHERE date = @date GROUP BY series, load_id`)
+	q.Parameters = []bigquery.QueryParameter{{Name: "date", Value: civil.DateOf(testDate)}}
+	it, err := q.Read(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loads := make(map[string]map[string]int64)
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return loads
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loads[row[0].(string)] == nil {
+			loads[row[0].(string)] = make(map[string]int64)
+		}
+		loads[row[0].(string)][row[1].(string)] = row[2].(int64)
+	}
+}
+
+// testLoad returns the load ID of file.
+func testLoad(t *testing.T, file ExportedFile) string {
+	t.Helper()
+
+	i := strings.LastIndex(file.Name, "/")
+	if i < 0 {
+		t.Fatalf("got load %s", file.Name)
+	}
+	return file.Name[i+1:]
+}
+
+func TestBigQueryLoadProject(t *testing.T) {
+	partial := []string{"1539820860,00:01,1.0", "1539820920,00:02,"}
+	complete := []string{"1539820860,00:01,1.0", "1539820920,00:02,2.0"}
+
+	tests := []struct {
+		policy string
+		first  []string
+		second []string
+		kept   []int
+	}{
+		{OverwriteAlways, complete, partial, []int{1}},
+		{OverwriteNever, partial, complete, []int{0}},
+		{OverwriteIfMoreComplete, partial, complete, []int{1}},
+		{OverwriteIfMoreComplete, complete, partial, []int{0}},
+		{OverwriteVersioned, partial, complete, []int{0, 1}},
+		{OverwriteVersioned, complete, complete, []int{0}},
+	}
+
+	cpu := testSeries("compute.googleapis.com/instance/cpu/usage_time")
+	disk := testSeries("compute.googleapis.com/instance/disk/write_ops_count", "disk", "sda")
+	for _, test := range tests {
+		b := testBigQueryExporter(t, utils.Conf{Overwrite: test.policy})
+
+		// Two runs of the day, each merging once both series are staged
+		var loads []string
+		for i, points := range [][]string{test.first, test.second} {
+			run := b.withRun(fmt.Sprintf("run%d", i))
+			if err := run.PlanProject(testDate, "p", []Series{cpu, disk}); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := run.Export(testDate, cpu, points)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loads = append(loads, testLoad(t, file))
+			if done, err := run.LoadProject(testDate, "p"); done || err != nil {
+				t.Errorf("%s: merged %v with a series missing, %v", test.policy, done, err)
+			}
+
+			if _, err := run.Export(testDate, disk, complete); err != nil {
+				t.Fatal(err)
+			}
+			// Merging again changes nothing
+			for j := 0; j < 2; j++ {
+				if done, err := run.LoadProject(testDate, "p"); !done || err != nil {
+					t.Fatalf("%s: not merged, %v", test.policy, err)
+				}
+			}
+		}
+
+		want := make(map[string]int64)
+		for _, i := range test.kept {
+			want[loads[i]] = 2
+		}
+		got := testLoads(t, b)
+		if !reflect.DeepEqual(got["web_1234"], want) {
+			t.Errorf("%s: got loads %v, want %v", test.policy, got["web_1234"], want)
+		}
+		if len(got["web_1234[disk-sda]"]) != 1 {
+			t.Errorf("%s: got loads %v of the disk", test.policy, got["web_1234[disk-sda]"])
+		}
+	}
+
+	// A planned series without points still counts as staged
+	b := testBigQueryExporter(t, utils.Conf{RunID: "run"})
+	if err := b.PlanProject(testDate, "p", []Series{cpu, disk}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Export(testDate, cpu, complete); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Export(testDate, disk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := b.LoadProject(testDate, "p"); !done || err != nil {
+		t.Fatalf("not merged with an empty series, %v", err)
+	}
+	if got := testLoads(t, b); len(got["web_1234"]) != 1 || len(got["web_1234[disk-sda]"]) != 0 {
+		t.Errorf("got loads %v", got)
+	}
+}
+
+func TestBigQueryConcurrentLoads(t *testing.T) {
+	b := testBigQueryExporter(t, utils.Conf{Overwrite: OverwriteAlways, RunID: "run"})
+	cpu := testSeries("compute.googleapis.com/instance/cpu/usage_time")
+	if err := b.PlanProject(testDate, "p", []Series{cpu}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlapping tasks stage different points of the series, then merge
+	// at once. Whichever merge wins, the series keeps the rows of one load.
+	contents := [][]string{
+		{"1539820860,00:01,1.0"},
+		{"1539820860,00:01,1.0", "1539820920,00:02,2.0"},
+	}
+	var wg sync.WaitGroup
+	for i := range contents {
+		wg.Add(1)
+		go func(points []string) {
+			defer wg.Done()
+			if _, err := b.Export(testDate, cpu, points); err != nil {
+				t.Error(err)
+			}
+		}(contents[i])
+	}
+	wg.Wait()
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A merge conflicting with the other fails, the task is retried
+			b.LoadProject(testDate, "p")
+		}()
+	}
+	wg.Wait()
+	if done, err := b.LoadProject(testDate, "p"); !done || err != nil {
+		t.Fatalf("not merged, %v", err)
+	}
+
+	loads := testLoads(t, b)["web_1234"]
+	if len(loads) != 1 {
+		t.Errorf("got loads %v, want the rows of one load", loads)
+	}
+	for _, rows := range loads {
+		if rows != 1 && rows != 2 {
+			t.Errorf("got loads %v, want the rows of one load", loads)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of exported files
+const CompressionNone = ""
+const CompressionGzip = "gzip"
+const CompressionZstd = "zstd"
+
+var compressionExts = map[string]string{
+	CompressionNone: "",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func compressionPolicy(compression string) string {
+	if _, ok := compressionExts[compression]; !ok {
+		log.Fatalf("Unknown compression: %s", compression)
+	}
+
+	return compression
+}
+
+// CompressionExt is the file extension suffix of compression, e.g. ".gz".
+func CompressionExt(compression string) string {
+	return compressionExts[compression]
+}
+
+// CompressionOf guesses the compression of an exported object from its name.
+func CompressionOf(name string) string {
+	for compression, ext := range compressionExts {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			return compression
+		}
+	}
+
+	return CompressionNone
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter streams what is written through the compressor into w.
+// Closing it flushes the compressor, not w.
+func compressWriter(w io.Writer, compression string) io.WriteCloser {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			log.Fatalf("Cannot create zstd writer: %v", err)
+		}
+		return zw
+	default:
+		return nopWriteCloser{w}
+	}
+}
+
+// Compress returns content compressed with compression.
+func Compress(content []byte, compression string) []byte {
+	var buf bytes.Buffer
+
+	w := compressWriter(&buf, compression)
+	if _, err := w.Write(content); err != nil {
+		log.Fatalf("Cannot compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Cannot compress: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Decompress returns content decompressed from compression. Content that is
+// not compressed, e.g. transcoded on download, is returned as is.
+func Decompress(content []byte, compression string) ([]byte, error) {
+	var r io.Reader
+	var err error
+
+	switch {
+	case compression == CompressionGzip && bytes.HasPrefix(content, gzipMagic):
+		r, err = gzip.NewReader(bytes.NewReader(content))
+	case compression == CompressionZstd && bytes.HasPrefix(content, zstdMagic):
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(bytes.NewReader(content))
+		if err == nil {
+			defer zr.Close()
+		}
+		r = zr
+	default:
+		return content, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress: %v", err)
+	}
+
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress: %v", err)
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,136 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("1539849660,2018-10-18 08:01:00,1.000000\n", 1000))
+
+	tests := []struct {
+		compression string
+		magic       []byte
+	}{
+		{CompressionNone, []byte("1539849660")},
+		{CompressionGzip, gzipMagic},
+		{CompressionZstd, zstdMagic},
+	}
+
+	for _, test := range tests {
+		compressed := Compress(content, test.compression)
+		if !bytes.HasPrefix(compressed, test.magic) {
+			t.Errorf("%q: got content starting with %x", test.compression, compressed[:4])
+		}
+		if test.compression != CompressionNone && len(compressed) >= len(content) {
+			t.Errorf("%q: %d bytes compressed to %d", test.compression, len(content), len(compressed))
+		}
+		if got, err := Decompress(compressed, test.compression); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%q: round trip changed the content, %v", test.compression, err)
+		}
+
+		// Served decompressed, e.g. transcoded by GCS
+		if got, err := Decompress(content, test.compression); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%q: plain content changed, %v", test.compression, err)
+		}
+
+		// Truncated files are reported, not read as empty
+		if test.compression != CompressionNone {
+			if _, err := Decompress(compressed[:len(compressed)/2], test.compression); err == nil {
+				t.Errorf("%q: decompressed a truncated file", test.compression)
+			}
+		}
+	}
+}
+
+func TestCompressionOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+	}{
+		{"a/2018-10-18[web][cpu_usage_time].csv", CompressionNone},
+		{"a/2018-10-18[web][cpu_usage_time].csv.gz", CompressionGzip},
+		{"a/2018-10-18[web][cpu_usage_time].csv.zst", CompressionZstd},
+	}
+
+	for _, test := range tests {
+		if got := CompressionOf(test.name); got != test.compression {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.compression)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		compression     string
+		encryption      Encryption
+		contentType     string
+		contentEncoding string
+	}{
+		{CompressionNone, Encryption{}, "text/csv", ""},
+		{CompressionGzip, Encryption{}, "text/csv", "gzip"},
+		{CompressionZstd, Encryption{}, "application/zstd", ""},
+		{CompressionGzip, Encryption{Mode: EncryptionAge}, "application/octet-stream", ""},
+	}
+
+	for _, test := range tests {
+		contentType, contentEncoding := contentType(test.compression, test.encryption)
+		if contentType != test.contentType || contentEncoding != test.contentEncoding {
+			t.Errorf("%q, %q: got %s, %q", test.compression, test.encryption.Mode, contentType, contentEncoding)
+		}
+	}
+}
+
+func TestExportCompressed(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		f := NewFileExporter(utils.Conf{Destination: t.TempDir(), Compression: compression, Overwrite: OverwriteIfMoreComplete}, FileConf{}).(FileExporter)
+		series := testSeries("compute.googleapis.com/instance/cpu/usage_time")
+
+		file, err := f.Export(testDate, series, []string{"60,00:01,1.0", "120,00:02,2.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(file.Name, ".csv"+CompressionExt(compression)) || file.Rows != 2 {
+			t.Fatalf("%s: got file %+v", compression, file)
+		}
+
+		stored, err := ioutil.ReadFile(filepath.Join(f.Dir, filepath.FromSlash(file.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if SHA256(stored) != file.SHA256 || int64(len(stored)) != file.Size {
+			t.Errorf("%s: file %+v does not describe the stored bytes", compression, file)
+		}
+		if got, _ := Decompress(stored, compression); string(got) != "timestamp,datetime,value\n60,00:01,1.0\n120,00:02,2.0" {
+			t.Errorf("%s: file holds %q", compression, got)
+		}
+
+		// The existing file is read back to compare completeness
+		kept, err := f.Export(testDate, series, []string{"60,00:01,1.0"})
+		if err != nil || kept.SHA256 != file.SHA256 || kept.Rows != 2 {
+			t.Errorf("%s: got kept file %+v, want %+v", compression, kept, file)
+		}
+	}
+}
+
+func TestVersionedName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a/2018-10-18[web].csv", "a/2018-10-18[web].v2.csv"},
+		{"a/2018-10-18[web].csv.gz", "a/2018-10-18[web].v2.csv.gz"},
+		{"a/2018-10-18[web].csv.zst", "a/2018-10-18[web].v2.csv.zst"},
+	}
+
+	for _, test := range tests {
+		if got := versionedName(test.name, 2); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/openpgp"
+	// Keys without hash preferences imply RIPEMD-160
+	_ "golang.org/x/crypto/ripemd160"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// Encryption of exported files
+const EncryptionNone = ""
+const EncryptionAge = "age"
+const EncryptionOpenPGP = "openpgp"
+const EncryptionEnvelope = "envelope"
+
+var encryptionExts = map[string]string{
+	EncryptionNone:     "",
+	EncryptionAge:      ".age",
+	EncryptionOpenPGP:  ".gpg",
+	EncryptionEnvelope: ".enc",
+}
+
+// Object metadata naming the encryption of exported objects
+const encryptionMetadataKey = "encryption"
+const encryptionKeyIDsMetadataKey = "encryption-key-ids"
+
+// Encryption encrypts exported files for age or OpenPGP recipients, or
+// with a data key wrapped by a local key-encryption key (envelope). Age and
+// envelope files are age files, the envelope KEK is an age X25519 identity
+// wrapping the file key of each file.
+type Encryption struct {
+	Mode string
+
+	// KeyIDs identify the keys able to decrypt: age recipients, OpenPGP
+	// key IDs or the KEK ID.
+	KeyIDs []string
+
+	ageRecipients []age.Recipient
+	ageIdentities []age.Identity
+	pgpRecipients openpgp.EntityList
+	pgpIdentities openpgp.EntityList
+}
+
+// NewEncryption returns the encryption of c, which ValidateConf checked.
+func NewEncryption(c utils.EncryptionConf) Encryption {
+	e, err := ParseEncryption(c)
+	if err != nil {
+		log.Fatalf("Invalid encryption: %v", err)
+	}
+
+	return e
+}
+
+// ParseEncryption reads the recipients and identities of c.
+func ParseEncryption(c utils.EncryptionConf) (Encryption, error) {
+	e, err := ParseDecryption(c)
+	if err != nil {
+		return e, err
+	}
+
+	switch c.Mode {
+	case EncryptionAge:
+		for i := range c.Recipients {
+			recipient, err := age.ParseX25519Recipient(c.Recipients[i])
+			if err != nil {
+				return e, fmt.Errorf("invalid age recipient %s: %v", c.Recipients[i], err)
+			}
+			e.ageRecipients = append(e.ageRecipients, recipient)
+			e.KeyIDs = append(e.KeyIDs, c.Recipients[i])
+		}
+	case EncryptionOpenPGP:
+		for i := range c.Recipients {
+			entities, err := readKeyRing(c.Recipients[i])
+			if err != nil {
+				return e, err
+			}
+			for j := range entities {
+				e.KeyIDs = append(e.KeyIDs, entities[j].PrimaryKey.KeyIdString())
+			}
+			e.pgpRecipients = append(e.pgpRecipients, entities...)
+		}
+	}
+
+	if c.Mode != EncryptionNone && len(e.KeyIDs) == 0 {
+		return e, fmt.Errorf("%s encryption needs recipients", c.Mode)
+	}
+
+	return e, nil
+}
+
+// ParseDecryption reads only the keys of c able to decrypt: the identities
+// of identity_file, or the KEK of envelope encryption. It needs no
+// recipients.
+func ParseDecryption(c utils.EncryptionConf) (Encryption, error) {
+	e := Encryption{Mode: c.Mode}
+
+	switch c.Mode {
+	case EncryptionNone:
+	case EncryptionAge:
+		if c.IdentityFile != "" {
+			identities, err := readAgeIdentities(c.IdentityFile)
+			if err != nil {
+				return e, err
+			}
+			e.ageIdentities = identities
+		}
+	case EncryptionOpenPGP:
+		if c.IdentityFile != "" {
+			identities, err := readKeyRing(c.IdentityFile)
+			if err != nil {
+				return e, err
+			}
+			e.pgpIdentities = identities
+		}
+	case EncryptionEnvelope:
+		if c.KEKID == "" {
+			return e, errors.New("envelope encryption needs a kek_id")
+		}
+		kek, err := readKEK(c.KEKFile)
+		if err != nil {
+			return e, err
+		}
+		e.ageRecipients = []age.Recipient{kek.Recipient()}
+		e.ageIdentities = []age.Identity{kek}
+		e.KeyIDs = []string{c.KEKID}
+	default:
+		return e, fmt.Errorf("unknown encryption %q, want %s, %s or %s", c.Mode, EncryptionAge, EncryptionOpenPGP, EncryptionEnvelope)
+	}
+
+	return e, nil
+}
+
+// EncryptionExt is the file extension suffix of an encryption mode, e.g. ".age".
+func EncryptionExt(mode string) string {
+	return encryptionExts[mode]
+}
+
+// EncryptionOf guesses the encryption of an exported object from its name.
+func EncryptionOf(name string) string {
+	for mode, ext := range encryptionExts {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			return mode
+		}
+	}
+
+	return EncryptionNone
+}
+
+func (e Encryption) Enabled() bool {
+	return e.Mode != EncryptionNone
+}
+
+// Metadata names the encryption and key IDs of an encrypted object.
+func (e Encryption) Metadata() map[string]string {
+	if !e.Enabled() {
+		return map[string]string{}
+	}
+
+	return map[string]string{
+		encryptionMetadataKey:       e.Mode,
+		encryptionKeyIDsMetadataKey: strings.Join(e.KeyIDs, ","),
+	}
+}
+
+// Writer encrypts what is written through it into w. Closing it writes the
+// last chunk, not w.
+func (e Encryption) Writer(w io.Writer) io.WriteCloser {
+	var ew io.WriteCloser
+	var err error
+
+	switch e.Mode {
+	case EncryptionAge, EncryptionEnvelope:
+		ew, err = age.Encrypt(w, e.ageRecipients...)
+	case EncryptionOpenPGP:
+		ew, err = openpgp.Encrypt(w, e.pgpRecipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	default:
+		ew = nopWriteCloser{w}
+	}
+	if err != nil {
+		log.Fatalf("Cannot encrypt: %v", err)
+	}
+
+	return ew
+}
+
+// Decrypt returns content decrypted with the configured identities, or
+// the KEK of envelope encryption.
+func (e Encryption) Decrypt(content []byte) ([]byte, error) {
+	switch e.Mode {
+	case EncryptionAge, EncryptionEnvelope:
+		if len(e.ageIdentities) == 0 {
+			return nil, errors.New("no age identity configured")
+		}
+		r, err := age.Decrypt(bytes.NewReader(content), e.ageIdentities...)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case EncryptionOpenPGP:
+		if len(e.pgpIdentities) == 0 {
+			return nil, errors.New("no OpenPGP identity configured")
+		}
+		md, err := openpgp.ReadMessage(bytes.NewReader(content), e.pgpIdentities, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(md.UnverifiedBody)
+	default:
+		return content, nil
+	}
+}
+
+type encodeWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (e encodeWriter) Close() error {
+	for i := range e.closers {
+		if err := e.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newEncodeWriter compresses then encrypts what is written through it into
+// w. Closing it flushes both, not w.
+func newEncodeWriter(w io.Writer, compression string, encryption Encryption) io.WriteCloser {
+	ew := encryption.Writer(w)
+	cw := compressWriter(ew, compression)
+
+	return encodeWriter{Writer: cw, closers: []io.Closer{cw, ew}}
+}
+
+// decodeContent returns the CSV content of an exported file, false when it
+// cannot be decrypted, e.g. without identity, or decompressed.
+func decodeContent(content []byte, compression string, encryption Encryption) (string, bool) {
+	content, err := encryption.Decrypt(content)
+	if err != nil {
+		log.Printf("Cannot decrypt existing file: %v", err)
+		return "", false
+	}
+
+	content, err = Decompress(content, compression)
+	if err != nil {
+		log.Printf("Cannot read existing file: %v", err)
+		return "", false
+	}
+
+	return string(content), true
+}
+
+func readKeyRing(filename string) (openpgp.EntityList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OpenPGP keys: %v", err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OpenPGP keys %s: %v", filename, err)
+	}
+
+	return entities, nil
+}
+
+func readAgeIdentities(filename string) ([]age.Identity, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read age identities: %v", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identities in %s: %v", filename, err)
+	}
+
+	return identities, nil
+}
+
+// readKEK reads the age X25519 identity of envelope encryption, as written
+// by age-keygen.
+func readKEK(filename string) (*age.X25519Identity, error) {
+	identities, err := readAgeIdentities(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	kek, ok := identities[0].(*age.X25519Identity)
+	if len(identities) != 1 || !ok {
+		return nil, fmt.Errorf("KEK %s must hold one age X25519 identity", filename)
+	}
+
+	return kek, nil
+}
@@ -0,0 +1,262 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// age encrypts payloads in chunks of 64 KiB
+const ageChunkSize = 64 * 1024
+
+// Keys of testdata, the age-cli-<n>.csv.age files are encrypted to both by
+// the age command line tool, v1.2.1
+const ageTestRecipient = "age1x63awfcpfenact0l98450dh6u72qr7hxz3k4hcw7sxzdr2h8edhqcyv6wn"
+const ageOtherRecipient = "age1ztdjghnh0l09qmfnzw7lcmtlvs5lz82raeyplgs94769lff0zy6q9cp2m6"
+
+// ageTestContent returns the n first bytes of repeated rows, the plaintext
+// of the testdata files.
+func ageTestContent(n int) []byte {
+	row := "60,00:01,1.0\n"
+	return []byte(strings.Repeat(row, n/len(row)+1)[:n])
+}
+
+func testEncryption(t *testing.T, c utils.EncryptionConf) Encryption {
+	t.Helper()
+
+	if c.Mode == "" {
+		c.Mode = EncryptionAge
+	}
+
+	return NewEncryption(c)
+}
+
+func encrypt(t *testing.T, e Encryption, plain []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := e.Writer(&buf)
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParseEncryption(t *testing.T) {
+	kekFile := filepath.Join(t.TempDir(), "kek")
+	writeKEK(t, kekFile)
+
+	tests := []struct {
+		conf utils.EncryptionConf
+		err  string
+	}{
+		{utils.EncryptionConf{Mode: "rot13"}, `unknown encryption "rot13"`},
+		{utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{ageTestRecipient}}, ""},
+		{utils.EncryptionConf{Mode: EncryptionAge}, "age encryption needs recipients"},
+		{utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{ageTestRecipient[:len(ageTestRecipient)-1] + "q"}}, "invalid age recipient"},
+		{utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{"agf" + ageTestRecipient[3:]}}, "invalid age recipient"},
+		{utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{ageTestRecipient}, IdentityFile: "testdata/missing.txt"}, "cannot read age identities"},
+		{utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{ageTestRecipient}, IdentityFile: "testdata/age-cli-13.csv.age"}, "invalid age identities"},
+		{utils.EncryptionConf{Mode: EncryptionOpenPGP, Recipients: []string{"testdata/missing.asc"}}, "cannot read OpenPGP keys"},
+		{utils.EncryptionConf{Mode: EncryptionOpenPGP, Recipients: []string{"testdata/age-keys.txt"}}, "cannot read OpenPGP keys"},
+		{utils.EncryptionConf{Mode: EncryptionEnvelope, KEKFile: kekFile}, "needs a kek_id"},
+		{utils.EncryptionConf{Mode: EncryptionEnvelope, KEKID: "kek-1", KEKFile: "testdata/missing.txt"}, "cannot read age identities"},
+		{utils.EncryptionConf{Mode: EncryptionEnvelope, KEKID: "kek-1", KEKFile: kekFile}, ""},
+	}
+
+	for _, test := range tests {
+		_, err := ParseEncryption(test.conf)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: got error %v, want %q", test.conf, err, test.err)
+		}
+	}
+
+	// Decrypting needs no recipients
+	e, err := ParseDecryption(utils.EncryptionConf{Mode: EncryptionAge, IdentityFile: "testdata/age-keys.txt"})
+	content, _ := ioutil.ReadFile("testdata/age-cli-13.csv.age")
+	if plain, decryptErr := e.Decrypt(content); err != nil || decryptErr != nil || !bytes.Equal(plain, ageTestContent(13)) {
+		t.Errorf("decrypt without recipients: %v, %v", err, decryptErr)
+	}
+}
+
+// writeKEK writes a new envelope KEK to filename.
+func writeKEK(t *testing.T, filename string) {
+	t.Helper()
+
+	kek, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte("# KEK\n"+kek.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenAgeCLIFiles(t *testing.T) {
+	for _, identityFile := range []string{"testdata/age-keys.txt", "testdata/other-key.txt"} {
+		e := testEncryption(t, utils.EncryptionConf{Recipients: []string{ageTestRecipient}, IdentityFile: identityFile})
+
+		for _, n := range []int{0, 13, 65537} {
+			content, err := ioutil.ReadFile(fmt.Sprintf("testdata/age-cli-%d.csv.age", n))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plain, err := e.Decrypt(content)
+			if err != nil {
+				t.Errorf("%s, %d bytes: %v", identityFile, n, err)
+				continue
+			}
+			if !bytes.Equal(plain, ageTestContent(n)) {
+				t.Errorf("%s, %d bytes: got %d bytes", identityFile, n, len(plain))
+			}
+		}
+	}
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	e := testEncryption(t, utils.EncryptionConf{Recipients: []string{ageTestRecipient, ageOtherRecipient}, IdentityFile: "testdata/age-keys.txt"})
+	other := testEncryption(t, utils.EncryptionConf{Recipients: []string{ageOtherRecipient}, IdentityFile: "testdata/other-key.txt"})
+
+	// Around the chunk boundaries of STREAM
+	for _, n := range []int{0, 1, ageChunkSize - 1, ageChunkSize, ageChunkSize + 1, 3 * ageChunkSize} {
+		plain := ageTestContent(n)
+		content := encrypt(t, e, plain)
+
+		for _, identity := range []Encryption{e, other} {
+			decrypted, err := identity.Decrypt(content)
+			if err != nil || !bytes.Equal(decrypted, plain) {
+				t.Errorf("%d bytes: got %d bytes, %v", n, len(decrypted), err)
+			}
+		}
+	}
+
+	content := encrypt(t, testEncryption(t, utils.EncryptionConf{Recipients: []string{ageTestRecipient}}), ageTestContent(10))
+	if _, err := other.Decrypt(content); err == nil {
+		t.Error("decrypted without the identity of a recipient")
+	}
+}
+
+func TestOpenAgeTampered(t *testing.T) {
+	e := testEncryption(t, utils.EncryptionConf{Recipients: []string{ageTestRecipient}, IdentityFile: "testdata/age-keys.txt"})
+	content := encrypt(t, e, ageTestContent(ageChunkSize+1))
+
+	headerEnd := bytes.Index(content, []byte("\n--- ")) + 1
+	payload := bytes.IndexByte(content[headerEnd:], '\n') + headerEnd + 1 + 16
+	firstChunk := payload + ageChunkSize + 16
+
+	flip := func(i int) []byte {
+		tampered := append([]byte{}, content...)
+		tampered[i] ^= 1
+		return tampered
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"header", bytes.Replace(content, []byte("X25519"), []byte("X25518"), 1)},
+		{"mac", flip(headerEnd + 5)},
+		{"nonce", flip(payload - 1)},
+		{"payload", flip(payload + 10)},
+		{"last chunk", flip(len(content) - 1)},
+		// A full first chunk is not flagged as the last one
+		{"truncated", content[:firstChunk]},
+		{"empty", nil},
+	}
+
+	for _, test := range tests {
+		if _, err := e.Decrypt(test.content); err == nil {
+			t.Errorf("%s: decrypted a tampered file", test.name)
+		}
+	}
+}
+
+// TestAgeCLIDecrypt checks the age tool decrypts the files written by the
+// exporter, when it is installed.
+func TestAgeCLIDecrypt(t *testing.T) {
+	age, err := exec.LookPath("age")
+	if err != nil {
+		t.Skip("age is not installed")
+	}
+
+	e := testEncryption(t, utils.EncryptionConf{Recipients: []string{ageTestRecipient}})
+	for _, n := range []int{0, 13, 2*ageChunkSize + 7} {
+		filename := filepath.Join(t.TempDir(), "file.csv.age")
+		if err := ioutil.WriteFile(filename, encrypt(t, e, ageTestContent(n)), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		plain, err := exec.Command(age, "-d", "-i", "testdata/age-keys.txt", filename).Output()
+		if err != nil || !bytes.Equal(plain, ageTestContent(n)) {
+			t.Errorf("%d bytes: age got %d bytes, %v", n, len(plain), err)
+		}
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	kekFile := filepath.Join(dir, "kek")
+	otherFile := filepath.Join(dir, "other")
+	writeKEK(t, kekFile)
+	writeKEK(t, otherFile)
+
+	e := testEncryption(t, utils.EncryptionConf{Mode: EncryptionEnvelope, KEKFile: kekFile, KEKID: "kek-1"})
+	for _, n := range []int{0, ageChunkSize, 2*ageChunkSize + 1} {
+		plain := ageTestContent(n)
+		decrypted, err := e.Decrypt(encrypt(t, e, plain))
+		if err != nil || !bytes.Equal(decrypted, plain) {
+			t.Errorf("%d bytes: got %d bytes, %v", n, len(decrypted), err)
+		}
+	}
+
+	// Envelope files are age files of the KEK
+	content := encrypt(t, e, ageTestContent(10))
+	if plain, err := testEncryption(t, utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{ageTestRecipient}, IdentityFile: kekFile}).Decrypt(content); err != nil || !bytes.Equal(plain, ageTestContent(10)) {
+		t.Errorf("age decrypt of an envelope file: %v", err)
+	}
+	if _, err := testEncryption(t, utils.EncryptionConf{Mode: EncryptionEnvelope, KEKFile: otherFile, KEKID: "kek-1"}).Decrypt(content); err == nil {
+		t.Error("decrypted with another KEK")
+	}
+}
+
+func TestValidateEncryptedRows(t *testing.T) {
+	kekFile := filepath.Join(t.TempDir(), "kek")
+	writeKEK(t, kekFile)
+
+	age := utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{ageTestRecipient}}
+	identity := age
+	identity.IdentityFile = "testdata/age-keys.txt"
+
+	tests := []struct {
+		conf utils.Conf
+		ok   bool
+	}{
+		{utils.Conf{Encryption: age}, true},
+		{utils.Conf{Consolidated: true, Encryption: age}, false},
+		{utils.Conf{WideFormat: true, Encryption: age}, false},
+		{utils.Conf{WideFormat: true, Encryption: identity}, true},
+		{utils.Conf{Consolidated: true, Encryption: utils.EncryptionConf{Mode: EncryptionEnvelope, KEKID: "kek-1", KEKFile: kekFile}}, true},
+		// Keys are read when the config is loaded
+		{utils.Conf{Encryption: utils.EncryptionConf{Mode: EncryptionAge, Recipients: []string{"age1"}}}, false},
+		{utils.Conf{Encryption: utils.EncryptionConf{Mode: EncryptionEnvelope, KEKFile: kekFile}}, false},
+		{utils.Conf{Encryption: utils.EncryptionConf{Mode: "rot13"}}, false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateConf(test.conf); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v", test.conf, err)
+		}
+	}
+}
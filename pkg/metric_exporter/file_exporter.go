@@ -1,9 +1,15 @@
 package metric_exporter
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -12,46 +18,323 @@ import (
 )
 
 type FileExporter struct {
-	Dir string
+	Dir          string
+	Paths        PathBuilder
+	LabelColumns []string
+	Overwrite    string
+	Compression  string
+	Encryption   Encryption
+	FileMode     os.FileMode
 }
 
-func NewFileExporter(c utils.Conf) MetricExporter {
+// FileConf sets the files written by the FileExporter.
+type FileConf struct {
+	// FileMode is the permission of written files, 0644 when unset.
+	FileMode os.FileMode `yaml:"file_mode"`
+}
+
+func init() {
+	Register(ExporterType{
+		Name:   "FileExporter",
+		Block:  "file",
+		Config: FileConf{},
+		New:    func(c utils.Conf, config interface{}) MetricExporter { return NewFileExporter(c, config.(FileConf)) },
+	})
+}
+
+func NewFileExporter(c utils.Conf, file FileConf) MetricExporter {
 	exporter := FileExporter{}
-	exporter.Dir = c.Destination
+	exporter.Dir = filepath.Join(c.Destination, c.Prefix)
+	exporter.Paths = NewPathBuilder(c)
+	exporter.Overwrite = overwritePolicy(c.Overwrite)
+	exporter.Compression = compressionPolicy(c.Compression)
+	exporter.Encryption = NewEncryption(c.Encryption)
+	exporter.LabelColumns = c.LabelColumns
+	exporter.FileMode = file.FileMode
+	if exporter.FileMode == 0 {
+		exporter.FileMode = 0644
+	}
 
 	return exporter
 }
 
-func (f FileExporter) saveTimeSeriesToCSV(filename string, metricPoints []string) {
+func (f FileExporter) saveTimeSeriesToCSV(filename string, series Series, metricPoints []string) (string, string, error) {
 	log.Printf("Points len: %d", len(metricPoints))
 
-	f.saveToFile(filename, stackdriver.PointCSVHeader, strings.Join(metricPoints, "\n"))
+	header, rows := csvContent(series, metricPoints, f.LabelColumns)
+	return f.saveToFile(filename, newCSVBody(header, StringRows(rows)))
+}
+
+// saveToFile writes body under the overwrite policy and returns the name
+// of the file holding it and its SHA-256, empty when an existing file was
+// kept. The file is written to a temporary name first, then linked to a
+// name that must not exist, or renamed over it.
+func (f FileExporter) saveToFile(filename string, body csvBody) (string, string, error) {
+	tmp, sum, err := writeTempFile(filename, body.reader(), f.Compression, f.Encryption, f.FileMode)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp)
+
+	switch f.Overwrite {
+	case OverwriteNever:
+		// Linking fails on an existing file, one written meanwhile included
+		linked, err := linkFile(tmp, filename)
+		if err != nil {
+			return "", "", err
+		}
+		if !linked {
+			log.Printf("Keep existing file %s", filename)
+			return filename, "", nil
+		}
+	case OverwriteIfMoreComplete:
+		unlock, err := lockFile(filename)
+		if err != nil {
+			return "", "", err
+		}
+		defer unlock()
+
+		existing, err := ioutil.ReadFile(filename)
+		if err == nil {
+			if existingContent, ok := decodeContent(existing, f.Compression, f.Encryption); ok && completeness(existingContent) >= body.points {
+				log.Printf("Keep existing file %s, it is as complete", filename)
+				return filename, "", nil
+			}
+		} else if !os.IsNotExist(err) {
+			return "", "", fmt.Errorf("cannot read file: %v", err)
+		}
+		if err := renameFile(tmp, filename); err != nil {
+			return "", "", err
+		}
+	case OverwriteVersioned:
+		name := filename
+		for version := 2; ; version++ {
+			linked, err := linkFile(tmp, name)
+			if err != nil {
+				return "", "", err
+			}
+			if linked {
+				return name, sum, nil
+			}
+			if existing, err := ioutil.ReadFile(name); err == nil && sameContent(existing, f.Compression, f.Encryption, body) {
+				log.Printf("Keep existing file %s, it holds the same content", name)
+				return name, "", nil
+			}
+			name = versionedName(filename, version)
+		}
+	default:
+		if err := renameFile(tmp, filename); err != nil {
+			return "", "", err
+		}
+	}
+
+	return filename, sum, nil
+}
+
+// linkFile links filename to tmp, false when filename exists.
+func linkFile(tmp, filename string) (bool, error) {
+	err := os.Link(tmp, filename)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot link file: %v", err)
+	}
+
+	return true, nil
+}
+
+func renameFile(tmp, filename string) error {
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("cannot rename file: %v", err)
+	}
+
+	return nil
+}
+
+// staleLock is the age of a lock file left by a crashed writer.
+const staleLock = time.Minute
+
+// lockFile waits for the lock of filename, a hidden file next to it created
+// by one writer at a time, and returns its release.
+func lockFile(filename string) (unlock func(), err error) {
+	lock := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".lock")
+	for {
+		file, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("cannot lock file: %v", err)
+		}
+
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(lock)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// exportedFile describes filename, reading it back when an existing file
+// was kept.
+func (f FileExporter) exportedFile(filename, sum string, rows int) (ExportedFile, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return ExportedFile{}, fmt.Errorf("cannot stat file: %v", err)
+	}
+
+	if sum == "" {
+		existing, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return ExportedFile{}, fmt.Errorf("cannot read file: %v", err)
+		}
+		sum = SHA256(existing)
+		rows = keptRows(existing, f.Compression, f.Encryption)
+	}
+
+	name, _ := filepath.Rel(f.Dir, filename)
+
+	return ExportedFile{Name: filepath.ToSlash(name), Size: info.Size(), Rows: rows, SHA256: sum, KeyIDs: f.Encryption.KeyIDs}, nil
+}
+
+// writeFileAtomic streams r, compressed and encrypted, to a temporary file in the same
+// folder then renames it, so readers never see a truncated file. It returns
+// the SHA-256 of the written file.
+func writeFileAtomic(filename string, r io.Reader, compression string, encryption Encryption, mode os.FileMode) (string, error) {
+	tmp, sum, err := writeTempFile(filename, r, compression, encryption, mode)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	return sum, renameFile(tmp, filename)
 }
 
-func (f FileExporter) saveToFile(filename, header, content string) {
-	file, err := os.Create(filename)
+// writeTempFile streams r, compressed and encrypted, to a hidden temporary
+// file next to filename. It returns its name and SHA-256.
+func writeTempFile(filename string, r io.Reader, compression string, encryption Encryption, mode os.FileMode) (string, string, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return "", "", fmt.Errorf("cannot create folder: %v", err)
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-")
 	if err != nil {
-		log.Fatal("Cannot create file", err)
+		return "", "", fmt.Errorf("cannot create file: %v", err)
 	}
-	defer file.Close()
 
-	fmt.Fprintf(file, "%s\n", header)
-	fmt.Fprintf(file, content)
+	h := sha256.New()
+	w := newEncodeWriter(io.MultiWriter(file, h), compression, encryption)
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", "", fmt.Errorf("cannot write file: %v", err)
+	}
+
+	return file.Name(), hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (f FileExporter) Export(dateTime time.Time, projectID, metric, instanceName string, metricPoints []string, attendNames ...string) {
-	folder := fmt.Sprintf("%s/%s/%d/%02d/%02d/%s", f.Dir, projectID, dateTime.Year(), dateTime.Month(), dateTime.Day(), instanceName)
-	os.MkdirAll(folder, os.ModePerm)
+func (f FileExporter) Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error) {
+	output := filepath.Join(f.Dir, filepath.FromSlash(f.Paths.SeriesPath(dateTime, series)))
 
-	title := strings.Replace(metric, "compute.googleapis.com/instance/", "", -1)
-	title = strings.Replace(title, "/", "_", -1)
+	output, sum, err := f.saveTimeSeriesToCSV(output, series, metricPoints)
+	if err != nil {
+		return ExportedFile{}, err
+	}
 
-	var output string
-	if len(attendNames) == 0 {
-		output = fmt.Sprintf("%s/%s[%s][%s].csv", folder, dateTime.Format("2006-01-02"), instanceName, title)
-	} else {
-		output = fmt.Sprintf("%s/%s[%s][%s][%s].csv", folder, dateTime.Format("2006-01-02"), instanceName, title, strings.Join(attendNames, "-"))
+	return f.exportedFile(output, sum, len(metricPoints))
+}
+
+func (f FileExporter) WriteObject(name string, content []byte) error {
+	return f.WriteObjectFrom(name, bytes.NewReader(content))
+}
+
+func (f FileExporter) WriteObjectFrom(name string, r io.Reader) error {
+	filename := filepath.Join(f.Dir, filepath.FromSlash(name))
+
+	_, err := writeFileAtomic(filename, r, CompressionNone, Encryption{}, f.FileMode)
+	return err
+}
+
+func (f FileExporter) ReadObject(name string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(f.Dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %v", err)
+	}
+
+	return content, nil
+}
+
+func (f FileExporter) DeleteObject(name string) error {
+	filename := filepath.Join(f.Dir, filepath.FromSlash(name))
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete file: %v", err)
+	}
+
+	// Drop folders left empty, up to the destination
+	for dir := filepath.Dir(filename); dir != filepath.Clean(f.Dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f FileExporter) ListObjects(prefix string) (names []string, err error) {
+	root := filepath.Join(f.Dir, filepath.FromSlash(prefix))
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(f.Dir, path)
+		names = append(names, filepath.ToSlash(rel))
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list files: %v", err)
+	}
+
+	return
+}
+
+func (f FileExporter) ExportProject(dateTime time.Time, projectID string, columns []string, rows RowSource) (ExportedFile, error) {
+	output := filepath.Join(f.Dir, filepath.FromSlash(f.Paths.ProjectPath(dateTime, projectID)))
+
+	body := newCSVBody(stackdriver.PointCSVHeader+","+strings.Join(columns, ","), rows)
+	log.Printf("Rows len: %d", body.rows)
+	if body.err != nil {
+		return ExportedFile{}, body.err
+	}
+	output, sum, err := f.saveToFile(output, body)
+	if err != nil {
+		return ExportedFile{}, err
 	}
 
-	f.saveTimeSeriesToCSV(output, metricPoints)
+	return f.exportedFile(output, sum, body.rows)
 }
@@ -0,0 +1,222 @@
+package metric_exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+const testHeader = "timestamp,datetime,value"
+
+// testFileExporter returns a FileExporter writing to a temporary folder
+// under policy.
+func testFileExporter(t *testing.T, policy string) FileExporter {
+	t.Helper()
+
+	return NewFileExporter(utils.Conf{Destination: t.TempDir(), Overwrite: policy}, FileConf{}).(FileExporter)
+}
+
+func testBody(rows ...string) csvBody {
+	return newCSVBody(testHeader, StringRows(rows))
+}
+
+func readTestFile(t *testing.T, filename string) string {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestSaveToFile(t *testing.T) {
+	partial := testBody("60,00:01,1.0", "120,00:02,")
+	complete := testBody("60,00:01,1.0", "120,00:02,2.0")
+
+	tests := []struct {
+		policy  string
+		first   csvBody
+		second  csvBody
+		name    string
+		kept    bool
+		content csvBody
+	}{
+		{OverwriteAlways, complete, partial, "a.csv", false, partial},
+		{OverwriteNever, partial, complete, "a.csv", true, partial},
+		{OverwriteIfMoreComplete, partial, complete, "a.csv", false, complete},
+		{OverwriteIfMoreComplete, complete, partial, "a.csv", true, complete},
+		{OverwriteVersioned, partial, complete, "a.v2.csv", false, complete},
+		// Writing the same content again adds no version
+		{OverwriteVersioned, complete, complete, "a.csv", true, complete},
+	}
+
+	for _, test := range tests {
+		f := testFileExporter(t, test.policy)
+		filename := filepath.Join(f.Dir, "a.csv")
+
+		if _, _, err := f.saveToFile(filename, test.first); err != nil {
+			t.Fatal(err)
+		}
+		name, sum, err := f.saveToFile(filename, test.second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Base(name) != test.name || (sum == "") != test.kept {
+			t.Errorf("%s: got %s, kept %v, want %s, kept %v", test.policy, filepath.Base(name), sum == "", test.name, test.kept)
+		}
+		if content := readTestFile(t, name); content != readBody(t, test.content) {
+			t.Errorf("%s: %s holds %q", test.policy, name, content)
+		}
+
+		// Temporary and lock files are gone
+		entries, _ := ioutil.ReadDir(f.Dir)
+		for i := range entries {
+			if strings.HasPrefix(entries[i].Name(), ".") {
+				t.Errorf("%s: left %s", test.policy, entries[i].Name())
+			}
+		}
+	}
+}
+
+func readBody(t *testing.T, body csvBody) string {
+	t.Helper()
+
+	content, err := ioutil.ReadAll(body.reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestSaveToFileConcurrent(t *testing.T) {
+	const writers = 8
+
+	tests := []struct {
+		policy string
+		files  int
+	}{
+		{OverwriteNever, 1},
+		{OverwriteIfMoreComplete, 1},
+		{OverwriteVersioned, writers},
+	}
+
+	for _, test := range tests {
+		f := testFileExporter(t, test.policy)
+		filename := filepath.Join(f.Dir, "a.csv")
+
+		// Every writer has a distinct, more complete content
+		var wg sync.WaitGroup
+		written := make([]string, writers)
+		for i := 0; i < writers; i++ {
+			rows := make([]string, i+1)
+			for j := range rows {
+				rows[j] = "60,00:01,1.0"
+			}
+
+			wg.Add(1)
+			go func(i int, body csvBody) {
+				defer wg.Done()
+				name, sum, err := f.saveToFile(filename, body)
+				if err != nil {
+					t.Error(err)
+				}
+				if sum != "" {
+					written[i] = filepath.Base(name)
+				}
+			}(i, testBody(rows...))
+		}
+		wg.Wait()
+
+		files, _ := filepath.Glob(filepath.Join(f.Dir, "*"))
+		if len(files) != test.files {
+			t.Errorf("%s: got files %v, want %d", test.policy, files, test.files)
+		}
+
+		if test.policy == OverwriteVersioned {
+			sort.Strings(written)
+			for i := 1; i < len(written); i++ {
+				if written[i] == "" || written[i] == written[i-1] {
+					t.Errorf("%s: writers shared a file: %v", test.policy, written)
+				}
+			}
+		}
+	}
+
+	// The most complete content is left whatever the order
+	f := testFileExporter(t, OverwriteIfMoreComplete)
+	filename := filepath.Join(f.Dir, "a.csv")
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rows := []string{"60,00:01,1.0", "120,00:02,", "180,00:03,"}
+			for j := 1; j < len(rows) && j <= i%3; j++ {
+				rows[j] = strings.TrimSuffix(rows[j], ",") + ",2.0"
+			}
+			if _, _, err := f.saveToFile(filename, testBody(rows...)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if content := readTestFile(t, filename); completeness(content) != 3 {
+		t.Errorf("if-more-complete left %q", content)
+	}
+}
+
+func TestExportKeepsFileMode(t *testing.T) {
+	f := testFileExporter(t, OverwriteNever)
+	f.FileMode = 0640
+
+	file, err := f.Export(testDate, testSeries("compute.googleapis.com/instance/cpu/usage_time"), []string{"60,00:01,1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(f.Dir, filepath.FromSlash(file.Name)))
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("got %v, %v, want mode 0640", info, err)
+	}
+	if file.Rows != 1 || file.SHA256 == "" {
+		t.Errorf("got file %+v", file)
+	}
+}
+
+func TestFileExporterErrors(t *testing.T) {
+	f := testFileExporter(t, OverwriteAlways)
+
+	// The destination folder is a file
+	f.Dir = filepath.Join(f.Dir, "file")
+	if err := ioutil.WriteFile(f.Dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Export(testDate, testSeries("compute.googleapis.com/instance/cpu/usage_time"), []string{"60,00:01,1.0"}); err == nil {
+		t.Error("exported under a file")
+	}
+	if err := f.WriteObject("a.json", []byte("{}")); err == nil {
+		t.Error("wrote under a file")
+	}
+	if _, err := f.ReadObject("a.json"); err == nil || err == ErrObjectNotExist {
+		t.Errorf("read under a file: %v", err)
+	}
+
+	f = testFileExporter(t, OverwriteAlways)
+	if _, err := f.ReadObject("a.json"); err != ErrObjectNotExist {
+		t.Errorf("read a missing file: %v", err)
+	}
+	if names, err := f.ListObjects("missing/"); err != nil || len(names) != 0 {
+		t.Errorf("listed %v, %v", names, err)
+	}
+}
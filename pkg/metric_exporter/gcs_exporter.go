@@ -1,65 +1,558 @@
 package metric_exporter
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
 	"stackdriver-monitoring-exporter/pkg/utils"
 )
 
 type GCSExporter struct {
-	BucketName string
+	BucketName   string
+	Prefix       string
+	Paths        PathBuilder
+	LabelColumns []string
+	Overwrite    string
+	Compression  string
+	Encryption   Encryption
+
+	KMSKeyName      string
+	StorageClass    string
+	ContentType     string
+	ContentEncoding string
+	CacheControl    string
+	Metadata        map[string]string
+	Endpoint        string
+	RunID           string
+	ChunkSize       int
+
+	client *gcsClient
+}
+
+// GCSConf sets the attributes of objects written by the GCSExporter.
+type GCSConf struct {
+	KMSKeyName   string `yaml:"kms_key_name"`
+	StorageClass string `yaml:"storage_class"`
+
+	// ContentType and ContentEncoding override the ones derived from the
+	// compression and encryption.
+	ContentType     string `yaml:"content_type"`
+	ContentEncoding string `yaml:"content_encoding"`
+	CacheControl    string `yaml:"cache_control"`
+
+	// Metadata is added to the metadata describing every object.
+	Metadata map[string]string `yaml:"metadata"`
+
+	// Endpoint sends every storage request to another server, e.g. a local
+	// fake GCS server, without credentials.
+	Endpoint string `yaml:"endpoint"`
+
+	// ChunkSize is the size in bytes of the chunks of resumable uploads,
+	// 16 MiB when unset.
+	ChunkSize int `yaml:"chunk_size"`
+
+	// ConcurrentUploads bounds the uploads in flight at once, 4 when unset.
+	ConcurrentUploads int `yaml:"concurrent_uploads"`
+}
+
+const DefaultConcurrentUploads = 4
+
+// Uploads returns the number of uploads allowed in flight at once.
+func (g GCSConf) Uploads() int {
+	if g.ConcurrentUploads > 0 {
+		return g.ConcurrentUploads
+	}
+
+	return DefaultConcurrentUploads
+}
+
+// ConcurrentUploads returns the uploads the exporter of c allows in flight
+// at once, which also bounds the objects a job copies or deletes at once.
+// Only the gcs block of a GCSExporter sets it.
+func ConcurrentUploads(c utils.Conf) int {
+	t, _ := Lookup("GCSExporter")
+	if c.ExporterClass != t.Name {
+		return DefaultConcurrentUploads
+	}
+	config, err := t.decodeBlock(c)
+	if err != nil {
+		return DefaultConcurrentUploads
+	}
+
+	return config.(GCSConf).Uploads()
+}
+
+func init() {
+	Register(ExporterType{
+		Name:     "GCSExporter",
+		Block:    "gcs",
+		Config:   GCSConf{},
+		Validate: func(c utils.Conf, config interface{}) error { return validateGCS(c, config.(GCSConf)) },
+		New:      func(c utils.Conf, config interface{}) MetricExporter { return NewGCSExporter(c, config.(GCSConf)) },
+	})
+}
+
+// validateGCS rejects a content_encoding along with compression or
+// encryption, which set their own: clients decode objects as it says.
+func validateGCS(c utils.Conf, gcs GCSConf) error {
+	if gcs.Endpoint != "" {
+		if _, err := parseEndpoint("GCS", gcs.Endpoint); err != nil {
+			return err
+		}
+	}
+
+	if gcs.ContentEncoding != "" && (c.Compression != CompressionNone || c.Encryption.Mode != EncryptionNone) {
+		return errors.New("gcs.content_encoding cannot be set with compression or encryption")
+	}
+
+	return nil
 }
 
-func NewGCSExporter(c utils.Conf) MetricExporter {
+func NewGCSExporter(c utils.Conf, gcs GCSConf) MetricExporter {
 	exporter := GCSExporter{}
 	exporter.BucketName = c.Destination
+	if c.Prefix != "" {
+		exporter.Prefix = strings.Trim(c.Prefix, "/") + "/"
+	}
+	exporter.Paths = NewPathBuilder(c)
+	exporter.Overwrite = overwritePolicy(c.Overwrite)
+	exporter.Compression = compressionPolicy(c.Compression)
+	exporter.Encryption = NewEncryption(c.Encryption)
+	exporter.KMSKeyName = gcs.KMSKeyName
+	exporter.StorageClass = gcs.StorageClass
+	exporter.ContentType = gcs.ContentType
+	exporter.ContentEncoding = gcs.ContentEncoding
+	exporter.CacheControl = gcs.CacheControl
+	exporter.Metadata = gcs.Metadata
+	exporter.Endpoint = gcs.Endpoint
+	exporter.RunID = c.RunID
+	exporter.ChunkSize = gcs.ChunkSize
+	exporter.client = sharedClient(gcs.Endpoint, gcs.Uploads())
+	exporter.LabelColumns = c.LabelColumns
 
 	return exporter
 }
 
-func (g GCSExporter) saveTimeSeriesToCSV(filename string, metricPoints []string) {
+func (g GCSExporter) saveTimeSeriesToCSV(filename string, series Series, metricPoints []string, metadata map[string]string) (string, string, error) {
 	log.Printf("Points len: %d", len(metricPoints))
 
-	content := fmt.Sprintf("%s\n%s", stackdriver.PointCSVHeader, strings.Join(metricPoints, "\n"))
-	r := strings.NewReader(content)
+	header, rows := csvContent(series, metricPoints, g.LabelColumns)
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	return g.saveToObject(filename, newCSVBody(header, StringRows(rows)), metadata)
+}
+
+// gcsClient is a storage client shared by the exporters of a process, with
+// the slots of the uploads they allow in flight at once.
+type gcsClient struct {
+	*storage.Client
+	uploads chan struct{}
+}
+
+// gcsClientKey tells apart the exporters sharing the upload slots of a
+// client, those of one endpoint allowing the same uploads.
+type gcsClientKey struct {
+	endpoint string
+	uploads  int
+}
+
+var gcsClients = struct {
+	sync.Mutex
+	byEndpoint map[string]*storage.Client
+	byKey      map[gcsClientKey]*gcsClient
+}{byEndpoint: make(map[string]*storage.Client), byKey: make(map[gcsClientKey]*gcsClient)}
+
+// sharedClient returns the storage client of endpoint with the slots of
+// uploads in flight at once, both created on first use and kept for the
+// process lifetime. An endpoint sends the requests to another server.
+func sharedClient(endpoint string, uploads int) *gcsClient {
+	gcsClients.Lock()
+	defer gcsClients.Unlock()
+
+	key := gcsClientKey{endpoint, uploads}
+	if client, ok := gcsClients.byKey[key]; ok {
+		return client
+	}
+	if client, ok := gcsClients.byEndpoint[endpoint]; ok {
+		gcsClients.byKey[key] = &gcsClient{client, make(chan struct{}, uploads)}
+		return gcsClients.byKey[key]
+	}
+
+	var opts []option.ClientOption
+	if endpoint != "" {
+		u, err := parseEndpoint("GCS", endpoint)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: endpointTransport{u}}))
+	}
+
+	client, err := storage.NewClient(context.Background(), opts...)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
 
-	bh := client.Bucket(g.BucketName)
-	obj := bh.Object(filename)
-	w := obj.NewWriter(ctx)
+	gcsClients.byEndpoint[endpoint] = client
+	gcsClients.byKey[key] = &gcsClient{client, make(chan struct{}, uploads)}
+
+	return gcsClients.byKey[key]
+}
+
+// object returns the handle of name under Prefix, names passed to and
+// returned by the exporter are relative to it.
+func (g GCSExporter) object(name string) *storage.ObjectHandle {
+	return g.client.Bucket(g.BucketName).Object(g.Prefix + name)
+}
+
+// newWriter returns a writer of obj once an upload slot is free, release
+// frees it.
+func (g GCSExporter) newWriter(ctx context.Context, obj *storage.ObjectHandle) (w *storage.Writer, release func()) {
+	g.client.uploads <- struct{}{}
+
+	w = obj.NewWriter(ctx)
+	if g.ChunkSize > 0 {
+		w.ChunkSize = g.ChunkSize
+	}
+
+	return w, func() { <-g.client.uploads }
+}
+
+// parseEndpoint parses the endpoint of the service named by service, an URL
+// with a host.
+func parseEndpoint(service, endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s endpoint %q", service, endpoint)
+	}
+
+	return u, nil
+}
+
+// endpointTransport sends requests to endpoint, downloads from
+// storage.googleapis.com included. The Host header is kept, emulators route
+// downloads by it.
+type endpointTransport struct {
+	endpoint *url.URL
+}
+
+func (t endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Scheme = t.endpoint.Scheme
+	u.Host = t.endpoint.Host
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	r.Host = req.URL.Host
+
+	res, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The storage reader needs a metageneration, emulators may omit it
+	if res.Header.Get("X-Goog-Generation") != "" && res.Header.Get("X-Goog-Metageneration") == "" {
+		res.Header.Set("X-Goog-Metageneration", "1")
+	}
+
+	return res, nil
+}
+
+// objectMetadata returns the custom metadata of an object holding the
+// points of dateTime's day.
+func (g GCSExporter) objectMetadata(dateTime time.Time, projectID, metric string) map[string]string {
+	return exportMetadata(g.Metadata, g.Encryption, g.RunID, dateTime, projectID, metric)
+}
+
+// setAttrs applies the configured object attributes to w.
+func (g GCSExporter) setAttrs(w *storage.Writer) {
+	w.KMSKeyName = g.KMSKeyName
+	w.StorageClass = g.StorageClass
+	w.CacheControl = g.CacheControl
+	if g.ContentType != "" {
+		w.ContentType = g.ContentType
+	}
+	if g.ContentEncoding != "" {
+		w.ContentEncoding = g.ContentEncoding
+	}
+}
+
+// saveToObject uploads body under the overwrite policy. Uploads only
+// become visible once complete, generation preconditions keep concurrent
+// writers from clobbering each other. It returns the name of the object
+// holding body and its SHA-256, empty when an existing object was kept.
+func (g GCSExporter) saveToObject(filename string, body csvBody, metadata map[string]string) (string, string, error) {
+	ctx := context.Background()
+
+	points := body.points
+
+	switch g.Overwrite {
+	case OverwriteNever:
+		obj := g.object(filename).If(storage.Conditions{DoesNotExist: true})
+		sum, ok, err := g.upload(ctx, obj, body, points, metadata)
+		if err == nil && !ok {
+			log.Printf("Keep existing object %s", filename)
+		}
+		return filename, sum, err
+	case OverwriteIfMoreComplete:
+		obj := g.object(filename)
+		attrs, err := obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			obj = obj.If(storage.Conditions{DoesNotExist: true})
+		} else if err != nil {
+			return "", "", fmt.Errorf("cannot read object attributes: %v", err)
+		} else {
+			complete, err := g.objectCompleteness(ctx, obj, attrs)
+			if err != nil {
+				return "", "", err
+			}
+			if complete >= points {
+				log.Printf("Keep existing object %s, it is as complete", filename)
+				return filename, "", nil
+			}
+			obj = obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+		}
+		sum, ok, err := g.upload(ctx, obj, body, points, metadata)
+		if err == nil && !ok {
+			log.Printf("Object %s changed during export, keep it", filename)
+		}
+		return filename, sum, err
+	case OverwriteVersioned:
+		name := filename
+		for version := 2; ; version++ {
+			sum, ok, err := g.upload(ctx, g.object(name).If(storage.Conditions{DoesNotExist: true}), body, points, metadata)
+			if err != nil || ok {
+				return name, sum, err
+			}
+			existing, err := g.ReadObject(name)
+			if err != nil && err != ErrObjectNotExist {
+				return "", "", err
+			}
+			if err == nil && sameContent(existing, g.Compression, g.Encryption, body) {
+				log.Printf("Keep existing object %s, it holds the same content", name)
+				return name, "", nil
+			}
+			name = versionedName(filename, version)
+		}
+	default:
+		sum, _, err := g.upload(ctx, g.object(filename), body, points, metadata)
+		return filename, sum, err
+	}
+}
+
+// exportedFile describes the object name, reading it back when an existing
+// object was kept.
+func (g GCSExporter) exportedFile(name, sum string, rows int) (ExportedFile, error) {
+	ctx := context.Background()
+
+	attrs, err := g.object(name).Attrs(ctx)
+	if err != nil {
+		return ExportedFile{}, fmt.Errorf("cannot read object attributes: %v", err)
+	}
+
+	if sum == "" {
+		existing, err := g.ReadObject(name)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		sum = SHA256(existing)
+		rows = keptRows(existing, g.Compression, g.Encryption)
+	}
+
+	return ExportedFile{Name: name, Size: attrs.Size, Rows: rows, SHA256: sum, KeyIDs: g.Encryption.KeyIDs}, nil
+}
+
+// upload streams body to obj and returns the SHA-256 of the object, or
+// false when a precondition of obj failed. A failed upload is cancelled,
+// it never becomes visible.
+func (g GCSExporter) upload(ctx context.Context, obj *storage.ObjectHandle, body csvBody, points int, metadata map[string]string) (string, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, release := g.newWriter(ctx, obj)
+	defer release()
+
+	w.Metadata = map[string]string{completenessMetadataKey: strconv.Itoa(points)}
+	for key, value := range metadata {
+		w.Metadata[key] = value
+	}
+
+	w.ContentType, w.ContentEncoding = contentType(g.Compression, g.Encryption)
+	g.setAttrs(w)
+
+	h := sha256.New()
+	cw := newEncodeWriter(io.MultiWriter(w, h), g.Compression, g.Encryption)
+	err := body.writeTo(cw)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		cancel()
+		w.Close()
+		return "", false, fmt.Errorf("cannot upload object: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("cannot upload object: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), true, nil
+}
+
+// objectCompleteness reads the completeness recorded on an object, or counts
+// it for objects written before it was recorded.
+func (g GCSExporter) objectCompleteness(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs) (int, error) {
+	if points, err := strconv.Atoi(attrs.Metadata[completenessMetadataKey]); err == nil {
+		return points, nil
+	}
+
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read object: %v", err)
+	}
+	defer r.Close()
+
+	existing, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read object: %v", err)
+	}
+
+	content, ok := decodeContent(existing, g.Compression, g.Encryption)
+	if !ok {
+		return 0, nil
+	}
+
+	return completeness(content), nil
+}
+
+func (g GCSExporter) Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error) {
+	output := g.Paths.SeriesPath(dateTime, series)
+
+	metadata := g.objectMetadata(dateTime, series.ProjectID, series.Metric)
+	output, sum, err := g.saveTimeSeriesToCSV(output, series, metricPoints, metadata)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return g.exportedFile(output, sum, len(metricPoints))
+}
+
+func (g GCSExporter) WriteObject(name string, content []byte) error {
+	return g.WriteObjectFrom(name, bytes.NewReader(content))
+}
+
+func (g GCSExporter) WriteObjectFrom(name string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, release := g.newWriter(ctx, g.object(name))
+	defer release()
+
+	w.Metadata = map[string]string{}
+	for key, value := range g.Metadata {
+		w.Metadata[key] = value
+	}
+	if g.RunID != "" {
+		w.Metadata[runIDMetadataKey] = g.RunID
+	}
+	w.KMSKeyName = g.KMSKeyName
+	w.StorageClass = g.StorageClass
+	w.CacheControl = g.CacheControl
+
+	// Canceling before Close drops the upload
 	if _, err := io.Copy(w, r); err != nil {
-		log.Fatalf("Failed to export metrics: %v", err)
+		cancel()
+		w.Close()
+		return fmt.Errorf("cannot write object: %v", err)
 	}
 	if err := w.Close(); err != nil {
-		log.Fatalf("Failed to export metrics: %v", err)
+		return fmt.Errorf("cannot write object: %v", err)
+	}
+
+	return nil
+}
+
+func (g GCSExporter) ReadObject(name string) ([]byte, error) {
+	ctx := context.Background()
+
+	// Stored bytes, gzip objects are not transcoded, so checksums match
+	r, err := g.object(name).ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrObjectNotExist
 	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read object: %v", err)
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read object: %v", err)
+	}
+
+	return content, nil
 }
 
-func (g GCSExporter) Export(dateTime time.Time, projectID, metric, instanceName string, metricPoints []string, attendNames ...string) {
-	folder := fmt.Sprintf("%s/%d/%02d/%02d/%s", projectID, dateTime.Year(), dateTime.Month(), dateTime.Day(), instanceName)
+func (g GCSExporter) DeleteObject(name string) error {
+	ctx := context.Background()
 
-	title := strings.Replace(metric, "compute.googleapis.com/instance/", "", -1)
-	title = strings.Replace(title, "agent.googleapis.com/", "", -1)
-	title = strings.Replace(title, "/", "_", -1)
+	err := g.object(name).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("cannot delete object: %v", err)
+	}
+
+	return nil
+}
 
-	var output string
-	if len(attendNames) == 0 {
-		output = fmt.Sprintf("%s/%s[%s][%s].csv", folder, dateTime.Format("2006-01-02"), instanceName, title)
-	} else {
-		output = fmt.Sprintf("%s/%s[%s][%s][%s].csv", folder, dateTime.Format("2006-01-02"), instanceName, title, strings.Join(attendNames, "-"))
+func (g GCSExporter) ListObjects(prefix string) (names []string, err error) {
+	ctx := context.Background()
+
+	it := g.client.Bucket(g.BucketName).Objects(ctx, &storage.Query{Prefix: g.Prefix + prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot list objects: %v", err)
+		}
+		names = append(names, strings.TrimPrefix(attrs.Name, g.Prefix))
+	}
+
+	return
+}
+
+func (g GCSExporter) ExportProject(dateTime time.Time, projectID string, columns []string, rows RowSource) (ExportedFile, error) {
+	output := g.Paths.ProjectPath(dateTime, projectID)
+
+	body := newCSVBody(stackdriver.PointCSVHeader+","+strings.Join(columns, ","), rows)
+	log.Printf("Rows len: %d", body.rows)
+	if body.err != nil {
+		return ExportedFile{}, body.err
+	}
+	output, sum, err := g.saveToObject(output, body, g.objectMetadata(dateTime, projectID, ""))
+	if err != nil {
+		return ExportedFile{}, err
 	}
 
-	g.saveTimeSeriesToCSV(output, metricPoints)
+	return g.exportedFile(output, sum, body.rows)
 }
@@ -0,0 +1,179 @@
+package metric_exporter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestValidateGCS(t *testing.T) {
+	tests := []struct {
+		config string
+		ok     bool
+	}{
+		{"gcs: {content_encoding: gzip}", true},
+		{"compression: gzip\ngcs: {content_encoding: gzip}", false},
+		{"compression: zstd\ngcs: {content_encoding: identity}", false},
+		{"encryption: {mode: envelope, kek_id: k}\ngcs: {content_encoding: gzip}", false},
+		{"compression: gzip\ngcs: {content_type: text/plain}", true},
+	}
+
+	for _, test := range tests {
+		c := testConf(t, "exporter: GCSExporter\ndestination: bucket\n"+test.config)
+		if err := ValidateConf(c); (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.config, err)
+		}
+	}
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	c := testConf(t, `
+exporter: GCSExporter
+gcs:
+  concurrent_uploads: 8
+exporters:
+  - name: gcs
+  - name: s3
+    exporter: S3Exporter
+  - name: slow
+    gcs:
+      concurrent_uploads: 2
+`)
+
+	instances := testInstances(t, c)
+	for i, want := range []int{8, DefaultConcurrentUploads, 2} {
+		if got := ConcurrentUploads(instances[i]); got != want {
+			t.Errorf("%s: got %d uploads, want %d", instances[i].Name, got, want)
+		}
+	}
+
+	// Instances of one endpoint share its client, not a bound they do not set
+	endpoint := "http://localhost:4443"
+	fast, slow := sharedClient(endpoint, 8), sharedClient(endpoint, 2)
+	if fast.Client != slow.Client || cap(fast.uploads) != 8 || cap(slow.uploads) != 2 {
+		t.Errorf("got clients of %d and %d uploads", cap(fast.uploads), cap(slow.uploads))
+	}
+	if sharedClient(endpoint, 8) != fast {
+		t.Error("instances of the same bound do not share their uploads")
+	}
+}
+
+// testGCSExporter returns an exporter of a new bucket of the GCS server at
+// GCS_TEST_ENDPOINT, e.g. fake-gcs-server -scheme http -port 4443, and
+// skips the test without it.
+func testGCSExporter(t *testing.T, c utils.Conf) GCSExporter {
+	t.Helper()
+
+	endpoint := os.Getenv("GCS_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("GCS_TEST_ENDPOINT is not set")
+	}
+
+	c.Destination = fmt.Sprintf("test-%d", time.Now().UnixNano())
+	if err := sharedClient(endpoint, 1).Bucket(c.Destination).Create(context.Background(), "test", nil); err != nil {
+		t.Fatalf("Cannot create bucket: %v", err)
+	}
+
+	return NewGCSExporter(c, GCSConf{Endpoint: endpoint}).(GCSExporter)
+}
+
+func TestGCSSaveToObject(t *testing.T) {
+	partial := testBody("60,00:01,1.0", "120,00:02,")
+	complete := testBody("60,00:01,1.0", "120,00:02,2.0")
+
+	tests := []struct {
+		policy  string
+		first   csvBody
+		second  csvBody
+		name    string
+		kept    bool
+		content csvBody
+	}{
+		{OverwriteAlways, complete, partial, "a.csv", false, partial},
+		{OverwriteNever, partial, complete, "a.csv", true, partial},
+		{OverwriteIfMoreComplete, partial, complete, "a.csv", false, complete},
+		{OverwriteIfMoreComplete, complete, partial, "a.csv", true, complete},
+		{OverwriteVersioned, partial, complete, "a.v2.csv", false, complete},
+		{OverwriteVersioned, complete, complete, "a.csv", true, complete},
+	}
+
+	for _, test := range tests {
+		g := testGCSExporter(t, utils.Conf{Overwrite: test.policy})
+
+		if _, _, err := g.saveToObject("a.csv", test.first, nil); err != nil {
+			t.Fatal(err)
+		}
+		name, sum, err := g.saveToObject("a.csv", test.second, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name != test.name || (sum == "") != test.kept {
+			t.Errorf("%s: got %s, kept %v, want %s, kept %v", test.policy, name, sum == "", test.name, test.kept)
+		}
+		if content, _ := g.ReadObject(name); string(content) != readBody(t, test.content) {
+			t.Errorf("%s: %s holds %q", test.policy, name, content)
+		}
+	}
+}
+
+func TestGCSExport(t *testing.T) {
+	g := testGCSExporter(t, utils.Conf{Prefix: "exports", Compression: CompressionGzip, RunID: "run"})
+
+	file, err := g.Export(testDate, testSeries("compute.googleapis.com/instance/cpu/usage_time"), []string{"60,00:01,1.0", "120,00:02,2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(file.Name, ".csv.gz") || file.Rows != 2 {
+		t.Errorf("got file %+v", file)
+	}
+
+	// Stored compressed, not transcoded when read back
+	attrs, err := g.object(file.Name).Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != "exports/"+file.Name || attrs.ContentType != "text/csv" || attrs.ContentEncoding != "gzip" || attrs.Metadata[runIDMetadataKey] != "run" {
+		t.Errorf("got attributes %s, %s, %s, %v", attrs.Name, attrs.ContentType, attrs.ContentEncoding, attrs.Metadata)
+	}
+	content, err := g.ReadObject(file.Name)
+	if err != nil || int64(len(content)) != file.Size || SHA256(content) != file.SHA256 {
+		t.Errorf("read %d bytes of %+v", len(content), file)
+	}
+	if plain, _ := Decompress(content, CompressionGzip); CSVRows(string(plain)) != 2 {
+		t.Errorf("got %q", plain)
+	}
+
+	project, err := g.ExportProject(testDate, "p", []string{"metric"}, StringRows([]string{"60,00:01,1.0,cpu"}))
+	if err != nil || project.Rows != 1 {
+		t.Errorf("got project file %+v", project)
+	}
+
+	if err := g.WriteObject("_reports/2018-10-18/plan/p.json", []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"_reports/2018-10-18/plan/p.json", file.Name, project.Name}
+	for _, name := range want {
+		if names, err := g.ListObjects(name); err != nil || !reflect.DeepEqual(names, []string{name}) {
+			t.Errorf("listed %v under %s, %v", names, name, err)
+		}
+	}
+	if names, _ := g.ListObjects(""); len(names) != len(want) {
+		t.Errorf("listed %v", names)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := g.DeleteObject(file.Name); err != nil {
+			t.Errorf("delete: %v", err)
+		}
+	}
+	if _, err := g.ReadObject(file.Name); err != ErrObjectNotExist {
+		t.Errorf("read a deleted object: %v", err)
+	}
+}
@@ -1,9 +1,236 @@
 package metric_exporter
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
 	"time"
+
+	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
 )
 
+// Series identifies one exported time series.
+type Series struct {
+	ProjectID    string   `json:"project_id"`
+	Metric       string   `json:"metric"`
+	Zone         string   `json:"zone,omitempty"`
+	InstanceID   string   `json:"instance_id,omitempty"`
+	InstanceName string   `json:"instance_name"`
+	AttendNames  []string `json:"attend_names,omitempty"`
+
+	// ValueColumns replaces the single value column, set for files with
+	// one column per metric.
+	ValueColumns []string `json:"value_columns,omitempty"`
+
+	// Columns names the columns that follow the value in metricPoints,
+	// set for the long output format.
+	Columns []string `json:"columns,omitempty"`
+
+	// Labels are the instance labels, only loaded when label columns are
+	// configured.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Group is the display name of the Monitoring group the series was
+	// selected through, empty unless group folders are enabled.
+	Group string `json:"group,omitempty"`
+}
+
+// WideMetric is the metric of the per-instance file holding every metric.
+const WideMetric = "wide"
+
+// ColumnName names the series in a file with one column per metric, e.g.
+// "cpu_usage_time" or "disk_sda_write_ops_count".
+func (s Series) ColumnName() string {
+	name := MetricShortName(s.Metric)
+	if len(s.AttendNames) == 0 {
+		return name
+	}
+
+	attend := strings.Join(s.AttendNames, "_")
+	if strings.HasPrefix(name, s.AttendNames[0]+"_") {
+		return attend + strings.TrimPrefix(name, s.AttendNames[0])
+	}
+
+	return name + "_" + attend
+}
+
+// InstanceLabel names the instance in folder and file names. It carries the
+// instance ID so VMs sharing a name do not collide, unless legacyPaths asks
+// for the name-only layout.
+func (s Series) InstanceLabel(legacyPaths bool) string {
+	if legacyPaths || s.InstanceID == "" {
+		return s.InstanceName
+	}
+
+	return s.InstanceName + "_" + s.InstanceID
+}
+
+// csvContent returns the CSV header and rows of metricPoints, followed by the
+// series columns and one "label_<key>" column per entry of labelColumns.
+func csvContent(series Series, metricPoints []string, labelColumns []string) (header string, rows []string) {
+	header = stackdriver.PointCSVHeader
+	if len(series.ValueColumns) > 0 {
+		header = stackdriver.PointTimeCSVHeader + "," + strings.Join(series.ValueColumns, ",")
+	}
+	if len(series.Columns) > 0 {
+		header = header + "," + strings.Join(series.Columns, ",")
+	}
+
+	if len(labelColumns) == 0 {
+		return header, metricPoints
+	}
+
+	names := make([]string, len(labelColumns))
+	values := make([]string, len(labelColumns))
+	for i := range labelColumns {
+		names[i] = "label_" + labelColumns[i]
+		values[i] = series.Labels[labelColumns[i]]
+	}
+
+	header = header + "," + strings.Join(names, ",")
+	suffix := "," + strings.Join(values, ",")
+
+	rows = make([]string, len(metricPoints))
+	for i := range metricPoints {
+		rows[i] = metricPoints[i] + suffix
+	}
+
+	return
+}
+
+// RowSource passes the rows of a file to emit in order. It may be called
+// more than once, so rows read from elsewhere are streamed rather than held
+// in memory. An error it returns fails the export, the file is not written.
+type RowSource func(emit func(row string)) error
+
+// StringRows is the RowSource of rows.
+func StringRows(rows []string) RowSource {
+	return func(emit func(row string)) error {
+		for i := range rows {
+			emit(rows[i])
+		}
+		return nil
+	}
+}
+
+// csvBody is CSV content streamed row by row to a writer, rather than built
+// in memory. rows and points count its rows and the rows holding a value,
+// sum is the SHA-256 of the content before compression and encryption, err
+// the error of source while they were counted.
+type csvBody struct {
+	header string
+	source RowSource
+	rows   int
+	points int
+	sum    string
+	err    error
+}
+
+func newCSVBody(header string, source RowSource) csvBody {
+	body := csvBody{header: header, source: source}
+
+	h := sha256.New()
+	io.WriteString(h, header+"\n")
+	body.err = source(func(row string) {
+		if body.rows > 0 {
+			io.WriteString(h, "\n")
+		}
+		io.WriteString(h, row)
+
+		body.rows++
+		if rowComplete(row) {
+			body.points++
+		}
+	})
+	body.sum = hex.EncodeToString(h.Sum(nil))
+
+	return body
+}
+
+func (b csvBody) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(b.header)
+	bw.WriteString("\n")
+	first := true
+	err := b.source(func(row string) {
+		if !first {
+			bw.WriteString("\n")
+		}
+		first = false
+		bw.WriteString(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// reader returns the content of b, streamed as it is read.
+func (b csvBody) reader() io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(b.writeTo(w))
+	}()
+
+	return r
+}
+
+// ExportedFile describes a file written, or kept by the overwrite policy, by
+// an exporter. Name is relative to the exporter destination.
+type ExportedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+
+	// KeyIDs of the keys able to decrypt the file, when encrypted
+	KeyIDs []string `json:"key_ids,omitempty"`
+}
+
+// SchemaVersion is the version of the layout of exported CSV files, raised
+// whenever columns change meaning.
+const SchemaVersion = 1
+
+// SHA256 returns the hex SHA-256 of content, as stored in ExportedFile.
+func SHA256(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
 type MetricExporter interface {
-	Export(dateTime time.Time, projectID, metric, instanceName string, metricPoints []string, attendNames ...string)
+	Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error)
+}
+
+// ErrObjectNotExist is returned by ReadObject for a missing object.
+var ErrObjectNotExist = errors.New("object does not exist")
+
+// ObjectStore is implemented by exporters whose destination can also hold
+// auxiliary objects such as run records and reports. WriteObjectFrom streams
+// the content read from r, an error reading it fails the write and leaves
+// no object. Deleting a missing object is not an error.
+type ObjectStore interface {
+	WriteObject(name string, content []byte) error
+	WriteObjectFrom(name string, r io.Reader) error
+	ReadObject(name string) ([]byte, error)
+	ListObjects(prefix string) ([]string, error)
+	DeleteObject(name string) error
+}
+
+// ProjectExporter is implemented by exporters that can write the consolidated
+// daily file of a project. columns follow the point columns of every row.
+type ProjectExporter interface {
+	ExportProject(dateTime time.Time, projectID string, columns []string, rows RowSource) (ExportedFile, error)
+}
+
+// ProjectLoader is implemented by exporters that stage the series of a
+// project and load them together. PlanProject records the series planned,
+// LoadProject loads the staged series once all planned ones are, and
+// reports whether it did.
+type ProjectLoader interface {
+	PlanProject(dateTime time.Time, projectID string, planned []Series) error
+	LoadProject(dateTime time.Time, projectID string) (bool, error)
 }
@@ -0,0 +1,89 @@
+package metric_exporter
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// testDate is the day exported in tests.
+var testDate = time.Date(2018, 10, 18, 0, 0, 0, 0, time.UTC)
+
+func testSeries(metric string, attendNames ...string) Series {
+	return Series{
+		ProjectID:    "p",
+		Metric:       metric,
+		Zone:         "asia-east1-a",
+		InstanceID:   "1234",
+		InstanceName: "web",
+		AttendNames:  attendNames,
+	}
+}
+
+func TestInstanceLabel(t *testing.T) {
+	series := testSeries("compute.googleapis.com/instance/cpu/usage_time")
+	if got := series.InstanceLabel(false); got != "web_1234" {
+		t.Errorf("InstanceLabel(false) = %q, want web_1234", got)
+	}
+	if got := series.InstanceLabel(true); got != "web" {
+		t.Errorf("InstanceLabel(true) = %q, want web", got)
+	}
+
+	series.InstanceID = ""
+	if got := series.InstanceLabel(false); got != "web" {
+		t.Errorf("InstanceLabel(false) without ID = %q, want web", got)
+	}
+}
+
+func TestSeriesPathInstanceID(t *testing.T) {
+	series := testSeries("compute.googleapis.com/instance/disk/write_ops_count", "disk", "sda")
+
+	tests := []struct {
+		legacyPaths bool
+		want        string
+	}{
+		{false, "p/2018/10/18/web_1234/2018-10-18[web_1234][disk_write_ops_count][disk-sda].csv"},
+		{true, "p/2018/10/18/web/2018-10-18[web][disk_write_ops_count][disk-sda].csv"},
+	}
+
+	for _, test := range tests {
+		paths := NewPathBuilder(utils.Conf{LegacyPaths: test.legacyPaths})
+		if got := paths.SeriesPath(testDate, series); got != test.want {
+			t.Errorf("SeriesPath with legacy_paths %v = %q, want %q", test.legacyPaths, got, test.want)
+		}
+	}
+}
+
+func TestCSVContentColumns(t *testing.T) {
+	series := testSeries("agent.googleapis.com/memory/bytes_used")
+	series.Columns = []string{"metric", "state"}
+	series.Labels = map[string]string{"env": "prod"}
+	points := []string{"1,a,1,agent.googleapis.com/memory/bytes_used,used", "1,a,2,agent.googleapis.com/memory/bytes_used,free"}
+
+	header, rows := csvContent(series, points, nil)
+	if header != "timestamp,datetime,value,metric,state" || !reflect.DeepEqual(rows, points) {
+		t.Errorf("got %q and %q", header, rows)
+	}
+
+	header, rows = csvContent(series, points, []string{"env", "team"})
+	want := []string{points[0] + ",prod,", points[1] + ",prod,"}
+	if header != "timestamp,datetime,value,metric,state,label_env,label_team" || !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %q and %q with label columns", header, rows)
+	}
+}
+
+func TestCSVBody(t *testing.T) {
+	body := newCSVBody("timestamp,datetime,value", StringRows([]string{"60,00:01,1.0", "120,00:02,", "180,00:03,3.0"}))
+	if body.rows != 3 || body.points != 2 {
+		t.Errorf("got %d rows and %d points, want 3 and 2", body.rows, body.points)
+	}
+
+	content, err := ioutil.ReadAll(body.reader())
+	want := "timestamp,datetime,value\n60,00:01,1.0\n120,00:02,\n180,00:03,3.0"
+	if err != nil || string(content) != want {
+		t.Errorf("got content %q, %v, want %q", content, err, want)
+	}
+}
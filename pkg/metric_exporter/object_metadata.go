@@ -0,0 +1,58 @@
+package metric_exporter
+
+import (
+	"strconv"
+	"time"
+)
+
+// Custom metadata describing exported objects
+const (
+	projectIDMetadataKey     = "project-id"
+	metricMetadataKey        = "metric"
+	windowStartMetadataKey   = "window-start"
+	windowEndMetadataKey     = "window-end"
+	runIDMetadataKey         = "run-id"
+	schemaVersionMetadataKey = "schema-version"
+)
+
+// completenessMetadataKey holds the completeness of exported objects, read
+// by the if-more-complete overwrite policy.
+const completenessMetadataKey = "complete-points"
+
+// exportMetadata returns the custom metadata of an object holding the
+// points of dateTime's day, on top of the static metadata.
+func exportMetadata(static map[string]string, encryption Encryption, runID string, dateTime time.Time, projectID, metric string) map[string]string {
+	metadata := encryption.Metadata()
+	for key, value := range static {
+		metadata[key] = value
+	}
+
+	metadata[projectIDMetadataKey] = projectID
+	if metric != "" {
+		metadata[metricMetadataKey] = metric
+	}
+	metadata[windowStartMetadataKey] = dateTime.UTC().Format(time.RFC3339)
+	metadata[windowEndMetadataKey] = dateTime.AddDate(0, 0, 1).UTC().Format(time.RFC3339)
+	if runID != "" {
+		metadata[runIDMetadataKey] = runID
+	}
+	metadata[schemaVersionMetadataKey] = strconv.Itoa(SchemaVersion)
+
+	return metadata
+}
+
+// contentType returns the content type and encoding of exported objects.
+// gzip objects are served decompressed to clients that do not accept it,
+// encrypted objects are opaque.
+func contentType(compression string, encryption Encryption) (string, string) {
+	switch {
+	case encryption.Enabled():
+		return "application/octet-stream", ""
+	case compression == CompressionGzip:
+		return "text/csv", "gzip"
+	case compression == CompressionZstd:
+		return "application/zstd", ""
+	default:
+		return "text/csv", ""
+	}
+}
@@ -0,0 +1,100 @@
+package metric_exporter
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// Overwrite policies of exported files that already exist
+const OverwriteAlways = "always"
+const OverwriteNever = "never"
+const OverwriteIfMoreComplete = "if-more-complete"
+const OverwriteVersioned = "versioned"
+
+func overwritePolicy(policy string) string {
+	policy, err := parseOverwritePolicy(policy)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return policy
+}
+
+// parseOverwritePolicy returns the policy named by policy, always when it is
+// empty.
+func parseOverwritePolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return OverwriteAlways, nil
+	case OverwriteAlways, OverwriteNever, OverwriteIfMoreComplete, OverwriteVersioned:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overwrite policy %q", policy)
+	}
+}
+
+// completeness counts the rows of CSV content, header excluded, whose first
+// value is present.
+func completeness(content string) int {
+	return rowsCompleteness(strings.Split(content, "\n")[1:])
+}
+
+func rowsCompleteness(rows []string) (points int) {
+	for i := range rows {
+		if rowComplete(rows[i]) {
+			points = points + 1
+		}
+	}
+
+	return
+}
+
+// rowComplete reports whether row holds a value.
+func rowComplete(row string) bool {
+	fields := strings.SplitN(row, ",", 4)
+	return len(fields) >= 3 && fields[2] != ""
+}
+
+// CSVRows counts the rows of CSV content after its header.
+func CSVRows(content string) (rows int) {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			rows = rows + 1
+		}
+	}
+
+	return
+}
+
+// keptRows counts the rows of an existing file kept by the overwrite
+// policy, zero when it cannot be decrypted.
+func keptRows(existing []byte, compression string, encryption Encryption) int {
+	content, ok := decodeContent(existing, compression, encryption)
+	if !ok {
+		return 0
+	}
+
+	return CSVRows(content)
+}
+
+// sameContent reports whether the stored bytes existing decode to the
+// content of body. Versioned writes keep such a file rather than add a
+// version, e.g. when tasks finishing together write the same wide file.
+func sameContent(existing []byte, compression string, encryption Encryption, body csvBody) bool {
+	content, ok := decodeContent(existing, compression, encryption)
+	return ok && SHA256([]byte(content)) == body.sum
+}
+
+// versionedName inserts a version before the extension,
+// "a/2018-10-18[web].csv.gz" becomes "a/2018-10-18[web].v2.csv.gz".
+func versionedName(name string, version int) string {
+	encryptionExt := EncryptionExt(EncryptionOf(name))
+	name = strings.TrimSuffix(name, encryptionExt)
+
+	compressionExt := CompressionExt(CompressionOf(name))
+	ext := path.Ext(strings.TrimSuffix(name, compressionExt)) + compressionExt + encryptionExt
+	return fmt.Sprintf("%s.v%d%s", strings.TrimSuffix(name, ext[:len(ext)-len(encryptionExt)]), version, ext)
+}
@@ -0,0 +1,240 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+const PathPresetDefault = "default"
+const PathPresetHive = "hive"
+
+// Series, project, bundle and project file path templates of every preset
+var pathPresets = map[string][4]string{
+	PathPresetDefault: {
+		`{{.ProjectID}}/{{.Year}}/{{.Month}}/{{.Day}}/{{with .Group}}{{.}}/{{end}}{{.Instance}}/{{.Date}}[{{.Instance}}][{{.MetricName}}]{{with .Attend}}[{{.}}]{{end}}.{{.Ext}}`,
+		`{{.ProjectID}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Date}}[{{.ProjectID}}].{{.Ext}}`,
+		`{{.ProjectID}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Date}}[{{.ProjectID}}].{{.Ext}}`,
+		`{{.ProjectID}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Name}}`,
+	},
+	PathPresetHive: {
+		`project={{.ProjectID}}/dt={{.Date}}/metric={{.MetricName}}/{{with .Group}}group={{.}}/{{end}}{{.Instance}}{{with .Attend}}-{{.}}{{end}}.{{.Ext}}`,
+		`consolidated/project={{.ProjectID}}/dt={{.Date}}/{{.ProjectID}}.{{.Ext}}`,
+		`bundles/project={{.ProjectID}}/dt={{.Date}}/{{.ProjectID}}.{{.Ext}}`,
+		`project={{.ProjectID}}/dt={{.Date}}/{{.Name}}`,
+	},
+}
+
+// PathVars are the variables available to path templates.
+type PathVars struct {
+	ProjectID string
+	Date      string
+	Year      string
+	Month     string
+	Day       string
+
+	Zone         string
+	InstanceID   string
+	InstanceName string
+	// Instance is the instance folder name, see Series.InstanceLabel
+	Instance string
+	Group    string
+
+	Metric     string
+	MetricName string
+	Attend     string
+
+	// Labels are the instance labels of the series
+	Labels map[string]string
+
+	Ext string
+
+	// Name is the file name of project files, e.g. "instances.csv"
+	Name string
+}
+
+// PathBuilder renders the object paths of exported files, relative to the
+// exporter destination.
+type PathBuilder struct {
+	LegacyPaths bool
+	Ext         string
+
+	series      *template.Template
+	project     *template.Template
+	bundle      *template.Template
+	projectFile *template.Template
+}
+
+// NewPathBuilder returns the path builder of c, which ValidateConf has
+// checked.
+func NewPathBuilder(c utils.Conf) PathBuilder {
+	b, err := ParsePathBuilder(c)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return b
+}
+
+// ParsePathBuilder parses the path templates of c, failing on an unknown
+// preset or a template that does not parse.
+func ParsePathBuilder(c utils.Conf) (b PathBuilder, err error) {
+	preset := c.PathPreset
+	if preset == "" {
+		preset = PathPresetDefault
+	}
+
+	templates, ok := pathPresets[preset]
+	if !ok {
+		return b, fmt.Errorf("unknown path preset: %s", preset)
+	}
+	if c.PathTemplate != "" {
+		templates[0] = c.PathTemplate
+	}
+	if c.ProjectPathTemplate != "" {
+		templates[1] = c.ProjectPathTemplate
+	}
+	if c.BundlePathTemplate != "" {
+		templates[2] = c.BundlePathTemplate
+	}
+	if c.ProjectFilePathTemplate != "" {
+		templates[3] = c.ProjectFilePathTemplate
+	}
+
+	b = PathBuilder{LegacyPaths: c.LegacyPaths, Ext: "csv" + compressionExts[compressionPolicy(c.Compression)] + encryptionExts[c.Encryption.Mode]}
+	names := [4]string{"path_template", "project_path_template", "bundle_path_template", "project_file_path_template"}
+	var parsed [4]*template.Template
+	for i := range templates {
+		parsed[i], err = template.New(names[i]).Option("missingkey=zero").Parse(templates[i])
+		if err != nil {
+			return b, fmt.Errorf("invalid %s: %v", names[i], err)
+		}
+	}
+	b.series, b.project, b.bundle, b.projectFile = parsed[0], parsed[1], parsed[2], parsed[3]
+
+	return b, nil
+}
+
+// MetricShortName strips the API prefix of metric types, e.g.
+// "compute.googleapis.com/instance/cpu/usage_time" becomes "cpu_usage_time".
+func MetricShortName(metric string) string {
+	name := strings.Replace(metric, "compute.googleapis.com/instance/", "", -1)
+	name = strings.Replace(name, "agent.googleapis.com/", "", -1)
+
+	return strings.Replace(name, "/", "_", -1)
+}
+
+func (b PathBuilder) dateVars(dateTime time.Time, projectID string) PathVars {
+	return PathVars{
+		ProjectID: projectID,
+		Date:      dateTime.Format("2006-01-02"),
+		Year:      fmt.Sprintf("%d", dateTime.Year()),
+		Month:     fmt.Sprintf("%02d", dateTime.Month()),
+		Day:       fmt.Sprintf("%02d", dateTime.Day()),
+		Ext:       b.Ext,
+	}
+}
+
+func (b PathBuilder) SeriesPath(dateTime time.Time, series Series) string {
+	vars := b.dateVars(dateTime, series.ProjectID)
+	vars.Zone = series.Zone
+	vars.InstanceID = series.InstanceID
+	vars.InstanceName = series.InstanceName
+	vars.Instance = series.InstanceLabel(b.LegacyPaths)
+	vars.Group = series.Group
+	vars.Metric = series.Metric
+	vars.MetricName = MetricShortName(series.Metric)
+	vars.Attend = strings.Join(series.AttendNames, "-")
+	vars.Labels = series.Labels
+
+	return render(b.series, vars)
+}
+
+func (b PathBuilder) ProjectPath(dateTime time.Time, projectID string) string {
+	return render(b.project, b.dateVars(dateTime, projectID))
+}
+
+// BundlePath is the path of the project's daily archive, ext is the archive
+// format.
+func (b PathBuilder) BundlePath(dateTime time.Time, projectID, ext string) string {
+	vars := b.dateVars(dateTime, projectID)
+	vars.Ext = ext
+
+	return render(b.bundle, vars)
+}
+
+// ProjectFilePath is the path of a file of the project's day that is not
+// exported points, such as the inventory or the manifest.
+func (b PathBuilder) ProjectFilePath(dateTime time.Time, projectID, name string) string {
+	vars := b.dateVars(dateTime, projectID)
+	vars.Name = name
+
+	return render(b.projectFile, vars)
+}
+
+// pathMarker stands for the variables that are not known when listing the
+// files of a project and day.
+const pathMarker = "\x00"
+
+// DayPrefixes returns the folders holding every file of projectID and the
+// day of dateTime, so they can be listed without walking the whole
+// destination. A template starting with instance labels gives "".
+func (b PathBuilder) DayPrefixes(dateTime time.Time, projectID string) (prefixes []string) {
+	vars := b.dateVars(dateTime, projectID)
+	vars.Zone = pathMarker
+	vars.InstanceID = pathMarker
+	vars.InstanceName = pathMarker
+	vars.Instance = pathMarker
+	vars.Group = pathMarker
+	vars.Metric = pathMarker
+	vars.MetricName = pathMarker
+	vars.Attend = pathMarker
+	vars.Ext = pathMarker
+	vars.Name = pathMarker
+
+	seen := make(map[string]bool)
+	for _, t := range []*template.Template{b.series, b.project, b.bundle, b.projectFile} {
+		prefix := render(t, vars)
+		if i := strings.Index(prefix, pathMarker); i >= 0 {
+			prefix = prefix[:i]
+		}
+		prefix = prefix[:strings.LastIndex(prefix, "/")+1]
+
+		// Labels are unknown, they may come before the date
+		if strings.Contains(t.Root.String(), ".Labels") {
+			prefix = ""
+		}
+
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	// Drop the folders inside another one
+	sort.Strings(prefixes)
+	kept := prefixes[:0]
+	for i := range prefixes {
+		if len(kept) > 0 && strings.HasPrefix(prefixes[i], kept[len(kept)-1]) {
+			continue
+		}
+		kept = append(kept, prefixes[i])
+	}
+
+	return kept
+}
+
+func render(t *template.Template, vars PathVars) string {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		log.Fatalf("Cannot render path %s: %v", t.Name(), err)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,117 @@
+package metric_exporter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestPathPresets(t *testing.T) {
+	series := testSeries("compute.googleapis.com/instance/disk/write_ops_count", "disk", "sda")
+
+	tests := []struct {
+		preset      string
+		series      string
+		project     string
+		bundle      string
+		projectFile string
+	}{
+		{
+			PathPresetDefault,
+			"p/2018/10/18/web_1234/2018-10-18[web_1234][disk_write_ops_count][disk-sda].csv",
+			"p/2018/10/18/2018-10-18[p].csv",
+			"p/2018/10/18/2018-10-18[p].tar.gz",
+			"p/2018/10/18/manifest.json",
+		},
+		{
+			PathPresetHive,
+			"project=p/dt=2018-10-18/metric=disk_write_ops_count/web_1234-disk-sda.csv",
+			"consolidated/project=p/dt=2018-10-18/p.csv",
+			"bundles/project=p/dt=2018-10-18/p.tar.gz",
+			"project=p/dt=2018-10-18/manifest.json",
+		},
+	}
+
+	for _, test := range tests {
+		b, err := ParsePathBuilder(utils.Conf{PathPreset: test.preset})
+		if err != nil {
+			t.Fatalf("%s: %v", test.preset, err)
+		}
+
+		if got := b.SeriesPath(testDate, series); got != test.series {
+			t.Errorf("%s: got series path %s, want %s", test.preset, got, test.series)
+		}
+		if got := b.ProjectPath(testDate, "p"); got != test.project {
+			t.Errorf("%s: got project path %s, want %s", test.preset, got, test.project)
+		}
+		if got := b.BundlePath(testDate, "p", "tar.gz"); got != test.bundle {
+			t.Errorf("%s: got bundle path %s, want %s", test.preset, got, test.bundle)
+		}
+		if got := b.ProjectFilePath(testDate, "p", "manifest.json"); got != test.projectFile {
+			t.Errorf("%s: got project file path %s, want %s", test.preset, got, test.projectFile)
+		}
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	c := utils.Conf{
+		PathTemplate:            "{{.ProjectID}}/{{.Zone}}/{{.InstanceName}}/{{.MetricName}}{{with .Attend}}-{{.}}{{end}}.{{.Ext}}",
+		ProjectFilePathTemplate: "{{.ProjectID}}/{{.Date}}/{{.Name}}",
+		Compression:             "gzip",
+	}
+	b, err := ParsePathBuilder(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := b.SeriesPath(testDate, testSeries("compute.googleapis.com/instance/cpu/usage_time")), "p/asia-east1-a/web/cpu_usage_time.csv.gz"; got != want {
+		t.Errorf("got series path %s, want %s", got, want)
+	}
+	if got, want := b.ProjectFilePath(testDate, "p", "instances.csv"), "p/2018-10-18/instances.csv"; got != want {
+		t.Errorf("got project file path %s, want %s", got, want)
+	}
+}
+
+func TestParsePathBuilderErrors(t *testing.T) {
+	tests := []struct {
+		conf utils.Conf
+		err  string
+	}{
+		{utils.Conf{PathPreset: "flat"}, "unknown path preset: flat"},
+		{utils.Conf{PathTemplate: "{{.ProjectID}/{{.Date}}"}, "invalid path_template"},
+		{utils.Conf{BundlePathTemplate: "{{if .Date}}"}, "invalid bundle_path_template"},
+		{utils.Conf{ProjectFilePathTemplate: "{{.Name"}, "invalid project_file_path_template"},
+	}
+
+	for _, test := range tests {
+		if _, err := ParsePathBuilder(test.conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: got error %v, want %q", test.conf, err, test.err)
+		}
+
+		// Found when the config is validated, not while exporting
+		if err := ValidateConf(test.conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: ValidateConf got error %v, want %q", test.conf, err, test.err)
+		}
+	}
+}
+
+func TestDayPrefixes(t *testing.T) {
+	if got, want := NewPathBuilder(utils.Conf{}).DayPrefixes(testDate, "p"), []string{"p/2018/10/18/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got prefixes %q, want %q", got, want)
+	}
+
+	paths := NewPathBuilder(utils.Conf{PathPreset: PathPresetHive})
+	got := paths.DayPrefixes(testDate, "p")
+	want := []string{"bundles/project=p/dt=2018-10-18/", "consolidated/project=p/dt=2018-10-18/", "project=p/dt=2018-10-18/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got prefixes %q, want %q", got, want)
+	}
+
+	// Instance labels may come before the date
+	paths = NewPathBuilder(utils.Conf{PathTemplate: "{{.Labels.team}}/{{.Date}}/{{.Instance}}.{{.Ext}}"})
+	if got := paths.DayPrefixes(testDate, "p"); got[0] != "" {
+		t.Errorf("got prefixes %q with labels, want the whole destination", got)
+	}
+}
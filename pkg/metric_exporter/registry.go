@@ -0,0 +1,249 @@
+package metric_exporter
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// DefaultExporter is used when config.yaml names no exporter.
+const DefaultExporter = "FileExporter"
+
+// ExporterType is an exporter known to the registry.
+type ExporterType struct {
+	// Name is the value of "exporter" in config.yaml.
+	Name string
+
+	// Block is the key of the exporter's own config block, Config the zero
+	// value of the struct it decodes into. Unknown keys fail validation.
+	Block  string
+	Config interface{}
+
+	// Validate, when set, checks the options of c and of the decoded block
+	// the exporter cannot combine.
+	Validate func(c utils.Conf, config interface{}) error
+
+	// New returns the exporter of c and of its decoded block, a value of
+	// the type of Config.
+	New func(c utils.Conf, config interface{}) MetricExporter
+}
+
+var registry = struct {
+	sync.RWMutex
+	types map[string]ExporterType
+}{types: make(map[string]ExporterType)}
+
+// Register adds t to the registry, exporters register themselves in init.
+func Register(t ExporterType) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.types[t.Name]; ok {
+		panic("metric_exporter: exporter registered twice: " + t.Name)
+	}
+	registry.types[t.Name] = t
+}
+
+// Lookup returns the exporter registered as name, DefaultExporter when empty.
+func Lookup(name string) (ExporterType, bool) {
+	if name == "" {
+		name = DefaultExporter
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	t, ok := registry.types[name]
+	return t, ok
+}
+
+// isBlock reports whether key is the block of a registered exporter.
+func isBlock(key string) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for _, t := range registry.types {
+		if t.Block != "" && t.Block == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Exporters returns the sorted names of the registered exporters.
+func Exporters() (names []string) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for name := range registry.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// runKeys are read from the top-level conf once per run, when the series
+// of every instance are planned together.
+var runKeys = map[string]bool{
+	"timezone":           true,
+	"groups":             true,
+	"group_folders":      true,
+	"instance_selectors": true,
+	"compute_endpoint":   true,
+	"exporters":          true,
+}
+
+// ValidateConf checks the exporter of c, or of each of its instances, is
+// registered and its config block matches its schema.
+func ValidateConf(c utils.Conf) error {
+	if len(c.Exporters) == 0 {
+		return validateRoutes(c)
+	}
+
+	instances, err := c.ExporterInstances()
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for i := range instances {
+		instance := instances[i]
+		if names[instance.Name] {
+			return fmt.Errorf("exporter %s listed twice", instance.Name)
+		}
+		names[instance.Name] = true
+
+		// Keys of an instance are fields of the conf or exporter blocks,
+		// others are misspelled
+		for key := range c.Exporters[i] {
+			if !utils.ConfKey(key) && !isBlock(key) {
+				return fmt.Errorf("exporter %s: unknown key %q", instance.Name, key)
+			}
+			if runKeys[key] {
+				return fmt.Errorf("exporter %s: %s applies to the whole run, set it at the top level", instance.Name, key)
+			}
+		}
+
+		if err := validateRoutes(instance); err != nil {
+			return fmt.Errorf("exporter %s: %v", instance.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateRoutes checks the exporter of c on its default route and on each
+// of its routes.
+func validateRoutes(c utils.Conf) error {
+	if err := validateExporter(c); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Routes {
+		name := c.RouteName(i)
+		if names[name] {
+			return fmt.Errorf("route %s listed twice", name)
+		}
+		names[name] = true
+
+		if err := validateExporter(c.WithRoute(name)); err != nil {
+			return fmt.Errorf("route %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func validateExporter(c utils.Conf) error {
+	t, ok := Lookup(c.ExporterClass)
+	if !ok {
+		return fmt.Errorf("unknown exporter %q, registered: %s", c.ExporterClass, strings.Join(Exporters(), ", "))
+	}
+
+	if _, err := ParsePathBuilder(c); err != nil {
+		return err
+	}
+
+	if _, err := parseOverwritePolicy(c.Overwrite); err != nil {
+		return err
+	}
+
+	if _, err := ParseEncryption(c.Encryption); err != nil {
+		return err
+	}
+
+	// Wide and consolidated files are assembled from the encrypted rows of
+	// the run ledger
+	mode := c.Encryption.Mode
+	if (c.WideFormat || c.Consolidated) && (mode == EncryptionAge || mode == EncryptionOpenPGP) && c.Encryption.IdentityFile == "" {
+		return fmt.Errorf("wide_format and consolidated read exported rows back, %s encryption needs an identity_file", mode)
+	}
+
+	if format := c.Bundle.Format; format != "" && format != utils.BundleTarGz && format != utils.BundleZip {
+		return fmt.Errorf("unknown bundle format %q, want %s or %s", format, utils.BundleTarGz, utils.BundleZip)
+	}
+
+	// Rollups append the rows of plaintext CSV files, encrypted files would
+	// expire without being rolled up
+	if c.Retention.MonthlyRollups && mode != EncryptionNone {
+		return fmt.Errorf("monthly_rollups cannot read %s encrypted files", mode)
+	}
+
+	config, err := t.decodeBlock(c)
+	if err != nil {
+		return err
+	}
+
+	if t.Validate != nil {
+		return t.Validate(c, config)
+	}
+
+	return nil
+}
+
+// decodeBlock decodes the block of t in c into a value of the type of
+// t.Config, its zero value when c has no such block.
+func (t ExporterType) decodeBlock(c utils.Conf) (interface{}, error) {
+	if t.Block == "" || t.Config == nil {
+		return t.Config, nil
+	}
+
+	block, ok := c.Blocks[t.Block]
+	if !ok {
+		return t.Config, nil
+	}
+
+	content, err := yaml.Marshal(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s block of %s: %v", t.Block, t.Name, err)
+	}
+	config := reflect.New(reflect.TypeOf(t.Config))
+	if err := yaml.UnmarshalStrict(content, config.Interface()); err != nil {
+		return nil, fmt.Errorf("%s block of %s: %v", t.Block, t.Name, err)
+	}
+
+	return config.Elem().Interface(), nil
+}
+
+// NewExporter returns the exporter configured by c and its block.
+func NewExporter(c utils.Conf) (MetricExporter, error) {
+	t, ok := Lookup(c.ExporterClass)
+	if !ok {
+		return nil, fmt.Errorf("unknown exporter %q, registered: %s", c.ExporterClass, strings.Join(Exporters(), ", "))
+	}
+
+	config, err := t.decodeBlock(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.New(c, config), nil
+}
@@ -0,0 +1,136 @@
+package metric_exporter
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// testConf returns the conf of the config.yaml content.
+func testConf(t *testing.T, content string) utils.Conf {
+	t.Helper()
+
+	var c utils.Conf
+	if err := c.Parse([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// testInstances returns the exporter instances of c.
+func testInstances(t *testing.T, c utils.Conf) []utils.Conf {
+	t.Helper()
+
+	instances, err := c.ExporterInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return instances
+}
+
+func TestNewExporterBlock(t *testing.T) {
+	c := testConf(t, `
+destination: /tmp/metrics
+file:
+  file_mode: 0600
+exporters:
+  - name: default
+  - name: shared
+    file:
+      file_mode: 0640
+`)
+
+	instances := testInstances(t, c)
+	tests := []struct {
+		conf utils.Conf
+		mode os.FileMode
+	}{
+		{c, 0600},
+		{instances[0], 0600},
+		{instances[1], 0640},
+		{utils.Conf{Destination: "/tmp/metrics"}, 0644},
+	}
+
+	for _, test := range tests {
+		exporter, err := NewExporter(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := exporter.(FileExporter).FileMode; mode != test.mode {
+			t.Errorf("%s: got file mode %o, want %o", test.conf.Name, mode, test.mode)
+		}
+	}
+}
+
+func TestValidateBlock(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"exporter: Nope", `unknown exporter "Nope"`},
+		{"file: {file_mod: 0600}", "file block of FileExporter"},
+		{"exporter: GCSExporter\ngcs: {chunk_size: big}", "gcs block of GCSExporter"},
+		// Blocks of other exporters are not checked
+		{"gcs: {chunk_size: big}", ""},
+		{"exporters: [{name: a, file: {mode: 1}}]", "exporter a: file block of FileExporter"},
+		{"bundle: {format: rar}", `unknown bundle format "rar"`},
+		{"bundle: {format: zip}", ""},
+		// Rollups of encrypted files
+		{"retention: {keep_days: 30, monthly_rollups: true}\nencryption: {mode: age, recipients: [" + ageTestRecipient + "]}", "monthly_rollups cannot read age encrypted files"},
+		{"exporters: [{name: a, retention: {keep_days: 30, monthly_rollups: true}, encryption: {mode: age, recipients: [" + ageTestRecipient + "]}}]", "exporter a: monthly_rollups"},
+		{"retention: {keep_days: 30}\nencryption: {mode: age, recipients: [" + ageTestRecipient + "]}", ""},
+		// Options shared by the exporters
+		{"overwrite: sometimes", `unknown overwrite policy "sometimes"`},
+		{"exporters: [{name: a, overwrite: versioned}, {name: b, overwrite: sometimes}]", "exporter b: unknown overwrite policy"},
+		{"encryption: {mode: rot13}", `unknown encryption "rot13"`},
+		// Settings of each exporter
+		{"exporter: GCSExporter\ngcs: {endpoint: 'localhost:4443'}", "invalid GCS endpoint"},
+		{"exporter: BigQueryExporter\ndestination: metrics", `BigQuery destination "metrics" is not dataset.table`},
+		{"exporter: BigQueryExporter\ndestination: p.metrics.cpu.usage", "is not dataset.table"},
+		{"exporter: BigQueryExporter\ndestination: metrics.", "has an empty part"},
+		{"exporter: BigQueryExporter\ndestination: metrics.points\nbigquery: {endpoint: /bq}", "invalid BigQuery endpoint"},
+		{"exporter: BigQueryExporter\ndestination: p.metrics.points\nbigquery: {endpoint: 'http://localhost:9050'}", ""},
+		{"exporter: S3Exporter\ndestination: b\ns3: {endpoint: 'http://'}", "invalid S3 endpoint"},
+		{"exporter: S3Exporter\ndestination: b\ns3: {server_side_encryption: aes}", `unknown S3 server_side_encryption "aes"`},
+		{"exporter: S3Exporter\ndestination: b\ns3: {server_side_encryption: AES256, kms_key_id: k}", "kms_key_id needs server_side_encryption aws:kms"},
+		{"exporter: S3Exporter\ndestination: b\ns3: {sse_customer_key: c2hvcnQ=}", "sse_customer_key is not a base64 AES-256 key"},
+		{"exporter: S3Exporter\ndestination: b\ns3: {server_side_encryption: 'aws:kms', kms_key_id: k}", ""},
+		{"exporter: AzureBlobExporter\ndestination: c\nazure: {account_name: a, endpoint: blob}", "invalid Azure endpoint"},
+		{"exporter: AzureBlobExporter\ndestination: c\nazure: {account_name: a, account_key: '!'}", "account_key is not base64"},
+		{"exporter: AzureBlobExporter\ndestination: c\nazure: {account_name: a, sas_token: 'sig=%zz'}", "invalid Azure sas_token"},
+		{"exporter: AzureBlobExporter\ndestination: c\nazure: {account_name: a, sas_token: '?sv=2021-08-06&sig=abc'}", ""},
+		{"exporter: SFTPExporter\nsftp: {address: host}", "SFTP host_keys of host:22 is required"},
+		{"exporter: SFTPExporter\nsftp: {address: host, host_keys: [ssh-ed25519 AAAA]}", "invalid SFTP host key"},
+		{"exporter: SFTPExporter\nsftp: {address: host, host_keys: ['SHA256:abc'], private_key_file: testdata/missing}", "cannot read SFTP private key"},
+		{"exporter: SFTPExporter\nsftp: {address: host, host_keys: ['SHA256:abc'], private_key_file: testdata/age-keys.txt}", "invalid SFTP private key"},
+		{"exporter: SFTPExporter\nsftp: {address: host, host_keys: ['SHA256:abc']}", ""},
+		// Keys of instances are decoded strictly
+		{"exporters: [{name: a, destinaton: /tmp}]", `exporter a: unknown key "destinaton"`},
+		{"exporters: [{name: a, gcs: {chunk_size: 1}}, {name: b, s3: {region: eu-west-1}}]", ""},
+		{"exporters: [{name: a, overwrite: [never]}]", "exporter a:"},
+		// Planning reads them once per run
+		{"exporters: [{name: a, instance_selectors: {default: {name_regex: web}}}]", "exporter a: instance_selectors applies to the whole run"},
+		{"exporters: [{name: a}, {name: b, groups: [web]}]", "exporter b: groups applies to the whole run"},
+		{"exporters: [{name: a, group_folders: true}]", "exporter a: group_folders"},
+		{"exporters: [{name: a, compute_endpoint: 'http://localhost:8080'}]", "exporter a: compute_endpoint"},
+		{"exporters: [{name: a, timezone: 9}]", "exporter a: timezone"},
+		{"groups: [web]\ninstance_selectors: {default: {name_regex: web}}\nexporters: [{name: a}]", ""},
+		// Each instance writes its own output format
+		{"exporters: [{name: a}, {name: b, output_format: long, long_columns: [zone]}]", ""},
+	}
+
+	for _, test := range tests {
+		err := ValidateConf(testConf(t, test.config))
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: got error %v, want %q", test.config, err, test.err)
+		}
+	}
+
+	if _, err := NewExporter(testConf(t, "file: {file_mod: 0600}")); err == nil {
+		t.Error("NewExporter decoded a block with an unknown key")
+	}
+}
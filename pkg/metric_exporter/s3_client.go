@@ -0,0 +1,447 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client sends requests signed with AWS Signature Version 4 to an S3
+// compatible endpoint.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
+
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	// sse are the server-side encryption headers of uploads, sseCustomer
+	// those of every request reading or writing object content.
+	sse         http.Header
+	sseCustomer http.Header
+
+	http *http.Client
+}
+
+const defaultS3Region = "us-east-1"
+
+func newS3Client(c S3Conf) *s3Client {
+	client, err := parseS3Client(c)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return client
+}
+
+// parseS3Client returns the client of c, failing on an invalid endpoint or
+// server-side encryption.
+func parseS3Client(c S3Conf) (*s3Client, error) {
+	client := &s3Client{region: c.Region, pathStyle: c.PathStyle, http: s3HTTPClient}
+	if client.region == "" {
+		client.region = defaultS3Region
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + client.region + ".amazonaws.com"
+	}
+	u, err := parseEndpoint("S3", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client.endpoint = u
+
+	client.accessKeyID = c.AccessKeyID
+	client.secretAccessKey = c.SecretAccessKey
+	client.sessionToken = c.SessionToken
+	if client.accessKeyID == "" {
+		client.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		client.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		client.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	client.sse = http.Header{}
+	switch c.ServerSideEncryption {
+	case "":
+	case "AES256":
+		client.sse.Set("X-Amz-Server-Side-Encryption", c.ServerSideEncryption)
+	case "aws:kms":
+		client.sse.Set("X-Amz-Server-Side-Encryption", c.ServerSideEncryption)
+		if c.KMSKeyID != "" {
+			client.sse.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.KMSKeyID)
+		}
+	default:
+		return nil, fmt.Errorf("unknown S3 server_side_encryption %q, want AES256 or aws:kms", c.ServerSideEncryption)
+	}
+	if c.KMSKeyID != "" && c.ServerSideEncryption != "aws:kms" {
+		return nil, errors.New("S3 kms_key_id needs server_side_encryption aws:kms")
+	}
+
+	client.sseCustomer = http.Header{}
+	if c.SSECustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.SSECustomerKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("S3 sse_customer_key is not a base64 AES-256 key")
+		}
+		sum := md5.Sum(key)
+		client.sseCustomer.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		client.sseCustomer.Set("X-Amz-Server-Side-Encryption-Customer-Key", c.SSECustomerKey)
+		client.sseCustomer.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+
+	return client, nil
+}
+
+// s3HTTPClient is shared by the exporters of a process, so connections are
+// reused across files. Objects are read as stored, gzip ones included, so
+// checksums match.
+var s3HTTPClient = &http.Client{Timeout: 5 * time.Minute, Transport: s3Transport()}
+
+func s3Transport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	return transport
+}
+
+// s3Request is one request on a bucket, or one of its objects when key is
+// set.
+type s3Request struct {
+	method string
+	key    string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// s3Error is the error document of a failed request.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// do sends r, retrying server errors, and returns the response of the last
+// attempt. Responses with an error status are returned as *s3Error.
+func (c *s3Client) do(bucket string, r s3Request) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		res, err = c.http.Do(c.newRequest(bucket, r, time.Now().UTC()))
+		if err != nil {
+			continue
+		}
+		if res.StatusCode < 300 || res.StatusCode == http.StatusNotModified {
+			return res, nil
+		}
+
+		err = readS3Error(res)
+		if res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+	}
+
+	return res, err
+}
+
+func readS3Error(res *http.Response) error {
+	defer res.Body.Close()
+
+	e := &s3Error{StatusCode: res.StatusCode}
+	content, _ := ioutil.ReadAll(res.Body)
+	if xml.Unmarshal(content, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(res.StatusCode)
+	}
+
+	return e
+}
+
+// isS3Status reports whether err is an S3 error of status.
+func isS3Status(err error, status int) bool {
+	e, ok := err.(*s3Error)
+	return ok && e.StatusCode == status
+}
+
+// newRequest returns r addressed to bucket and signed at now.
+func (c *s3Client) newRequest(bucket string, r s3Request, now time.Time) *http.Request {
+	u := *c.endpoint
+	path := "/" + r.key
+	if c.pathStyle {
+		path = "/" + bucket + path
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + path
+	u.RawPath = uriEscape(u.Path, false)
+	u.RawQuery = s3Query(r.query)
+
+	req, err := http.NewRequest(r.method, u.String(), bytes.NewReader(r.body))
+	if err != nil {
+		log.Fatalf("Invalid S3 request: %v", err)
+	}
+	for key, values := range r.header {
+		req.Header[key] = values
+	}
+
+	c.sign(req, r.body, now)
+
+	return req
+}
+
+// sign adds the Signature Version 4 authorization of req, whose content is
+// body.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	if c.accessKeyID == "" {
+		// Anonymous requests, e.g. to a public bucket or a fake server
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for i := range names {
+		canonicalHeaders.WriteString(names[i] + ":" + headers[names[i]] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretAccessKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEscape percent-encodes s as request signatures expect, keeping only
+// unreserved characters, and slashes unless escapeSlash.
+func uriEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' || ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' && !escapeSlash {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+
+	return b.String()
+}
+
+// s3Query returns the canonical query string of query, sorted by key.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for i := range keys {
+		values := query[keys[i]]
+		sort.Strings(values)
+		for j := range values {
+			params = append(params, uriEscape(keys[i], true)+"="+uriEscape(values[j], true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// s3Upload buffers what is written to it into parts of partSize: one PUT
+// when the content fits a part, a multipart upload otherwise. The upload
+// only completes, with header's preconditions, when it is closed.
+type s3Upload struct {
+	client   *s3Client
+	bucket   string
+	key      string
+	header   http.Header
+	partSize int
+
+	buf      bytes.Buffer
+	size     int64
+	uploadID string
+	parts    []s3CompletedPart
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	u.buf.Write(p)
+	u.size += int64(len(p))
+
+	for u.buf.Len() >= u.partSize*2 {
+		if err := u.uploadPart(u.buf.Next(u.partSize)); err != nil {
+			if u.uploadID != "" {
+				u.abort()
+			}
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (u *s3Upload) uploadPart(part []byte) error {
+	if u.uploadID == "" {
+		// Preconditions apply when the upload completes
+		header := http.Header{}
+		for key, values := range u.header {
+			if key != "If-None-Match" && key != "If-Match" {
+				header[key] = values
+			}
+		}
+
+		res, err := u.client.do(u.bucket, s3Request{method: http.MethodPost, key: u.key, query: url.Values{"uploads": {""}}, header: header})
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		u.uploadID = result.UploadID
+	}
+
+	partNumber := len(u.parts) + 1
+	query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {u.uploadID}}
+	res, err := u.client.do(u.bucket, s3Request{method: http.MethodPut, key: u.key, query: query, header: u.client.sseCustomer, body: part})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	u.parts = append(u.parts, s3CompletedPart{partNumber, res.Header.Get("ETag")})
+
+	return nil
+}
+
+// Close completes the upload, an *s3Error of status 412 when a
+// precondition failed.
+func (u *s3Upload) Close() error {
+	if u.uploadID == "" {
+		res, err := u.client.do(u.bucket, s3Request{method: http.MethodPut, key: u.key, header: u.header, body: u.buf.Bytes()})
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+
+	if err := u.uploadPart(u.buf.Next(u.buf.Len())); err != nil {
+		u.abort()
+		return err
+	}
+
+	content, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		u.abort()
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/xml"}}
+	for _, key := range []string{"If-None-Match", "If-Match"} {
+		if value := u.header.Get(key); value != "" {
+			header.Set(key, value)
+		}
+	}
+
+	res, err := u.client.do(u.bucket, s3Request{method: http.MethodPost, key: u.key, query: url.Values{"uploadId": {u.uploadID}}, header: header, body: content})
+	if err != nil {
+		u.abort()
+		return err
+	}
+	defer res.Body.Close()
+
+	// Failures after the response started come in the body of a 200
+	content, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		u.abort()
+		return err
+	}
+	if e := (&s3Error{StatusCode: http.StatusInternalServerError}); xml.Unmarshal(content, e) == nil && e.Code != "" {
+		u.abort()
+		return e
+	}
+
+	return nil
+}
+
+// abort drops the uploaded parts, storage keeps and bills them otherwise.
+func (u *s3Upload) abort() {
+	res, err := u.client.do(u.bucket, s3Request{method: http.MethodDelete, key: u.key, query: url.Values{"uploadId": {u.uploadID}}})
+	if err != nil {
+		log.Printf("Failed to abort upload of %s: %v", u.key, err)
+		return
+	}
+	res.Body.Close()
+}
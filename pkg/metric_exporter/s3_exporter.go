@@ -0,0 +1,413 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+type S3Exporter struct {
+	BucketName   string
+	Prefix       string
+	Paths        PathBuilder
+	LabelColumns []string
+	Overwrite    string
+	Compression  string
+	Encryption   Encryption
+
+	StorageClass string
+	Metadata     map[string]string
+	RunID        string
+	PartSize     int
+
+	client *s3Client
+}
+
+const defaultS3PartSize = 16 << 20
+
+// minS3PartSize is the smallest part S3 accepts but for the last one.
+const minS3PartSize = 5 << 20
+
+// S3Conf sets the S3 compatible object storage written by the S3Exporter,
+// the bucket is the destination.
+type S3Conf struct {
+	// Endpoint is the URL of the storage, AWS S3 of Region when unset.
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+
+	// PathStyle addresses buckets in the path rather than the host name,
+	// as MinIO and most S3 compatible servers expect.
+	PathStyle bool `yaml:"path_style"`
+
+	// Credentials default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+
+	// PartSize in bytes, files larger than one part are sent as multipart
+	// uploads, 16 MiB when unset and at least 5 MiB.
+	PartSize int `yaml:"part_size"`
+
+	// ServerSideEncryption is "AES256" or "aws:kms" with KMSKeyID.
+	// SSECustomerKey, a base64 AES-256 key, encrypts with a key of yours.
+	ServerSideEncryption string `yaml:"server_side_encryption"`
+	KMSKeyID             string `yaml:"kms_key_id"`
+	SSECustomerKey       string `yaml:"sse_customer_key"`
+
+	StorageClass string `yaml:"storage_class"`
+
+	// Metadata is added to the metadata describing every object.
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+func init() {
+	Register(ExporterType{
+		Name:   "S3Exporter",
+		Block:  "s3",
+		Config: S3Conf{},
+		Validate: func(c utils.Conf, config interface{}) error {
+			_, err := parseS3Client(config.(S3Conf))
+			return err
+		},
+		New: func(c utils.Conf, config interface{}) MetricExporter { return NewS3Exporter(c, config.(S3Conf)) },
+	})
+}
+
+func NewS3Exporter(c utils.Conf, s3 S3Conf) MetricExporter {
+	exporter := S3Exporter{}
+	exporter.BucketName = c.Destination
+	if c.Prefix != "" {
+		exporter.Prefix = strings.Trim(c.Prefix, "/") + "/"
+	}
+	exporter.Paths = NewPathBuilder(c)
+	exporter.Overwrite = overwritePolicy(c.Overwrite)
+	exporter.Compression = compressionPolicy(c.Compression)
+	exporter.Encryption = NewEncryption(c.Encryption)
+	exporter.StorageClass = s3.StorageClass
+	exporter.Metadata = s3.Metadata
+	exporter.RunID = c.RunID
+	exporter.LabelColumns = c.LabelColumns
+
+	exporter.PartSize = s3.PartSize
+	if exporter.PartSize == 0 {
+		exporter.PartSize = defaultS3PartSize
+	}
+	if exporter.PartSize < minS3PartSize {
+		exporter.PartSize = minS3PartSize
+	}
+
+	exporter.client = newS3Client(s3)
+
+	return exporter
+}
+
+func (s S3Exporter) saveTimeSeriesToCSV(filename string, series Series, metricPoints []string, metadata map[string]string) (string, string, int64, error) {
+	log.Printf("Points len: %d", len(metricPoints))
+
+	header, rows := csvContent(series, metricPoints, s.LabelColumns)
+
+	return s.saveToObject(filename, newCSVBody(header, StringRows(rows)), metadata)
+}
+
+// saveToObject uploads body under the overwrite policy, conditional writes
+// keep concurrent writers from clobbering each other. It returns the name of
+// the object holding body, its SHA-256 and size, an empty SHA-256 when an
+// existing object was kept.
+func (s S3Exporter) saveToObject(filename string, body csvBody, metadata map[string]string) (string, string, int64, error) {
+	points := body.points
+	ifNoneMatch := http.Header{"If-None-Match": {"*"}}
+
+	switch s.Overwrite {
+	case OverwriteNever:
+		sum, size, ok, err := s.upload(filename, body, points, metadata, ifNoneMatch)
+		if err == nil && !ok {
+			log.Printf("Keep existing object %s", filename)
+		}
+		return filename, sum, size, err
+	case OverwriteIfMoreComplete:
+		conditions := ifNoneMatch
+		header, ok, err := s.head(filename)
+		if err != nil {
+			return "", "", 0, err
+		}
+		if ok {
+			complete, err := s.objectCompleteness(filename, header)
+			if err != nil {
+				return "", "", 0, err
+			}
+			if complete >= points {
+				log.Printf("Keep existing object %s, it is as complete", filename)
+				return filename, "", 0, nil
+			}
+			conditions = http.Header{"If-Match": {header.Get("ETag")}}
+		}
+		sum, size, ok, err := s.upload(filename, body, points, metadata, conditions)
+		if err == nil && !ok {
+			log.Printf("Object %s changed during export, keep it", filename)
+		}
+		return filename, sum, size, err
+	case OverwriteVersioned:
+		name := filename
+		for version := 2; ; version++ {
+			sum, size, ok, err := s.upload(name, body, points, metadata, ifNoneMatch)
+			if err != nil || ok {
+				return name, sum, size, err
+			}
+			existing, err := s.ReadObject(name)
+			if err != nil && err != ErrObjectNotExist {
+				return "", "", 0, err
+			}
+			if err == nil && sameContent(existing, s.Compression, s.Encryption, body) {
+				log.Printf("Keep existing object %s, it holds the same content", name)
+				return name, "", 0, nil
+			}
+			name = versionedName(filename, version)
+		}
+	default:
+		sum, size, _, err := s.upload(filename, body, points, metadata, nil)
+		return filename, sum, size, err
+	}
+}
+
+// objectHeader returns the headers of an upload: content type, custom
+// metadata, server-side encryption and storage class.
+func (s S3Exporter) objectHeader(metadata map[string]string) http.Header {
+	header := http.Header{}
+	for key, value := range metadata {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+	for key, values := range s.client.sse {
+		header[key] = values
+	}
+	for key, values := range s.client.sseCustomer {
+		header[key] = values
+	}
+	if s.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", s.StorageClass)
+	}
+
+	return header
+}
+
+// upload streams body to key and returns the SHA-256 and size of the object,
+// or false when one of conditions failed.
+func (s S3Exporter) upload(key string, body csvBody, points int, metadata map[string]string, conditions http.Header) (string, int64, bool, error) {
+	header := s.objectHeader(metadata)
+	header.Set("X-Amz-Meta-"+completenessMetadataKey, strconv.Itoa(points))
+	contentType, contentEncoding := contentType(s.Compression, s.Encryption)
+	header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		header.Set("Content-Encoding", contentEncoding)
+	}
+	for key, values := range conditions {
+		header[key] = values
+	}
+
+	u := &s3Upload{client: s.client, bucket: s.BucketName, key: s.Prefix + key, header: header, partSize: s.PartSize}
+	h := sha256.New()
+	cw := newEncodeWriter(io.MultiWriter(u, h), s.Compression, s.Encryption)
+	err := body.writeTo(cw)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		if u.uploadID != "" {
+			u.abort()
+		}
+		return "", 0, false, fmt.Errorf("cannot upload object: %v", err)
+	}
+	if err := u.Close(); err != nil {
+		// Concurrent conditional writes of the same key conflict
+		if isS3Status(err, http.StatusPreconditionFailed) || isS3Status(err, http.StatusConflict) {
+			return "", 0, false, nil
+		}
+		return "", 0, false, fmt.Errorf("cannot upload object: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), u.size, true, nil
+}
+
+// head returns the headers of key, false when it does not exist.
+func (s S3Exporter) head(key string) (http.Header, bool, error) {
+	res, err := s.client.do(s.BucketName, s3Request{method: http.MethodHead, key: s.Prefix + key, header: s.client.sseCustomer})
+	if isS3Status(err, http.StatusNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot read object: %v", err)
+	}
+	res.Body.Close()
+
+	return res.Header, true, nil
+}
+
+// objectCompleteness reads the completeness recorded on an object, or counts
+// it for objects written before it was recorded.
+func (s S3Exporter) objectCompleteness(key string, header http.Header) (int, error) {
+	if points, err := strconv.Atoi(header.Get("X-Amz-Meta-" + completenessMetadataKey)); err == nil {
+		return points, nil
+	}
+
+	existing, err := s.ReadObject(key)
+	if err == ErrObjectNotExist {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	content, ok := decodeContent(existing, s.Compression, s.Encryption)
+	if !ok {
+		return 0, nil
+	}
+
+	return completeness(content), nil
+}
+
+// exportedFile describes the object name, reading it back when an existing
+// object was kept.
+func (s S3Exporter) exportedFile(name, sum string, size int64, rows int) (ExportedFile, error) {
+	if sum == "" {
+		existing, err := s.ReadObject(name)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		sum = SHA256(existing)
+		size = int64(len(existing))
+		rows = keptRows(existing, s.Compression, s.Encryption)
+	}
+
+	return ExportedFile{Name: name, Size: size, Rows: rows, SHA256: sum, KeyIDs: s.Encryption.KeyIDs}, nil
+}
+
+func (s S3Exporter) Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error) {
+	output := s.Paths.SeriesPath(dateTime, series)
+
+	metadata := exportMetadata(s.Metadata, s.Encryption, s.RunID, dateTime, series.ProjectID, series.Metric)
+	output, sum, size, err := s.saveTimeSeriesToCSV(output, series, metricPoints, metadata)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return s.exportedFile(output, sum, size, len(metricPoints))
+}
+
+func (s S3Exporter) ExportProject(dateTime time.Time, projectID string, columns []string, rows RowSource) (ExportedFile, error) {
+	output := s.Paths.ProjectPath(dateTime, projectID)
+
+	body := newCSVBody(stackdriver.PointCSVHeader+","+strings.Join(columns, ","), rows)
+	log.Printf("Rows len: %d", body.rows)
+	if body.err != nil {
+		return ExportedFile{}, body.err
+	}
+	metadata := exportMetadata(s.Metadata, s.Encryption, s.RunID, dateTime, projectID, "")
+	output, sum, size, err := s.saveToObject(output, body, metadata)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return s.exportedFile(output, sum, size, body.rows)
+}
+
+func (s S3Exporter) WriteObject(name string, content []byte) error {
+	return s.WriteObjectFrom(name, bytes.NewReader(content))
+}
+
+func (s S3Exporter) WriteObjectFrom(name string, r io.Reader) error {
+	metadata := make(map[string]string)
+	for key, value := range s.Metadata {
+		metadata[key] = value
+	}
+	if s.RunID != "" {
+		metadata[runIDMetadataKey] = s.RunID
+	}
+
+	u := &s3Upload{client: s.client, bucket: s.BucketName, key: s.Prefix + name, header: s.objectHeader(metadata), partSize: s.PartSize}
+	if _, err := io.Copy(u, r); err != nil {
+		if u.uploadID != "" {
+			u.abort()
+		}
+		return fmt.Errorf("cannot write object: %v", err)
+	}
+	if err := u.Close(); err != nil {
+		return fmt.Errorf("cannot write object: %v", err)
+	}
+
+	return nil
+}
+
+func (s S3Exporter) ReadObject(name string) ([]byte, error) {
+	res, err := s.client.do(s.BucketName, s3Request{method: http.MethodGet, key: s.Prefix + name, header: s.client.sseCustomer})
+	if isS3Status(err, http.StatusNotFound) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read object: %v", err)
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read object: %v", err)
+	}
+
+	return content, nil
+}
+
+func (s S3Exporter) DeleteObject(name string) error {
+	res, err := s.client.do(s.BucketName, s3Request{method: http.MethodDelete, key: s.Prefix + name})
+	if isS3Status(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot delete object: %v", err)
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+func (s S3Exporter) ListObjects(prefix string) (names []string, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+	for {
+		res, err := s.client.do(s.BucketName, s3Request{method: http.MethodGet, query: query})
+		if err != nil {
+			return nil, fmt.Errorf("cannot list objects: %v", err)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list objects: %v", err)
+		}
+
+		for i := range result.Contents {
+			names = append(names, strings.TrimPrefix(result.Contents[i].Key, s.Prefix))
+		}
+
+		if !result.IsTruncated {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
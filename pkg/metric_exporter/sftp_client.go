@@ -0,0 +1,173 @@
+package metric_exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// sftpServer is where an SFTPExporter connects, as whom. Exporters of the
+// same settings share their session by key.
+type sftpServer struct {
+	key     string
+	address string
+	config  *ssh.ClientConfig
+}
+
+func newSFTPServer(c SFTPConf) sftpServer {
+	server, err := parseSFTPServer(c)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return server
+}
+
+// parseSFTPServer returns the server of c, failing on missing or invalid
+// host keys or an unreadable private key.
+func parseSFTPServer(c SFTPConf) (sftpServer, error) {
+	address := c.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	if len(c.HostKeys) == 0 {
+		return sftpServer{}, fmt.Errorf("SFTP host_keys of %s is required", address)
+	}
+	hostKeys, err := pinnedHostKeys(c.HostKeys)
+	if err != nil {
+		return sftpServer{}, err
+	}
+	config := &ssh.ClientConfig{
+		User:            c.User,
+		HostKeyCallback: hostKeys,
+		Timeout:         sftpDialTimeout,
+	}
+
+	if c.PrivateKeyFile != "" {
+		key, err := ioutil.ReadFile(c.PrivateKeyFile)
+		if err != nil {
+			return sftpServer{}, fmt.Errorf("cannot read SFTP private key: %v", err)
+		}
+		passphrase := c.PrivateKeyPassphrase
+		if passphrase == "" {
+			passphrase = os.Getenv("SFTP_PRIVATE_KEY_PASSPHRASE")
+		}
+
+		var signer ssh.Signer
+		if passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return sftpServer{}, fmt.Errorf("invalid SFTP private key: %v", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	password := c.Password
+	if password == "" {
+		password = os.Getenv("SFTP_PASSWORD")
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+
+	key := strings.Join(append([]string{address, c.User, password, c.PrivateKeyFile, c.PrivateKeyPassphrase}, c.HostKeys...), "\x00")
+
+	return sftpServer{key, address, config}, nil
+}
+
+// pinnedHostKeys accepts the server only when it presents one of pins, keys
+// in authorized_keys format or SHA256 fingerprints.
+func pinnedHostKeys(pins []string) (ssh.HostKeyCallback, error) {
+	var keys [][]byte
+	var fingerprints []string
+	for i := range pins {
+		pin := strings.TrimSpace(pins[i])
+		if strings.HasPrefix(pin, "SHA256:") {
+			fingerprints = append(fingerprints, pin)
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pin))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SFTP host key %q: %v", pin, err)
+		}
+		keys = append(keys, key.Marshal())
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for i := range fingerprints {
+			if fingerprints[i] == fingerprint {
+				return nil
+			}
+		}
+		for i := range keys {
+			if bytes.Equal(keys[i], key.Marshal()) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("host key %s of %s is not pinned", fingerprint, hostname)
+	}, nil
+}
+
+// sftpConn is an SFTP session over its SSH connection.
+type sftpConn struct {
+	ssh *ssh.Client
+	*sftp.Client
+}
+
+func (c *sftpConn) Close() {
+	c.Client.Close()
+	c.ssh.Close()
+}
+
+var sftpConns = struct {
+	sync.Mutex
+	byKey map[string]*sftpConn
+}{byKey: make(map[string]*sftpConn)}
+
+// client returns the SFTP session of s, shared by the exporters of a process
+// and reused across files. It is dialed on first use, and again when the
+// server dropped the connection since.
+func (s sftpServer) client() (*sftp.Client, error) {
+	sftpConns.Lock()
+	defer sftpConns.Unlock()
+
+	if conn, ok := sftpConns.byKey[s.key]; ok {
+		if _, _, err := conn.ssh.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return conn.Client, nil
+		}
+		conn.Close()
+		delete(sftpConns.byKey, s.key)
+	}
+
+	sshClient, err := ssh.Dial("tcp", s.address, s.config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", s.address, err)
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("cannot start SFTP on %s: %v", s.address, err)
+	}
+
+	sftpConns.byKey[s.key] = &sftpConn{sshClient, client}
+
+	return client, nil
+}
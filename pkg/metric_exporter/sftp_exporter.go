@@ -0,0 +1,396 @@
+package metric_exporter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+type SFTPExporter struct {
+	Dir          string
+	Paths        PathBuilder
+	LabelColumns []string
+	Overwrite    string
+	Compression  string
+	Encryption   Encryption
+	FileMode     os.FileMode
+
+	server sftpServer
+}
+
+// SFTPConf sets the server written by the SFTPExporter, the destination is
+// the remote directory.
+type SFTPConf struct {
+	// Address is the host:port of the server, port 22 when omitted.
+	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+
+	// Password or PrivateKeyFile, with PrivateKeyPassphrase when the key is
+	// encrypted, authenticate User. The password and passphrase default to
+	// SFTP_PASSWORD and SFTP_PRIVATE_KEY_PASSPHRASE.
+	Password             string `yaml:"password"`
+	PrivateKeyFile       string `yaml:"private_key_file"`
+	PrivateKeyPassphrase string `yaml:"private_key_passphrase"`
+
+	// HostKeys pins the keys the server may present, as authorized_keys
+	// lines or SHA256 fingerprints printed by ssh-keygen -l. Required.
+	HostKeys []string `yaml:"host_keys"`
+
+	// FileMode is the permission of written files, 0644 when unset.
+	FileMode os.FileMode `yaml:"file_mode"`
+}
+
+func init() {
+	Register(ExporterType{
+		Name:   "SFTPExporter",
+		Block:  "sftp",
+		Config: SFTPConf{},
+		Validate: func(c utils.Conf, config interface{}) error {
+			_, err := parseSFTPServer(config.(SFTPConf))
+			return err
+		},
+		New: func(c utils.Conf, config interface{}) MetricExporter { return NewSFTPExporter(c, config.(SFTPConf)) },
+	})
+}
+
+func NewSFTPExporter(c utils.Conf, sftp SFTPConf) MetricExporter {
+	exporter := SFTPExporter{}
+	exporter.Dir = path.Join(c.Destination, c.Prefix)
+	exporter.Paths = NewPathBuilder(c)
+	exporter.Overwrite = overwritePolicy(c.Overwrite)
+	exporter.Compression = compressionPolicy(c.Compression)
+	exporter.Encryption = NewEncryption(c.Encryption)
+	exporter.LabelColumns = c.LabelColumns
+	exporter.FileMode = sftp.FileMode
+	if exporter.FileMode == 0 {
+		exporter.FileMode = 0644
+	}
+	exporter.server = newSFTPServer(sftp)
+
+	return exporter
+}
+
+// remotePath returns the path on the server of name, relative to Dir.
+func (s SFTPExporter) remotePath(name string) string {
+	return path.Join(s.Dir, name)
+}
+
+func (s SFTPExporter) saveTimeSeriesToCSV(filename string, series Series, metricPoints []string) (string, string, int64, error) {
+	log.Printf("Points len: %d", len(metricPoints))
+
+	header, rows := csvContent(series, metricPoints, s.LabelColumns)
+
+	return s.saveToFile(filename, newCSVBody(header, StringRows(rows)))
+}
+
+// saveToFile uploads body under the overwrite policy and returns the name of
+// the file holding it, its SHA-256 and size, an empty SHA-256 when an
+// existing file was kept. Files are uploaded under a temporary name then
+// renamed, so the partner never reads a truncated file.
+func (s SFTPExporter) saveToFile(filename string, body csvBody) (string, string, int64, error) {
+	client, err := s.server.client()
+	if err != nil {
+		return "", "", 0, err
+	}
+	remote := s.remotePath(filename)
+	if err := client.MkdirAll(path.Dir(remote)); err != nil {
+		return "", "", 0, fmt.Errorf("cannot create remote folder: %v", err)
+	}
+
+	switch s.Overwrite {
+	case OverwriteNever:
+		if _, err := client.Stat(remote); err == nil {
+			log.Printf("Keep existing file %s", filename)
+			return filename, "", 0, nil
+		}
+	case OverwriteIfMoreComplete:
+		existing, err := s.ReadObject(filename)
+		if err != nil && err != ErrObjectNotExist {
+			return "", "", 0, err
+		}
+		if err == nil {
+			if content, ok := decodeContent(existing, s.Compression, s.Encryption); ok && completeness(content) >= body.points {
+				log.Printf("Keep existing file %s, it is as complete", filename)
+				return filename, "", 0, nil
+			}
+		}
+	}
+
+	tmp, sum, size, err := s.upload(client, remote, body)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer client.Remove(tmp)
+
+	switch s.Overwrite {
+	case OverwriteNever:
+		// Rename fails on an existing file, written meanwhile by another task
+		if err := client.Rename(tmp, remote); err != nil {
+			log.Printf("Keep existing file %s", filename)
+			return filename, "", 0, nil
+		}
+	case OverwriteVersioned:
+		name := filename
+		for version := 2; ; version++ {
+			target := s.remotePath(name)
+			if _, err := client.Stat(target); os.IsNotExist(err) {
+				err = client.Rename(tmp, target)
+				if err == nil {
+					return name, sum, size, nil
+				}
+				if _, statErr := client.Stat(target); os.IsNotExist(statErr) {
+					return "", "", 0, fmt.Errorf("cannot rename file: %v", err)
+				}
+			}
+			existing, err := s.ReadObject(name)
+			if err != nil && err != ErrObjectNotExist {
+				return "", "", 0, err
+			}
+			if err == nil && sameContent(existing, s.Compression, s.Encryption, body) {
+				log.Printf("Keep existing file %s, it holds the same content", name)
+				return name, "", 0, nil
+			}
+			name = versionedName(filename, version)
+		}
+	default:
+		if err := replaceFile(client, tmp, remote); err != nil {
+			return "", "", 0, fmt.Errorf("cannot rename file: %v", err)
+		}
+	}
+
+	return filename, sum, size, nil
+}
+
+// replaceFile renames tmp to remote, replacing an existing file at once with
+// the posix-rename extension. Servers refusing it get remote removed then
+// tmp renamed, readers may miss the file in between.
+func replaceFile(client *sftp.Client, tmp, remote string) error {
+	err := client.PosixRename(tmp, remote)
+	if _, ok := err.(*sftp.StatusError); !ok {
+		return err
+	}
+
+	if err := client.Remove(remote); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(tmp, remote)
+}
+
+// tempPath returns a hidden temporary path next to remote, unique to the
+// writer.
+func tempPath(remote string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+
+	return path.Join(path.Dir(remote), "."+path.Base(remote)+".tmp-"+hex.EncodeToString(suffix))
+}
+
+// upload streams body, compressed and encrypted, to a temporary file next to
+// remote. It returns the temporary path, the SHA-256 and size of the file.
+func (s SFTPExporter) upload(client *sftp.Client, remote string, body csvBody) (string, string, int64, error) {
+	tmp := tempPath(remote)
+	file, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("cannot create file: %v", err)
+	}
+
+	// Large writes are sent as concurrent packets
+	bw := bufio.NewWriterSize(file, 1<<20)
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(bw, h)}
+	w := newEncodeWriter(counter, s.Compression, s.Encryption)
+	err = body.writeTo(w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = client.Chmod(tmp, s.FileMode)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return "", "", 0, fmt.Errorf("cannot write file: %v", err)
+	}
+
+	return tmp, hex.EncodeToString(h.Sum(nil)), counter.n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportedFile describes the file name, reading it back when an existing
+// file was kept.
+func (s SFTPExporter) exportedFile(name, sum string, size int64, rows int) (ExportedFile, error) {
+	if sum == "" {
+		existing, err := s.ReadObject(name)
+		if err != nil {
+			return ExportedFile{}, err
+		}
+		sum = SHA256(existing)
+		size = int64(len(existing))
+		rows = keptRows(existing, s.Compression, s.Encryption)
+	}
+
+	return ExportedFile{Name: name, Size: size, Rows: rows, SHA256: sum, KeyIDs: s.Encryption.KeyIDs}, nil
+}
+
+func (s SFTPExporter) Export(dateTime time.Time, series Series, metricPoints []string) (ExportedFile, error) {
+	output := s.Paths.SeriesPath(dateTime, series)
+
+	output, sum, size, err := s.saveTimeSeriesToCSV(output, series, metricPoints)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return s.exportedFile(output, sum, size, len(metricPoints))
+}
+
+func (s SFTPExporter) ExportProject(dateTime time.Time, projectID string, columns []string, rows RowSource) (ExportedFile, error) {
+	output := s.Paths.ProjectPath(dateTime, projectID)
+
+	body := newCSVBody(stackdriver.PointCSVHeader+","+strings.Join(columns, ","), rows)
+	log.Printf("Rows len: %d", body.rows)
+	if body.err != nil {
+		return ExportedFile{}, body.err
+	}
+	output, sum, size, err := s.saveToFile(output, body)
+	if err != nil {
+		return ExportedFile{}, err
+	}
+
+	return s.exportedFile(output, sum, size, body.rows)
+}
+
+func (s SFTPExporter) WriteObject(name string, content []byte) error {
+	return s.WriteObjectFrom(name, bytes.NewReader(content))
+}
+
+func (s SFTPExporter) WriteObjectFrom(name string, r io.Reader) error {
+	client, err := s.server.client()
+	if err != nil {
+		return err
+	}
+	remote := s.remotePath(name)
+	if err := client.MkdirAll(path.Dir(remote)); err != nil {
+		return fmt.Errorf("cannot create remote folder: %v", err)
+	}
+
+	tmp := tempPath(remote)
+	file, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = client.Chmod(tmp, s.FileMode)
+	}
+	if err == nil {
+		err = replaceFile(client, tmp, remote)
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return fmt.Errorf("cannot write file: %v", err)
+	}
+
+	return nil
+}
+
+func (s SFTPExporter) ReadObject(name string) ([]byte, error) {
+	client, err := s.server.client()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(s.remotePath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %v", err)
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %v", err)
+	}
+
+	return content, nil
+}
+
+func (s SFTPExporter) DeleteObject(name string) error {
+	client, err := s.server.client()
+	if err != nil {
+		return err
+	}
+	remote := s.remotePath(name)
+	if err := client.Remove(remote); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete file: %v", err)
+	}
+
+	// Drop folders left empty, up to the destination
+	for dir := path.Dir(remote); dir != path.Clean(s.Dir) && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if client.RemoveDirectory(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s SFTPExporter) ListObjects(prefix string) (names []string, err error) {
+	client, err := s.server.client()
+	if err != nil {
+		return nil, err
+	}
+
+	walker := client.Walk(s.remotePath(prefix))
+	for walker.Step() {
+		// A missing prefix lists nothing, files removed meanwhile are skipped
+		if err := walker.Err(); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot list files: %v", err)
+		}
+		if walker.Stat().IsDir() {
+			continue
+		}
+
+		names = append(names, strings.TrimPrefix(walker.Path(), path.Clean(s.Dir)+"/"))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
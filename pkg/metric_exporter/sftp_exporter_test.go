@@ -0,0 +1,301 @@
+package metric_exporter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// testSFTPServer serves the local filesystem over SFTP on a random port to
+// the user test with the password secret, answering the requests matching
+// refuse as unsupported. It returns the settings of an exporter pinning its
+// key.
+func testSFTPServer(t *testing.T, refuse func(packet []byte) bool) SFTPConf {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() != "test" || string(password) != "secret" {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config, refuse)
+		}
+	}()
+
+	return SFTPConf{
+		Address:  listener.Addr().String(),
+		User:     "test",
+		Password: "secret",
+		HostKeys: []string{string(ssh.MarshalAuthorizedKey(signer.PublicKey()))},
+	}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig, refuse func(packet []byte) bool) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the subsystem name as an SSH string
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+
+		var rwc io.ReadWriteCloser = channel
+		if refuse != nil {
+			rwc = refuseRequests(channel, refuse)
+		}
+		server, err := sftp.NewServer(rwc)
+		if err != nil {
+			return
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// refusePosixRename matches the requests of the posix-rename extension, for
+// a server without it.
+func refusePosixRename(packet []byte) bool {
+	// SSH_FXP_EXTENDED: type, ID, then the extension name
+	const name = "posix-rename@openssh.com"
+	return len(packet) > 9+len(name) && packet[0] == 200 && string(packet[9:9+len(name)]) == name
+}
+
+// refuseOpendir matches SSH_FXP_OPENDIR requests, for a server failing to
+// read folders.
+func refuseOpendir(packet []byte) bool {
+	return packet[0] == 11
+}
+
+// refuseRequests answers the packets read from channel matching refuse with
+// an unsupported status, and passes the others on.
+func refuseRequests(channel ssh.Channel, refuse func(packet []byte) bool) io.ReadWriteCloser {
+	r, w := io.Pipe()
+	conn := &sftpFilter{Reader: r, channel: channel}
+
+	go func() {
+		for {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(channel, header); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			packet := make([]byte, binary.BigEndian.Uint32(header))
+			if _, err := io.ReadFull(channel, packet); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+
+			if len(packet) > 5 && refuse(packet) {
+				// SSH_FXP_STATUS of the ID, SSH_FX_OP_UNSUPPORTED with
+				// empty message and language
+				status := []byte{0, 0, 0, 17, 101, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0}
+				copy(status[5:9], packet[1:5])
+				conn.Write(status)
+				continue
+			}
+			w.Write(append(header, packet...))
+		}
+	}()
+
+	return conn
+}
+
+// sftpFilter reads the packets passed on, and writes to the channel.
+type sftpFilter struct {
+	io.Reader
+
+	mu      sync.Mutex
+	channel ssh.Channel
+}
+
+func (f *sftpFilter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.channel.Write(p)
+}
+
+func (f *sftpFilter) Close() error {
+	return f.channel.Close()
+}
+
+// testSFTPExporter returns an exporter of a new directory on the server of
+// conf.
+func testSFTPExporter(t *testing.T, c utils.Conf, conf SFTPConf) SFTPExporter {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c.Destination = dir
+
+	return NewSFTPExporter(c, conf).(SFTPExporter)
+}
+
+func TestSFTPSaveToFile(t *testing.T) {
+	partial := testBody("60,00:01,1.0", "120,00:02,")
+	complete := testBody("60,00:01,1.0", "120,00:02,2.0")
+
+	tests := []struct {
+		policy  string
+		first   csvBody
+		second  csvBody
+		name    string
+		kept    bool
+		content csvBody
+	}{
+		{OverwriteAlways, complete, partial, "p/a.csv", false, partial},
+		{OverwriteNever, partial, complete, "p/a.csv", true, partial},
+		{OverwriteIfMoreComplete, partial, complete, "p/a.csv", false, complete},
+		{OverwriteIfMoreComplete, complete, partial, "p/a.csv", true, complete},
+		{OverwriteVersioned, partial, complete, "p/a.v2.csv", false, complete},
+		{OverwriteVersioned, complete, complete, "p/a.csv", true, complete},
+	}
+
+	for _, refuse := range []func(packet []byte) bool{nil, refusePosixRename} {
+		posixRename := refuse == nil
+		conf := testSFTPServer(t, refuse)
+		for _, test := range tests {
+			s := testSFTPExporter(t, utils.Conf{Overwrite: test.policy}, conf)
+
+			if _, _, _, err := s.saveToFile("p/a.csv", test.first); err != nil {
+				t.Fatal(err)
+			}
+			name, sum, _, err := s.saveToFile("p/a.csv", test.second)
+			if err != nil {
+				t.Fatalf("%s, posix-rename %v: %v", test.policy, posixRename, err)
+			}
+
+			if name != test.name || (sum == "") != test.kept {
+				t.Errorf("%s, posix-rename %v: got %s, kept %v, want %s, kept %v", test.policy, posixRename, name, sum == "", test.name, test.kept)
+			}
+			if content, _ := s.ReadObject(name); string(content) != readBody(t, test.content) {
+				t.Errorf("%s, posix-rename %v: %s holds %q", test.policy, posixRename, name, content)
+			}
+
+			// No temporary file left behind
+			names, err := s.ListObjects("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range names {
+				if strings.HasPrefix(names[i], "p/.") {
+					t.Errorf("%s, posix-rename %v: left %s", test.policy, posixRename, names[i])
+				}
+			}
+		}
+	}
+}
+
+func TestSFTPObjects(t *testing.T) {
+	for _, refuse := range []func(packet []byte) bool{nil, refusePosixRename} {
+		posixRename := refuse == nil
+		conf := testSFTPServer(t, refuse)
+		s := testSFTPExporter(t, utils.Conf{Prefix: "exports"}, conf)
+
+		want := []string{"_reports/a.json", "_reports/b.json", "p/c.csv"}
+		for _, name := range want {
+			if err := s.WriteObject(name, []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.WriteObject("p/c.csv", []byte("replaced")); err != nil {
+			t.Errorf("posix-rename %v: replace: %v", posixRename, err)
+		}
+		if content, err := s.ReadObject("p/c.csv"); err != nil || string(content) != "replaced" {
+			t.Errorf("posix-rename %v: read %q, %v", posixRename, content, err)
+		}
+
+		if names, err := s.ListObjects(""); err != nil || !reflect.DeepEqual(names, want) {
+			t.Errorf("posix-rename %v: listed %v, %v", posixRename, names, err)
+		}
+		if names, err := s.ListObjects("_reports/"); err != nil || len(names) != 2 {
+			t.Errorf("posix-rename %v: listed %v under _reports/, %v", posixRename, names, err)
+		}
+		if names, err := s.ListObjects("missing/"); err != nil || len(names) != 0 {
+			t.Errorf("posix-rename %v: listed %v under missing/, %v", posixRename, names, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := s.DeleteObject("p/c.csv"); err != nil {
+				t.Errorf("delete: %v", err)
+			}
+		}
+		if _, err := s.ReadObject("p/c.csv"); err != ErrObjectNotExist {
+			t.Errorf("read a deleted object: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(s.Dir, "p")); !os.IsNotExist(err) {
+			t.Errorf("folder left after delete: %v", err)
+		}
+	}
+}
+
+func TestSFTPListError(t *testing.T) {
+	s := testSFTPExporter(t, utils.Conf{}, testSFTPServer(t, refuseOpendir))
+	if err := s.WriteObject("p/a.csv", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A folder failing to be read fails the listing rather than hiding its
+	// files
+	if names, err := s.ListObjects(""); err == nil {
+		t.Errorf("listed %v, want an error", names)
+	}
+}
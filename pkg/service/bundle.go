@@ -0,0 +1,203 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// errBundleFileMissing stops a bundle whose file was already bundled and
+// removed by another task.
+var errBundleFileMissing = errors.New("bundled file missing")
+
+// projectFileCount is the number of files recorded for a project once every
+// step of the day is done: series files, wide files, the consolidated file
+// and the inventory, unless it was skipped.
+func (es ExportService) projectFileCount(store metric_exporter.ObjectStore, date, projectID string, planned []metric_exporter.Series) (int, error) {
+	count := len(planned)
+
+	if es.conf.WideFormat {
+		instances := make(map[string]bool)
+		for i := range planned {
+			instances[planned[i].InstanceID+"|"+planned[i].InstanceName+"|"+planned[i].Group] = true
+		}
+		count += len(instances)
+	}
+	if es.conf.Consolidated {
+		count++
+	}
+	if es.conf.Inventory || len(es.conf.LabelColumns) > 0 {
+		written, err := es.inventoryWritten(store, date, projectID)
+		if err != nil {
+			return 0, err
+		}
+		if written {
+			count += 2
+		}
+	}
+
+	return count, nil
+}
+
+// writeBundle packs the files of manifest into one archive, the manifest
+// first. The archive is streamed to the store as the files are read, one at
+// a time. Tasks finishing together may both write it, the content is the
+// same.
+func (es ExportService) writeBundle(store metric_exporter.ObjectStore, manifest Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatal("writeBundle: ", err.Error())
+	}
+
+	r, w := io.Pipe()
+	packed := make(chan error, 1)
+	go func() {
+		err := es.packBundle(w, store, content, manifest.Files)
+		w.CloseWithError(err)
+		packed <- err
+	}()
+
+	name := metric_exporter.NewPathBuilder(es.conf).BundlePath(es.dateTime(), manifest.ProjectID, es.conf.Bundle.Format)
+	err = store.WriteObjectFrom(name, r)
+	// Unblocks packing when the store stopped reading
+	r.Close()
+	if <-packed == errBundleFileMissing {
+		log.Printf("Missing file, skip bundle of project ID: %s", manifest.ProjectID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	files := manifest.Files
+	log.Printf("Bundle %d files of project ID: %s into %s", len(files), manifest.ProjectID, name)
+
+	if es.conf.Bundle.RemoveFiles {
+		errs := make([]error, len(files))
+		es.forEach(len(files), func(i int) {
+			errs[i] = store.DeleteObject(files[i].Name)
+		})
+		for i := range errs {
+			if errs[i] != nil {
+				return errs[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// packBundle writes the archive of the manifest content and files to w in
+// the bundle format of es.
+func (es ExportService) packBundle(w io.Writer, store metric_exporter.ObjectStore, manifest []byte, files []metric_exporter.ExportedFile) error {
+	var add func(name string, content []byte) error
+	var close func() error
+
+	switch es.conf.Bundle.Format {
+	case utils.BundleTarGz:
+		zw := gzip.NewWriter(w)
+		tw := tar.NewWriter(zw)
+		add = func(name string, content []byte) error {
+			header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := tw.Write(content)
+			return err
+		}
+		close = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return zw.Close()
+		}
+	case utils.BundleZip:
+		zw := zip.NewWriter(w)
+		add = func(name string, content []byte) error {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(content)
+			return err
+		}
+		close = zw.Close
+	default:
+		return fmt.Errorf("unknown bundle format: %s", es.conf.Bundle.Format)
+	}
+
+	if err := add(manifestName, manifest); err != nil {
+		return fmt.Errorf("cannot bundle %s: %v", manifestName, err)
+	}
+	for i := range files {
+		content, err := store.ReadObject(files[i].Name)
+		if err == metric_exporter.ErrObjectNotExist {
+			return errBundleFileMissing
+		}
+		if err != nil {
+			return err
+		}
+		if err := add(files[i].Name, content); err != nil {
+			return fmt.Errorf("cannot bundle %s: %v", files[i].Name, err)
+		}
+	}
+	if err := close(); err != nil {
+		return fmt.Errorf("cannot bundle: %v", err)
+	}
+
+	return nil
+}
+
+// readBundle returns the files packed in a bundle by name.
+func readBundle(content []byte, format string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	switch format {
+	case utils.BundleTarGz:
+		zr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(zr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if files[header.Name], err = ioutil.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+	case utils.BundleZip:
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, err
+		}
+		for i := range zr.File {
+			r, err := zr.File[i].Open()
+			if err != nil {
+				return nil, err
+			}
+			files[zr.File[i].Name], err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
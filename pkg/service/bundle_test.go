@@ -0,0 +1,102 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestWriteBundle(t *testing.T) {
+	for _, format := range []string{utils.BundleTarGz, utils.BundleZip} {
+		es := newTestService(t, utils.Conf{Bundle: utils.BundleConf{Format: format, RemoveFiles: true}})
+		store := testStore(t, es)
+
+		contents := map[string][]byte{
+			"p/2018/10/18/web_1/2018-10-18[web_1][cpu_usage_time].csv": []byte("timestamp,datetime,value\n60,00:01,1.0"),
+			"p/2018/10/18/instances.csv":                               []byte("zone,instance_id"),
+		}
+		manifest := Manifest{SchemaVersion: metric_exporter.SchemaVersion, ProjectID: "p", Date: "2018-10-18"}
+		for name, content := range contents {
+			store.WriteObject(name, content)
+			manifest.Files = append(manifest.Files, metric_exporter.ExportedFile{Name: name, Size: int64(len(content)), SHA256: metric_exporter.SHA256(content)})
+		}
+
+		if err := es.writeBundle(store, manifest); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		content, err := store.ReadObject("p/2018/10/18/2018-10-18[p]." + format)
+		if err != nil {
+			t.Fatalf("%s: no bundle: %v", format, err)
+		}
+		files, err := readBundle(content, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		var embedded Manifest
+		if err := json.Unmarshal(files[manifestName], &embedded); err != nil || !reflect.DeepEqual(embedded, manifest) {
+			t.Errorf("%s: embedded manifest %s, %v", format, files[manifestName], err)
+		}
+		for name, want := range contents {
+			if string(files[name]) != string(want) {
+				t.Errorf("%s: bundled %s holds %q", format, name, files[name])
+			}
+			if _, err := store.ReadObject(name); err != metric_exporter.ErrObjectNotExist {
+				t.Errorf("%s: %s not removed", format, name)
+			}
+		}
+	}
+}
+
+func TestWriteBundleMissingFile(t *testing.T) {
+	es := newTestService(t, utils.Conf{Bundle: utils.BundleConf{Format: utils.BundleZip}})
+	store := testStore(t, es)
+
+	// Bundled and removed by another task meanwhile
+	manifest := Manifest{ProjectID: "p", Files: []metric_exporter.ExportedFile{{Name: "p/2018/10/18/gone.csv"}}}
+	if err := es.writeBundle(store, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.ReadObject("p/2018/10/18/2018-10-18[p].zip"); err != metric_exporter.ErrObjectNotExist {
+		t.Error("bundle written without its files")
+	}
+}
+
+func TestProjectFileCount(t *testing.T) {
+	cpu := "compute.googleapis.com/instance/cpu/usage_time"
+	planned := []metric_exporter.Series{
+		testSeries("p", cpu, "web", "1"),
+		testSeries("p", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sda"),
+		testSeries("p", cpu, "db", "2"),
+	}
+
+	tests := []struct {
+		conf    utils.Conf
+		skipped bool
+		count   int
+	}{
+		{utils.Conf{}, false, 3},
+		{utils.Conf{WideFormat: true}, false, 5},
+		{utils.Conf{Consolidated: true, Inventory: true}, false, 6},
+		{utils.Conf{Consolidated: true, Inventory: true}, true, 4},
+		{utils.Conf{LabelColumns: []string{"env"}}, false, 5},
+		{utils.Conf{LabelColumns: []string{"env"}}, true, 3},
+	}
+
+	for _, test := range tests {
+		es := newTestService(t, test.conf)
+		store := testStore(t, es)
+		if test.skipped {
+			es.writeInventoryRecord("p", false)
+		}
+
+		if got, err := es.projectFileCount(store, "2018-10-18", "p", planned); got != test.count || err != nil {
+			t.Errorf("%+v, skipped %v: got %d files, %v, want %d", test.conf, test.skipped, got, err, test.count)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"log"
+	"strings"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// Columns identifying the series of every row of the consolidated file
+var consolidatedColumns = []string{"project_id", "zone", "instance_id", "instance_name", "series", "group"}
+
+const consolidatedFileKey = "consolidated"
+
+// exportProjectIfComplete writes the consolidated file of projectID once
+// every planned series of the project has a record, and reports whether it
+// is written.
+func (es ExportService) exportProjectIfComplete(projectID string) (bool, error) {
+	store, ok := es.objectStore()
+	if !ok {
+		return true, nil
+	}
+
+	exporter, ok := es.newMetricExporter().(metric_exporter.ProjectExporter)
+	if !ok {
+		log.Printf("Exporter %s cannot write consolidated files", es.conf.ExporterClass)
+		return true, nil
+	}
+
+	date := reportDate(es.dateTime())
+	_, err := store.ReadObject(fileRecordObjectName(date, projectID, consolidatedFileKey))
+	if err == nil {
+		// Written by an earlier attempt of the task
+		return true, nil
+	}
+	if err != metric_exporter.ErrObjectNotExist {
+		return false, err
+	}
+
+	planned, complete, err := es.projectComplete(store, date, projectID)
+	if err != nil || !complete {
+		return false, err
+	}
+
+	columns, seriesColumns := es.consolidatedHeader()
+
+	// Records are read one at a time as the file is written
+	rows := func(emit func(row string)) error {
+		for i := range planned {
+			record, ok, err := es.readSeriesRecord(store, date, planned[i])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				log.Printf("Consolidate: no record of %s", seriesKey(planned[i]))
+				continue
+			}
+
+			values := make([]string, len(seriesColumns))
+			for j := range seriesColumns {
+				values[j] = consolidatedValue(record, seriesColumns[j])
+			}
+			for j := range es.conf.LabelColumns {
+				values = append(values, record.Labels[es.conf.LabelColumns[j]])
+			}
+			suffix := "," + strings.Join(values, ",")
+
+			for j := range record.Rows {
+				emit(record.Rows[j] + suffix)
+			}
+		}
+		return nil
+	}
+
+	log.Printf("Consolidate %d series of project ID: %s", len(planned), projectID)
+	file, err := exporter.ExportProject(es.dateTime(), projectID, columns, rows)
+	if err != nil {
+		return false, err
+	}
+
+	return true, es.writeFileRecord(projectID, consolidatedFileKey, file)
+}
+
+// consolidatedHeader returns the columns of the consolidated file after the
+// point columns, and the series columns filled from the records. Long rows
+// already carry the metric type and the long_columns, which are not
+// repeated.
+func (es ExportService) consolidatedHeader() (columns, seriesColumns []string) {
+	if es.conf.OutputFormat == utils.OutputFormatLong {
+		columns = append([]string{"metric"}, es.conf.LongColumns...)
+	} else {
+		seriesColumns = []string{"metric"}
+	}
+
+	for i := range consolidatedColumns {
+		if !containsString(columns, consolidatedColumns[i]) {
+			seriesColumns = append(seriesColumns, consolidatedColumns[i])
+		}
+	}
+	columns = append(columns, seriesColumns...)
+
+	for i := range es.conf.LabelColumns {
+		columns = append(columns, "label_"+es.conf.LabelColumns[i])
+	}
+
+	return
+}
+
+func consolidatedValue(record seriesRecord, column string) string {
+	switch column {
+	case "metric":
+		return record.Metric
+	case "project_id":
+		return record.ProjectID
+	case "zone":
+		return record.Zone
+	case "instance_id":
+		return record.InstanceID
+	case "instance_name":
+		return record.InstanceName
+	case "series":
+		return strings.Join(record.AttendNames, "-")
+	case "group":
+		return record.Group
+	}
+
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for i := range values {
+		if values[i] == value {
+			return true
+		}
+	}
+
+	return false
+}
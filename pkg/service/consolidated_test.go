@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestConsolidatedHeader(t *testing.T) {
+	tests := []struct {
+		conf          utils.Conf
+		columns       []string
+		seriesColumns []string
+	}{
+		{
+			utils.Conf{},
+			[]string{"metric", "project_id", "zone", "instance_id", "instance_name", "series", "group"},
+			[]string{"metric", "project_id", "zone", "instance_id", "instance_name", "series", "group"},
+		},
+		{
+			utils.Conf{LabelColumns: []string{"env"}},
+			[]string{"metric", "project_id", "zone", "instance_id", "instance_name", "series", "group", "label_env"},
+			[]string{"metric", "project_id", "zone", "instance_id", "instance_name", "series", "group"},
+		},
+		{
+			// zone and instance_id come with the long rows
+			utils.Conf{OutputFormat: utils.OutputFormatLong, LongColumns: []string{"zone", "instance_id", "state"}},
+			[]string{"metric", "zone", "instance_id", "state", "project_id", "instance_name", "series", "group"},
+			[]string{"project_id", "instance_name", "series", "group"},
+		},
+	}
+
+	for _, test := range tests {
+		es := ExportService{conf: test.conf}
+		columns, seriesColumns := es.consolidatedHeader()
+		if !reflect.DeepEqual(columns, test.columns) || !reflect.DeepEqual(seriesColumns, test.seriesColumns) {
+			t.Errorf("%+v: got columns %v and %v, want %v and %v", test.conf, columns, seriesColumns, test.columns, test.seriesColumns)
+		}
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	es := newTestService(t, utils.Conf{Consolidated: true})
+	store := testStore(t, es)
+
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	sda := testSeries("p", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sda")
+	es.writePlan("p", []metric_exporter.Series{cpu, sda})
+
+	es.writeSeriesRecord(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+	if complete, err := es.Finalize("p", nil); complete || err != nil {
+		t.Fatalf("finalized a project with a series still running: %v", err)
+	}
+
+	es.writeSeriesRecord(sda, []string{"60,00:01,2.0"}, []string{"60,00:01,2.0", "120,00:02,3.0"})
+	if complete, err := es.Finalize("p", nil); !complete || err != nil {
+		t.Fatalf("complete project not finalized: %v", err)
+	}
+
+	files, _ := es.readFileRecords(store, "2018-10-18", "p")
+	if len(files) != 1 || files[0].Rows != 3 {
+		t.Fatalf("got file records %+v, want the consolidated file of 3 rows", files)
+	}
+	content, _ := store.ReadObject(files[0].Name)
+	want := "timestamp,datetime,value,metric,project_id,zone,instance_id,instance_name,series,group\n" +
+		"60,00:01,1.0,compute.googleapis.com/instance/cpu/usage_time,p,asia-east1-a,1,web,,\n" +
+		"60,00:01,2.0,compute.googleapis.com/instance/disk/write_ops_count,p,asia-east1-a,1,web,disk-sda,\n" +
+		"120,00:02,3.0,compute.googleapis.com/instance/disk/write_ops_count,p,asia-east1-a,1,web,disk-sda,"
+	if !strings.HasSuffix(string(content), want) {
+		t.Errorf("consolidated file holds\n%s\nwant\n%s", content, want)
+	}
+
+	// A retry finds the file written
+	store.DeleteObject(files[0].Name)
+	if complete, err := es.Finalize("p", nil); !complete || err != nil {
+		t.Errorf("retry not finalized: %v", err)
+	}
+	if _, err := store.ReadObject(files[0].Name); err != metric_exporter.ErrObjectNotExist {
+		t.Error("retry wrote the consolidated file again")
+	}
+}
+
+// testLoader stages series and loads each project once all its planned
+// series are staged, as BigQueryExporter does.
+type testLoader struct{}
+
+var testLoads = struct {
+	sync.Mutex
+	planned map[string]int
+	staged  map[string]int
+	loaded  map[string]int
+}{planned: make(map[string]int), staged: make(map[string]int), loaded: make(map[string]int)}
+
+func init() {
+	metric_exporter.Register(metric_exporter.ExporterType{
+		Name: "TestLoader",
+		New:  func(c utils.Conf, config interface{}) metric_exporter.MetricExporter { return testLoader{} },
+	})
+}
+
+func (testLoader) Export(dateTime time.Time, series metric_exporter.Series, metricPoints []string) (metric_exporter.ExportedFile, error) {
+	testLoads.Lock()
+	defer testLoads.Unlock()
+
+	testLoads.staged[series.ProjectID]++
+	return metric_exporter.ExportedFile{Name: series.Metric, Rows: len(metricPoints)}, nil
+}
+
+func (testLoader) PlanProject(dateTime time.Time, projectID string, planned []metric_exporter.Series) error {
+	testLoads.Lock()
+	defer testLoads.Unlock()
+
+	testLoads.planned[projectID] = len(planned)
+	return nil
+}
+
+func (testLoader) LoadProject(dateTime time.Time, projectID string) (bool, error) {
+	testLoads.Lock()
+	defer testLoads.Unlock()
+
+	if testLoads.planned[projectID] == 0 || testLoads.staged[projectID] < testLoads.planned[projectID] {
+		return false, nil
+	}
+	testLoads.loaded[projectID]++
+	return true, nil
+}
+
+func TestFinalizeLoadsProject(t *testing.T) {
+	es := newTestService(t, utils.Conf{ExporterClass: "TestLoader"})
+	if !es.needsFinalize() {
+		t.Fatal("no /finalize task for an exporter loading projects")
+	}
+
+	cpu := testSeries("loaded", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	sda := testSeries("loaded", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sda")
+	if err := es.writePlan("loaded", []metric_exporter.Series{cpu, sda}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := es.write(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if complete, err := es.Finalize("loaded", nil); complete || err != nil {
+		t.Fatalf("loaded a project with a series still running: %v", err)
+	}
+
+	if _, err := es.write(sda, []string{"60,00:01,2.0"}, []string{"60,00:01,2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if complete, err := es.Finalize("loaded", nil); !complete || err != nil {
+		t.Fatalf("complete project not loaded: %v", err)
+	}
+	if testLoads.loaded["loaded"] != 1 {
+		t.Errorf("project loaded %d times", testLoads.loaded["loaded"])
+	}
+}
+
+func TestSealedRows(t *testing.T) {
+	kekFile := filepath.Join(t.TempDir(), "kek")
+	kek, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(kekFile, []byte(kek.String()+"\n"), 0600)
+
+	es := newTestService(t, utils.Conf{Consolidated: true, Encryption: utils.EncryptionConf{Mode: metric_exporter.EncryptionEnvelope, KEKFile: kekFile, KEKID: "kek-1"}})
+	store := testStore(t, es)
+
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	rows := []string{"60,00:01,1.0", "120,00:02,2.0"}
+	es.writeSeriesRecord(cpu, rows, rows)
+
+	content, _ := store.ReadObject(seriesRecordObjectName("2018-10-18", cpu))
+	if bytes.Contains(content, []byte("00:01")) || !bytes.Contains(content, []byte("sealed_rows")) {
+		t.Errorf("series record holds %s", content)
+	}
+
+	record, ok, err := es.readSeriesRecord(store, "2018-10-18", cpu)
+	if err != nil || !ok || !reflect.DeepEqual(record.Rows, rows) || record.Points != 2 {
+		t.Errorf("got record %+v", record)
+	}
+
+	empty := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "db", "2")
+	es.writeSeriesRecord(empty, nil, nil)
+	if record, ok, err := es.readSeriesRecord(store, "2018-10-18", empty); err != nil || !ok || len(record.Rows) != 0 {
+		t.Errorf("got record %+v of an empty series", record)
+	}
+}
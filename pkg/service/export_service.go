@@ -2,9 +2,15 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"google.golang.org/appengine/taskqueue"
 	"log"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"stackdriver-monitoring-exporter/pkg/gcp"
 	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
@@ -45,17 +51,78 @@ func NewExportService(ctx context.Context) ExportService {
 	return es.init(ctx)
 }
 
+// WithRunID returns the service of the export tasks planned by run runID.
+func (es ExportService) WithRunID(runID string) ExportService {
+	es.conf.RunID = runID
+	return es
+}
+
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// forEach calls f for every index below n, running as many calls at once as
+// uploads are allowed in flight, and returns once all are done.
+func (es ExportService) forEach(n int, f func(i int)) {
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < metric_exporter.ConcurrentUploads(es.conf) && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
 func (es ExportService) newMetricExporter() metric_exporter.MetricExporter {
-	switch es.conf.ExporterClass {
-	case "GCSExporter":
-		return metric_exporter.NewGCSExporter(es.conf)
-	default:
-		return metric_exporter.NewFileExporter(es.conf)
+	exporter, err := metric_exporter.NewExporter(es.conf)
+	if err != nil {
+		log.Fatal("newMetricExporter: ", err.Error())
 	}
+
+	return exporter
+}
+
+var loadedConf struct {
+	sync.Once
+	conf utils.Conf
+	err  error
+}
+
+// LoadConf reads and validates config.yaml on its first call, the services
+// of the process share the result. main calls it at startup so an invalid
+// config fails there rather than in a request.
+func LoadConf() (utils.Conf, error) {
+	loadedConf.Do(func() {
+		if loadedConf.err = loadedConf.conf.LoadConfig(); loadedConf.err == nil {
+			loadedConf.err = metric_exporter.ValidateConf(loadedConf.conf)
+		}
+	})
+
+	return loadedConf.conf, loadedConf.err
 }
 
 func (es ExportService) init(ctx context.Context) ExportService {
-	es.conf.LoadConfig()
+	conf, err := LoadConf()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	es.conf = conf
 
 	es.client = stackdriver.MonitoringClient{}
 	es.client.SetTimezone(es.conf.Timezone)
@@ -64,118 +131,524 @@ func (es ExportService) init(ctx context.Context) ExportService {
 	return es
 }
 
+// instances returns a service per exporter instance of the conf, sharing
+// the monitoring client.
+func (es ExportService) instances() []ExportService {
+	// Instances are checked when the conf is loaded
+	confs, err := es.conf.ExporterInstances()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	instances := make([]ExportService, len(confs))
+	for i := range confs {
+		instances[i] = es
+		instances[i].conf = confs[i]
+	}
+
+	return instances
+}
+
+// instanceProjects returns the projects accepted by each instance, nil when
+// it accepts every project of the run.
+func (es ExportService) instanceProjects(ctx context.Context, instances []ExportService) []map[string]bool {
+	accepted := make([]map[string]bool, len(instances))
+	for i := range instances {
+		if reflect.DeepEqual(instances[i].conf.Projects, es.conf.Projects) {
+			continue
+		}
+
+		accepted[i] = make(map[string]bool)
+		projectIDs := gcp.GetProjects(ctx, instances[i].conf.Projects)
+		for j := range projectIDs {
+			accepted[i][projectIDs[j]] = true
+		}
+	}
+
+	return accepted
+}
+
 func (es ExportService) Do(ctx context.Context) {
-	projectIDs := gcp.GetProjects(ctx)
+	projectIDs := gcp.GetProjects(ctx, es.conf.Projects)
+
+	es.conf.RunID = newRunID()
+	log.Printf("Run ID: %s", es.conf.RunID)
+
+	instances := es.instances()
+	instanceProjects := es.instanceProjects(ctx, instances)
 
 	for prjIdx := range projectIDs {
 		projectID := projectIDs[prjIdx]
 
 		log.Printf("Query metrics in project ID: %s", projectID)
 
-		// Common instance metrics
-		es.exportInstanceCommonMetrics(ctx, projectID)
+		groups := []stackdriver.Group{{}}
+		if len(es.conf.Groups) > 0 {
+			groups = es.client.GetGroups(projectID, es.conf.Groups)
+			if len(groups) == 0 {
+				log.Printf("No configured group in project ID: %s", projectID)
+				continue
+			}
+		}
+
+		var tasks []exportTask
+		for grpIdx := range groups {
+			group := groups[grpIdx]
+
+			// Common instance metrics
+			tasks = append(tasks, es.planInstanceCommonMetrics(projectID, group)...)
+
+			// Agent metrics
+			tasks = append(tasks, es.planInstanceAgentMetrics(projectID, group)...)
+
+			// Disk metrics
+			tasks = append(tasks, es.planInstanceDiskMetrics(projectID, group)...)
+		}
+		tasks = dedupeTasks(tasks)
+
+		// Each instance gets the series passing its filters, its inventory
+		// and plan are complete before any task can look them up
+		var inventory []gcp.InstanceInfo
+		var inventoryErr error
+		var inventoryFetched bool
+		var info projectInfo
+		var finalizeTargets []ExportTarget
+		for i := range instances {
+			if instanceProjects[i] != nil && !instanceProjects[i][projectID] {
+				continue
+			}
+			route := instances[i].route(ctx, projectID, &info)
+			instance := instances[i].routed(route)
+
+			var planned []metric_exporter.Series
+			var plannedTasks []int
+			for j := range tasks {
+				if instance.conf.MatchMetric(tasks[j].series.Metric) {
+					planned = append(planned, tasks[j].series)
+					plannedTasks = append(plannedTasks, j)
+				}
+			}
+			if len(planned) == 0 {
+				continue
+			}
+
+			// Label columns are filled from the inventory. It only enriches
+			// the export, which goes on without it when it cannot be listed.
+			if instance.conf.Inventory || len(instance.conf.LabelColumns) > 0 {
+				if !inventoryFetched {
+					inventory, inventoryErr = gcp.GetInstanceInventory(ctx, projectID, es.conf.ComputeEndpoint)
+					if inventoryErr != nil {
+						log.Printf("Skip the instance inventory of project ID %s: %v", projectID, inventoryErr)
+					}
+					inventoryFetched = true
+				}
+				if err := instance.planInventory(projectID, inventory, inventoryErr); err != nil {
+					log.Printf("Skip exporter %s, project ID %s: cannot record the inventory: %v", instance.conf.Name, projectID, err)
+					continue
+				}
+			}
+
+			// Tasks of an instance without plan could never complete its
+			// project, the next run exports it
+			if err := instance.writePlan(projectID, planned); err != nil {
+				log.Printf("Skip exporter %s, project ID %s: cannot write the plan: %v", instance.conf.Name, projectID, err)
+				continue
+			}
+			for _, j := range plannedTasks {
+				tasks[j].targets = append(tasks[j].targets, ExportTarget{instance.conf.Name, route})
+			}
+
+			if instance.needsFinalize() {
+				finalizeTargets = append(finalizeTargets, ExportTarget{instance.conf.Name, route})
+			}
+		}
+
+		// Tasks carry the labels of their instance to the label columns
+		if inventoryFetched && inventoryErr == nil {
+			labels := inventoryLabels(inventory)
+			for i := range tasks {
+				tasks[i].series.Labels = labels[tasks[i].series.InstanceID]
+			}
+		}
+
+		for i := range tasks {
+			if len(tasks[i].targets) > 0 {
+				addExportTask(ctx, es.conf.RunID, tasks[i])
+			}
+		}
+
+		if len(finalizeTargets) > 0 {
+			addFinalizeTask(ctx, es.conf.RunID, projectID, finalizeTargets)
+		}
+	}
+}
+
+func (es ExportService) instanceSelector(metric string, group stackdriver.Group) utils.InstanceSelector {
+	selector := es.conf.InstanceSelector(metric)
+	selector.GroupID = group.ID
+
+	return selector
+}
+
+func (es ExportService) newSeries(projectID, metric string, instance stackdriver.Instance, group stackdriver.Group, attendNames ...string) metric_exporter.Series {
+	series := metric_exporter.Series{
+		ProjectID:    projectID,
+		Metric:       metric,
+		Zone:         instance.Zone,
+		InstanceID:   instance.InstanceID,
+		InstanceName: instance.InstanceName,
+		AttendNames:  attendNames,
+	}
+	if es.conf.GroupFolders {
+		series.Group = group.DisplayName
+	}
+
+	return series
+}
+
+// exportTask is one series to be exported by the /export handler, written
+// by its targets.
+type exportTask struct {
+	series  metric_exporter.Series
+	aligner string
+	filter  string
+	targets []ExportTarget
+}
+
+// dedupeTasks drops the tasks of series already planned through another
+// group. Without group folders they would write the same file.
+func dedupeTasks(tasks []exportTask) (unique []exportTask) {
+	seen := make(map[string]bool)
+	for i := range tasks {
+		key := seriesKey(tasks[i].series)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, tasks[i])
+	}
+
+	return
+}
+
+// targetParams joins the exporters and routes of targets as task params.
+func targetParams(targets []ExportTarget) (exporters, routes string) {
+	names := make([]string, len(targets))
+	routeNames := make([]string, len(targets))
+	for i := range targets {
+		names[i] = targets[i].Exporter
+		routeNames[i] = targets[i].Route
+	}
+
+	return strings.Join(names, "|"), strings.Join(routeNames, "|")
+}
+
+func addExportTask(ctx context.Context, runID string, task exportTask) {
+	series := task.series
+	exporters, routes := targetParams(task.targets)
+
+	var labels []byte
+	if len(series.Labels) > 0 {
+		var err error
+		if labels, err = json.Marshal(series.Labels); err != nil {
+			log.Fatal("addExportTask: ", err.Error())
+		}
+	}
 
-		// Agent metrics
-		es.exportInstanceAgentMetrics(ctx, projectID)
+	t := taskqueue.NewPOSTTask(
+		"/export",
+		map[string][]string{
+			"projectID":    {series.ProjectID},
+			"metric":       {series.Metric},
+			"aligner":      {task.aligner},
+			"filter":       {task.filter},
+			"zone":         {series.Zone},
+			"instanceID":   {series.InstanceID},
+			"instanceName": {series.InstanceName},
+			"attendNames":  {strings.Join(series.AttendNames, "|")},
+			"group":        {series.Group},
+			"labels":       {string(labels)},
+			"runID":        {runID},
+			"exporters":    {exporters},
+			"routes":       {routes},
+		},
+	)
+	if _, err := taskqueue.Add(ctx, t, ""); err != nil {
+		log.Fatal(err.Error())
+	}
+}
 
-		// Disk metrics
-		es.exportInstanceDiskMetrics(ctx, projectID)
+// finalizeDelay is how long the /finalize task of a project first waits for
+// its export tasks, it is retried with backoff until they are done.
+const finalizeDelay = 5 * time.Minute
+
+// addFinalizeTask adds the task writing the files of projectID assembled
+// from every series of the project. Only this task checks the project is
+// complete, so export tasks do not list the records of each other.
+func addFinalizeTask(ctx context.Context, runID, projectID string, targets []ExportTarget) {
+	exporters, routes := targetParams(targets)
+
+	t := taskqueue.NewPOSTTask(
+		"/finalize",
+		map[string][]string{
+			"projectID": {projectID},
+			"runID":     {runID},
+			"exporters": {exporters},
+			"routes":    {routes},
+		},
+	)
+	t.Delay = finalizeDelay
+	if _, err := taskqueue.Add(ctx, t, ""); err != nil {
+		log.Fatal(err.Error())
 	}
 }
 
-func (es ExportService) exportInstanceCommonMetrics(ctx context.Context, projectID string) {
+func (es ExportService) planInstanceCommonMetrics(projectID string, group stackdriver.Group) (tasks []exportTask) {
 	for mIdx := range monitoringMetrics {
 		metric := monitoringMetrics[mIdx]
 
-		log.Printf("es.client.GetInstanceNames")
-		instanceNames := es.client.GetInstanceNames(projectID, metric)
-
-		for instIdx := range instanceNames {
-			instanceName := instanceNames[instIdx]
-
-			filter := stackdriver.MakeInstanceFilter(metric, instanceName)
-
-			t := taskqueue.NewPOSTTask(
-				"/export",
-				map[string][]string{
-					"projectID":    {projectID},
-					"metric":       {metric},
-					"aligner":      {stackdriver.AggregationPerSeriesAlignerRate},
-					"filter":       {filter},
-					"instanceName": {instanceName},
-				},
-			)
-			if _, err := taskqueue.Add(ctx, t, ""); err != nil {
-				log.Fatal(err.Error())
-			}
+		log.Printf("es.client.GetInstances")
+		instances := es.client.GetInstances(projectID, metric, es.instanceSelector(metric, group))
+
+		for instIdx := range instances {
+			instance := instances[instIdx]
+
+			filter := stackdriver.MakeInstanceFilter(metric, instance.InstanceID)
+
+			series := es.newSeries(projectID, metric, instance, group)
+			tasks = append(tasks, exportTask{series: series, aligner: stackdriver.AggregationPerSeriesAlignerRate, filter: filter})
 		}
 	}
-}
 
-func (es ExportService) exportInstanceAgentMetrics(ctx context.Context, projectID string) {
-	// We use the common metric to get the instance name, we can't query with agent metric
-	instanceNames := es.client.GetInstanceNames(projectID, monitoringMetrics[0])
+	return
+}
 
+func (es ExportService) planInstanceAgentMetrics(projectID string, group stackdriver.Group) (tasks []exportTask) {
 	for mIdx := range monitoringAgentMetrics {
 		metric := monitoringAgentMetrics[mIdx]
 
-		for instIdx := range instanceNames {
-			instanceName := instanceNames[instIdx]
-
-			// Currently only support instance memory
-			filter := stackdriver.MakeAgentMemoryFilter(metric, instanceName)
-
-			t := taskqueue.NewPOSTTask(
-				"/export",
-				map[string][]string{
-					"projectID":    {projectID},
-					"metric":       {metric},
-					"aligner":      {stackdriver.AggregationPerSeriesAlignerMean},
-					"filter":       {filter},
-					"instanceName": {instanceName},
-				},
-			)
-			if _, err := taskqueue.Add(ctx, t, ""); err != nil {
-				log.Fatal(err.Error())
-			}
+		// We use the common metric to get the instance name, we can't query with agent metric
+		instances := es.client.GetInstances(projectID, monitoringMetrics[0], es.instanceSelector(metric, group))
+
+		for instIdx := range instances {
+			instance := instances[instIdx]
+
+			filter := es.agentFilter(metric, instance.InstanceID)
+
+			series := es.newSeries(projectID, metric, instance, group)
+			tasks = append(tasks, exportTask{series: series, aligner: stackdriver.AggregationPerSeriesAlignerMean, filter: filter})
 		}
 	}
+
+	return
 }
 
-func (es ExportService) exportInstanceDiskMetrics(ctx context.Context, projectID string) {
+func (es ExportService) planInstanceDiskMetrics(projectID string, group stackdriver.Group) (tasks []exportTask) {
 	for mdIdx := range monitoringDiskMetrics {
 		metric := monitoringDiskMetrics[mdIdx]
 
-		instanceAndDiskMaps := es.client.GetInstanceAndDiskMaps(projectID, metric)
+		instanceAndDiskMaps := es.client.GetInstanceAndDiskMaps(projectID, metric, es.instanceSelector(metric, group))
 
 		for mapIdx := range instanceAndDiskMaps {
 			m := instanceAndDiskMaps[mapIdx]
-			instanceName := m[stackdriver.InstanceNameKey]
+			instance := stackdriver.Instance{
+				Zone:         m[stackdriver.ZoneKey],
+				InstanceID:   m[stackdriver.InstanceIDKey],
+				InstanceName: m[stackdriver.InstanceNameKey],
+			}
 			deviceName := m[stackdriver.DeviceNameKey]
 
-			filter := stackdriver.MakeDiskFilter(metric, instanceName, deviceName)
-
-			t := taskqueue.NewPOSTTask(
-				"/export",
-				map[string][]string{
-					"projectID":    {projectID},
-					"metric":       {metric},
-					"aligner":      {stackdriver.AggregationPerSeriesAlignerRate},
-					"filter":       {filter},
-					"instanceName": {instanceName},
-					"attendNames":  {strings.Join([]string{"disk", deviceName}, "|")},
-				},
-			)
-			if _, err := taskqueue.Add(ctx, t, ""); err != nil {
-				log.Fatal(err.Error())
+			filter := stackdriver.MakeDiskFilter(metric, instance.InstanceID, deviceName)
+
+			series := es.newSeries(projectID, metric, instance, group, "disk", deviceName)
+			tasks = append(tasks, exportTask{series: series, aligner: stackdriver.AggregationPerSeriesAlignerRate, filter: filter})
+		}
+	}
+
+	return
+}
+
+// agentFilter selects the agent metric of an instance. Only the memory used
+// is supported, the long format keeps every state.
+func (es ExportService) agentFilter(metric, instanceID string) string {
+	if es.conf.OutputFormat == utils.OutputFormatLong {
+		return stackdriver.MakeInstanceFilter(metric, instanceID)
+	}
+
+	return stackdriver.MakeAgentMemoryFilter(metric, instanceID)
+}
+
+func isAgentMetric(metric string) bool {
+	for i := range monitoringAgentMetrics {
+		if monitoringAgentMetrics[i] == metric {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExporterResult is a series written by one exporter instance, or the error
+// it failed with.
+type ExporterResult struct {
+	Name        string                       `json:"name,omitempty"`
+	Route       string                       `json:"route,omitempty"`
+	Exporter    string                       `json:"exporter"`
+	Destination string                       `json:"destination"`
+	Prefix      string                       `json:"prefix,omitempty"`
+	File        metric_exporter.ExportedFile `json:"file"`
+	OK          bool                         `json:"ok"`
+	Error       string                       `json:"error,omitempty"`
+}
+
+// fetchedSeries are the points of a series and the rows written from them
+// in one output format.
+type fetchedSeries struct {
+	columns []string
+	points  []string
+	rows    []string
+}
+
+// formatKey tells apart the output formats that fetch a series differently.
+func formatKey(c utils.Conf) string {
+	if c.OutputFormat != utils.OutputFormatLong {
+		return ""
+	}
+
+	return c.OutputFormat + "|" + strings.Join(c.LongColumns, ",")
+}
+
+// Export fetches the points of series once per output format and writes
+// them with each target through its route, with every instance on its
+// default route when there is no target.
+func (es ExportService) Export(series metric_exporter.Series, aligner, filter string, targets []ExportTarget) []ExporterResult {
+	instances := es.targeted(targets)
+
+	fetched := make(map[string]fetchedSeries)
+	for i := range instances {
+		key := formatKey(instances[i].conf)
+		if _, ok := fetched[key]; !ok {
+			fetched[key] = instances[i].fetch(series, aligner, filter)
+		}
+	}
+
+	return es.writeInstances(instances, series, fetched)
+}
+
+// fetch retrieves the points of series in the output format of es. The
+// filter of agent metrics depends on the format.
+func (es ExportService) fetch(series metric_exporter.Series, aligner, filter string) (fetched fetchedSeries) {
+	if isAgentMetric(series.Metric) {
+		filter = es.agentFilter(series.Metric, series.InstanceID)
+	}
+
+	if es.conf.OutputFormat == utils.OutputFormatLong {
+		timeSeries := es.client.RetrieveTimeSeries(series.ProjectID, series.Metric, aligner, filter)
+		for i := range timeSeries {
+			fetched.points = append(fetched.points, timeSeries[i].Points...)
+		}
+
+		fetched.rows = stackdriver.LongRows(series.Metric, timeSeries, es.conf.LongColumns)
+		fetched.columns = append([]string{"metric"}, es.conf.LongColumns...)
+	} else {
+		fetched.points = es.client.RetrieveMetricPoints(series.ProjectID, series.Metric, aligner, filter)
+		fetched.rows = fetched.points
+	}
+
+	return
+}
+
+// writeInstances writes series with each instance in its output format.
+// Instances upload at once, within the bound of concurrent uploads, and one
+// failing does not stop the others.
+func (es ExportService) writeInstances(instances []ExportService, series metric_exporter.Series, fetched map[string]fetchedSeries) []ExporterResult {
+	results := make([]ExporterResult, len(instances))
+	es.forEach(len(instances), func(i int) {
+		instance := instances[i]
+		format := fetched[formatKey(instance.conf)]
+
+		s := series
+		s.Columns = format.columns
+
+		result := ExporterResult{
+			Name:        instance.conf.Name,
+			Route:       instance.conf.Route,
+			Exporter:    instance.conf.ExporterClass,
+			Destination: instance.conf.Destination,
+			Prefix:      instance.conf.Prefix,
+		}
+
+		file, err := instance.write(s, format.points, format.rows)
+		if err != nil {
+			log.Printf("Exporter %s, route %s failed: %v", instance.conf.Name, instance.conf.Route, err)
+			result.Error = err.Error()
+		} else {
+			if instance.conf.Name != "" || instance.conf.Route != "" {
+				log.Printf("Exporter %s, route %s wrote %s", instance.conf.Name, instance.conf.Route, file.Name)
 			}
+			result.File, result.OK = file, true
+		}
+		results[i] = result
+	})
+
+	return results
+}
+
+// targeted returns the instances of targets, each on its route, or every
+// instance on its default route when there is no target.
+func (es ExportService) targeted(targets []ExportTarget) (instances []ExportService) {
+	all := es.instances()
+	if len(targets) == 0 {
+		return all
+	}
+
+	for i := range all {
+		if target, ok := findTarget(targets, all[i].conf.Name); ok {
+			instances = append(instances, all[i].routed(target.Route))
+		}
+	}
+
+	return
+}
+
+func findTarget(targets []ExportTarget, exporter string) (ExportTarget, bool) {
+	for i := range targets {
+		if targets[i].Exporter == exporter {
+			return targets[i], true
 		}
 	}
+
+	return ExportTarget{}, false
 }
 
-func (es ExportService) Export(projectID, metric, aligner, filter, instanceName string, attendNames ...string) {
-	points := es.client.RetrieveMetricPoints(projectID, metric, aligner, filter)
+// write exports the fetched series with the exporter of es, then the files
+// assembled once the series completes a project or instance. The series
+// record is written after its file, so a failed export leaves the series
+// unfinished.
+func (es ExportService) write(series metric_exporter.Series, points, rows []string) (metric_exporter.ExportedFile, error) {
+	// The labels planned with the series only fill label columns
+	if len(es.conf.LabelColumns) == 0 {
+		series.Labels = nil
+	}
 
 	metricExporter := es.newMetricExporter()
-	metricExporter.Export(es.client.StartTime.In(es.client.Location()), projectID, metric, instanceName, points, attendNames...)
+	file, err := metricExporter.Export(es.dateTime(), series, rows)
+	if err != nil {
+		return file, err
+	}
+	if err := es.writeFileRecord(series.ProjectID, seriesKey(series), file); err != nil {
+		return file, err
+	}
+
+	if err := es.writeSeriesRecord(series, points, rows); err != nil {
+		return file, err
+	}
+
+	if es.conf.WideFormat {
+		if err := es.exportWideIfComplete(series); err != nil {
+			return file, err
+		}
+	}
+
+	return file, nil
 }
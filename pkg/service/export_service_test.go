@@ -0,0 +1,218 @@
+package service
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+// testDate is the day exported by the services of newTestService.
+var testDate = time.Date(2018, 10, 18, 0, 0, 0, 0, time.UTC)
+
+// newTestService returns a service exporting testDate with c, to a
+// temporary folder when c has no destination.
+func newTestService(t *testing.T, c utils.Conf) ExportService {
+	t.Helper()
+
+	if c.Destination == "" {
+		c.Destination = t.TempDir()
+	}
+
+	es := ExportService{conf: c}
+	es.client.StartTime = testDate
+
+	return es
+}
+
+func testSeries(projectID, metric, instanceName, instanceID string, attendNames ...string) metric_exporter.Series {
+	return metric_exporter.Series{
+		ProjectID:    projectID,
+		Metric:       metric,
+		Zone:         "asia-east1-a",
+		InstanceID:   instanceID,
+		InstanceName: instanceName,
+		AttendNames:  attendNames,
+	}
+}
+
+// testStore returns the object store of es.
+func testStore(t *testing.T, es ExportService) metric_exporter.ObjectStore {
+	t.Helper()
+
+	store, ok := es.objectStore()
+	if !ok {
+		t.Fatalf("exporter %s is not an object store", es.conf.ExporterClass)
+	}
+
+	return store
+}
+
+func TestDedupeTasks(t *testing.T) {
+	cpu := "compute.googleapis.com/instance/cpu/usage_time"
+	web := testSeries("p", cpu, "web", "1")
+	db := testSeries("p", cpu, "db", "2")
+	sda := testSeries("p", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sda")
+	sdb := testSeries("p", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sdb")
+
+	// web is a member of both groups
+	tasks := dedupeTasks([]exportTask{{series: web}, {series: sda}, {series: sdb}, {series: db}, {series: web}, {series: sda}})
+	if len(tasks) != 4 || tasks[0].series.InstanceName != "web" || tasks[3].series.InstanceName != "db" {
+		t.Errorf("got tasks %+v, want web, sda, sdb and db once", tasks)
+	}
+
+	// Group folders write each group's files apart
+	webA, webB := web, web
+	webA.Group, webB.Group = "a", "b"
+	if tasks := dedupeTasks([]exportTask{{series: webA}, {series: webB}}); len(tasks) != 2 {
+		t.Errorf("got %d tasks with group folders, want 2", len(tasks))
+	}
+}
+
+func TestSeriesKeyInstanceID(t *testing.T) {
+	cpu := "compute.googleapis.com/instance/cpu/usage_time"
+
+	// VMs sharing a name are told apart by their ID
+	a := seriesKey(testSeries("p", cpu, "web", "1"))
+	b := seriesKey(testSeries("p", cpu, "web", "2"))
+	if a == b {
+		t.Errorf("instances 1 and 2 share the key %q", a)
+	}
+	if want := "compute.googleapis.com_instance_cpu_usage_time[web_1]"; a != want {
+		t.Errorf("got key %q, want %q", a, want)
+	}
+}
+
+func TestTargeted(t *testing.T) {
+	var c utils.Conf
+	err := c.Parse([]byte(`
+exporters:
+  - name: local
+    destination: /tmp/a
+  - name: archive
+    destination: /tmp/b
+    routes:
+      - name: eu
+        match: {projects: [p]}
+        destination: /tmp/eu
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := ExportService{conf: c}
+
+	destinations := func(instances []ExportService) (got []string) {
+		for i := range instances {
+			got = append(got, instances[i].conf.Name+":"+instances[i].conf.Destination)
+		}
+		return
+	}
+
+	tests := []struct {
+		targets []ExportTarget
+		want    []string
+	}{
+		{nil, []string{"local:/tmp/a", "archive:/tmp/b"}},
+		{[]ExportTarget{{Exporter: "archive", Route: "eu"}}, []string{"archive:/tmp/eu"}},
+		{[]ExportTarget{{Exporter: "archive"}, {Exporter: "local"}}, []string{"local:/tmp/a", "archive:/tmp/b"}},
+		{[]ExportTarget{{Exporter: "gone"}}, nil},
+	}
+
+	for _, test := range tests {
+		if got := destinations(es.targeted(test.targets)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.targets, got, test.want)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	es := ExportService{conf: utils.Conf{ExporterClass: "GCSExporter", Blocks: map[string]interface{}{"gcs": map[string]interface{}{"concurrent_uploads": 3}}}}
+
+	var mu sync.Mutex
+	var running, most int
+	done := make([]bool, 20)
+	es.forEach(len(done), func(i int) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+	})
+
+	for i := range done {
+		if !done[i] {
+			t.Errorf("%d not called", i)
+		}
+	}
+	if most > 3 || most < 2 {
+		t.Errorf("got %d calls at once, want up to 3", most)
+	}
+}
+
+func TestWriteInstances(t *testing.T) {
+	// A file where the folder of the broken instance should be
+	blocked := filepath.Join(t.TempDir(), "blocked")
+	if err := ioutil.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	long := t.TempDir()
+
+	var c utils.Conf
+	err := c.Parse([]byte(`
+exporter: FileExporter
+exporters:
+  - name: broken
+    destination: ` + blocked + `
+  - name: long
+    destination: ` + long + `
+    output_format: long
+    long_columns: [zone]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := ExportService{conf: c}
+	es.client.StartTime = testDate
+
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	fetched := map[string]fetchedSeries{
+		"": {points: []string{"60,00:01,1.0"}, rows: []string{"60,00:01,1.0"}},
+		formatKey(es.instances()[1].conf): {
+			columns: []string{"metric", "zone"},
+			points:  []string{"60,00:01,1.0"},
+			rows:    []string{"60,00:01,1.0," + cpu.Metric + ",asia-east1-a"},
+		},
+	}
+	if len(fetched) != 2 {
+		t.Fatal("the long format shares the key of the default format")
+	}
+
+	results := es.writeInstances(es.instances(), cpu, fetched)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Name != "broken" || results[0].OK || results[0].Error == "" {
+		t.Errorf("got result %+v of the broken instance", results[0])
+	}
+	if results[1].Name != "long" || !results[1].OK || results[1].Error != "" || results[1].File.Rows != 1 {
+		t.Fatalf("got result %+v of the long instance", results[1])
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(long, filepath.FromSlash(results[1].File.Name)))
+	if want := "timestamp,datetime,value,metric,zone\n60,00:01,1.0," + cpu.Metric + ",asia-east1-a"; err != nil || string(content) != want {
+		t.Errorf("long file holds\n%s\nwant\n%s", content, want)
+	}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"log"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+// Finalize loads the staged series of projectID, then writes the files
+// assembled from all of its series, the consolidated file then the manifest
+// and bundle. It finalizes with each target, or every instance on its
+// default route when there is none. It reports false while series are still
+// running, the /finalize task is then retried, and the first error of an
+// instance after finalizing the others.
+func (es ExportService) Finalize(projectID string, targets []ExportTarget) (complete bool, err error) {
+	complete = true
+
+	instances := es.targeted(targets)
+	for i := range instances {
+		done, instanceErr := instances[i].finalize(projectID)
+		if instanceErr != nil {
+			log.Printf("Finalize: exporter %s, route %s: %v", instances[i].conf.Name, instances[i].conf.Route, instanceErr)
+			if err == nil {
+				err = instanceErr
+			}
+		}
+		if !done {
+			complete = false
+		}
+	}
+
+	return
+}
+
+func (es ExportService) finalize(projectID string) (bool, error) {
+	if loader, ok := es.newMetricExporter().(metric_exporter.ProjectLoader); ok {
+		if done, err := loader.LoadProject(es.dateTime(), projectID); err != nil || !done {
+			return false, err
+		}
+	}
+
+	if es.conf.Consolidated {
+		if done, err := es.exportProjectIfComplete(projectID); err != nil || !done {
+			return false, err
+		}
+	}
+
+	// The manifest lists the consolidated file
+	if es.conf.Manifest || es.conf.Bundle.Format != "" {
+		return es.writeManifestIfComplete(projectID)
+	}
+
+	return true, nil
+}
+
+// needsFinalize reports whether es loads or writes files from all the
+// series of a project, so the export job adds a /finalize task.
+func (es ExportService) needsFinalize() bool {
+	_, loads := es.newMetricExporter().(metric_exporter.ProjectLoader)
+	return loads || es.conf.Consolidated || es.conf.Manifest || es.conf.Bundle.Format != ""
+}
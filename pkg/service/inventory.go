@@ -0,0 +1,77 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"stackdriver-monitoring-exporter/pkg/gcp"
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+func (es ExportService) inventoryObjectName(projectID, ext string) string {
+	return metric_exporter.NewPathBuilder(es.conf).ProjectFilePath(es.dateTime(), projectID, "instances."+ext)
+}
+
+// planInventory writes the inventory of projectID, or skips it after listErr
+// listing the instances or an error writing it, and records which.
+func (es ExportService) planInventory(projectID string, inventory []gcp.InstanceInfo, listErr error) error {
+	written := listErr == nil
+	if written {
+		if err := es.writeInventory(projectID, inventory); err != nil {
+			log.Printf("Skip the instance inventory of exporter %s, project ID %s: %v", es.conf.Name, projectID, err)
+			written = false
+		}
+	}
+
+	return es.writeInventoryRecord(projectID, written)
+}
+
+// writeInventory saves the Compute Engine inventory of projectID next to its
+// daily metrics, once per project and day.
+func (es ExportService) writeInventory(projectID string, inventory []gcp.InstanceInfo) error {
+	store, ok := es.objectStore()
+	if !ok {
+		return nil
+	}
+
+	content, err := json.Marshal(inventory)
+	if err != nil {
+		log.Fatal("writeInventory: ", err.Error())
+	}
+	if err := es.writeInventoryFile(store, projectID, "json", content, len(inventory)); err != nil {
+		return err
+	}
+
+	rows := make([]string, len(inventory))
+	for i := range inventory {
+		rows[i] = inventory[i].CSVRow()
+	}
+	csv := fmt.Sprintf("%s\n%s", gcp.InstanceInventoryCSVHeader, strings.Join(rows, "\n"))
+
+	return es.writeInventoryFile(store, projectID, "csv", []byte(csv), len(inventory))
+}
+
+// writeInventoryFile writes an inventory file and its file record.
+func (es ExportService) writeInventoryFile(store metric_exporter.ObjectStore, projectID, ext string, content []byte, rows int) error {
+	name := es.inventoryObjectName(projectID, ext)
+	if err := store.WriteObject(name, content); err != nil {
+		return err
+	}
+
+	return es.writeFileRecord(projectID, path.Base(name), metric_exporter.ExportedFile{Name: name, Size: int64(len(content)), Rows: rows, SHA256: metric_exporter.SHA256(content)})
+}
+
+// inventoryLabels maps the instance IDs of inventory to their labels. Do
+// passes the labels of each series through its export task, so tasks do not
+// read the inventory back.
+func inventoryLabels(inventory []gcp.InstanceInfo) map[string]map[string]string {
+	labels := make(map[string]map[string]string)
+	for i := range inventory {
+		labels[inventory[i].InstanceID] = inventory[i].Labels
+	}
+
+	return labels
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/gcp"
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestInventory(t *testing.T) {
+	es := newTestService(t, utils.Conf{Inventory: true})
+	store := testStore(t, es)
+
+	inventory := []gcp.InstanceInfo{
+		{Zone: "asia-east1-a", InstanceID: "1", InstanceName: "web", MachineType: "n1-standard-2", VCPUs: 2, MemoryMB: 7680, Status: "RUNNING", Labels: map[string]string{"env": "prod", "team": "ops"}},
+		{Zone: "asia-east1-b", InstanceID: "2", InstanceName: "db", Status: "RUNNING"},
+	}
+	if err := es.writeInventory("p", inventory); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := store.ReadObject("p/2018/10/18/instances.json")
+	var written []gcp.InstanceInfo
+	if err != nil || json.Unmarshal(content, &written) != nil || !reflect.DeepEqual(written, inventory) {
+		t.Errorf("instances.json holds %s", content)
+	}
+
+	csv, _ := store.ReadObject("p/2018/10/18/instances.csv")
+	want := gcp.InstanceInventoryCSVHeader + "\n" +
+		"asia-east1-a,1,web,n1-standard-2,2,7680,false,RUNNING,env=prod;team=ops\n" +
+		"asia-east1-b,2,db,,0,0,false,RUNNING,"
+	if string(csv) != want {
+		t.Errorf("instances.csv holds\n%s\nwant\n%s", csv, want)
+	}
+
+	files, _ := es.readFileRecords(store, "2018-10-18", "p")
+	if len(files) != 2 || !strings.HasSuffix(files[0].Name, "instances.csv") || files[0].Rows != 2 {
+		t.Errorf("got file records %+v", files)
+	}
+
+	labels := inventoryLabels(inventory)
+	if labels["1"]["team"] != "ops" || labels["2"] != nil || labels["3"] != nil {
+		t.Errorf("got labels %v", labels)
+	}
+}
+
+// TestLabelColumns checks the labels planned with a series fill its label
+// columns without the inventory being read back.
+func TestLabelColumns(t *testing.T) {
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	cpu.Labels = map[string]string{"env": "prod", "team": "ops"}
+
+	for _, columns := range [][]string{{"team"}, nil} {
+		es := newTestService(t, utils.Conf{LabelColumns: columns})
+		store := testStore(t, es)
+
+		file, err := es.write(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := store.ReadObject(file.Name)
+		if labelled := strings.Contains(string(content), "ops"); labelled != (columns != nil) {
+			t.Errorf("label columns %v: wrote\n%s", columns, content)
+		}
+	}
+}
+
+func TestInventoryPathPreset(t *testing.T) {
+	es := newTestService(t, utils.Conf{Inventory: true, PathPreset: "hive"})
+	store := testStore(t, es)
+
+	es.writeInventory("p", []gcp.InstanceInfo{{Zone: "asia-east1-a", InstanceID: "1", InstanceName: "web"}})
+
+	// Next to the series files of the layout
+	for _, name := range []string{"project=p/dt=2018-10-18/instances.json", "project=p/dt=2018-10-18/instances.csv"} {
+		if _, err := store.ReadObject(name); err != nil {
+			t.Errorf("no %s", name)
+		}
+	}
+}
+
+// TestInventorySkipped checks a project whose inventory could not be listed
+// or written still gets its manifest and bundle.
+func TestInventorySkipped(t *testing.T) {
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	inventory := []gcp.InstanceInfo{{Zone: "asia-east1-a", InstanceID: "1", InstanceName: "web"}}
+
+	tests := []struct {
+		listErr error
+		files   int
+	}{
+		{nil, 3},
+		{errors.New("compute API unavailable"), 1},
+	}
+
+	for _, test := range tests {
+		es := newTestService(t, utils.Conf{Inventory: true, Manifest: true, Bundle: utils.BundleConf{Format: utils.BundleZip}})
+		store := testStore(t, es)
+
+		if err := es.planInventory("p", inventory, test.listErr); err != nil {
+			t.Fatal(err)
+		}
+		es.writePlan("p", []metric_exporter.Series{cpu})
+		es.write(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+
+		if complete, err := es.Finalize("p", nil); !complete || err != nil {
+			t.Fatalf("list error %v: not finalized, %v", test.listErr, err)
+		}
+		content, err := store.ReadObject("p/2018/10/18/manifest.json")
+		var manifest Manifest
+		if err != nil || json.Unmarshal(content, &manifest) != nil || len(manifest.Files) != test.files {
+			t.Errorf("list error %v: manifest holds %s", test.listErr, content)
+		}
+		if _, err := store.ReadObject("p/2018/10/18/2018-10-18[p].zip"); err != nil {
+			t.Errorf("list error %v: no bundle, %v", test.listErr, err)
+		}
+	}
+}
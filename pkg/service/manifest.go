@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/gcp"
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+const manifestName = "manifest.json"
+
+// Manifest lists every file exported for a project and day, so downstream
+// jobs can check the data set is complete and untouched.
+type Manifest struct {
+	SchemaVersion int    `json:"schema_version"`
+	RunID         string `json:"run_id"`
+	ProjectID     string `json:"project_id"`
+	Date          string `json:"date"`
+
+	// Export window of the points, RFC 3339
+	WindowStart string `json:"window_start"`
+	WindowEnd   string `json:"window_end"`
+
+	Files []metric_exporter.ExportedFile `json:"files"`
+}
+
+// VerifyResult is the outcome of checking a project's files against its
+// manifest.
+type VerifyResult struct {
+	Exporter  string   `json:"exporter,omitempty"`
+	Route     string   `json:"route,omitempty"`
+	ProjectID string   `json:"project_id"`
+	Date      string   `json:"date"`
+	Manifest  string   `json:"manifest"`
+	OK        bool     `json:"ok"`
+	Verified  int      `json:"verified"`
+	Missing   []string `json:"missing,omitempty"`
+	Corrupted []string `json:"corrupted,omitempty"`
+
+	// Error is why files could not be read, they are not verified
+	Error string `json:"error,omitempty"`
+}
+
+func (es ExportService) manifestObjectName(projectID string, dateTime time.Time) string {
+	return metric_exporter.NewPathBuilder(es.conf).ProjectFilePath(dateTime, projectID, manifestName)
+}
+
+// projectManifest returns the manifest of projectID once every planned
+// series has a record and every file of the day is recorded.
+func (es ExportService) projectManifest(store metric_exporter.ObjectStore, projectID string) (manifest Manifest, complete bool, err error) {
+	date := reportDate(es.dateTime())
+	planned, complete, err := es.projectComplete(store, date, projectID)
+	if err != nil || !complete {
+		return manifest, false, err
+	}
+
+	files, err := es.readFileRecords(store, date, projectID)
+	if err != nil {
+		return manifest, false, err
+	}
+	count, err := es.projectFileCount(store, date, projectID, planned)
+	if err != nil {
+		return manifest, false, err
+	}
+	if len(files) < count {
+		// Wide or consolidated files are still being written
+		return manifest, false, nil
+	}
+
+	manifest = Manifest{
+		SchemaVersion: metric_exporter.SchemaVersion,
+		RunID:         es.conf.RunID,
+		ProjectID:     projectID,
+		Date:          date,
+		WindowStart:   es.client.StartTime.Format(time.RFC3339),
+		WindowEnd:     es.client.EndTime.Format(time.RFC3339),
+		Files:         files,
+	}
+
+	return manifest, true, nil
+}
+
+// writeManifestIfComplete writes the manifest and the bundle of projectID
+// once all its files are written, and reports whether they are written.
+func (es ExportService) writeManifestIfComplete(projectID string) (bool, error) {
+	store, ok := es.objectStore()
+	if !ok {
+		return true, nil
+	}
+
+	manifest, complete, err := es.projectManifest(store, projectID)
+	if err != nil || !complete {
+		return false, err
+	}
+
+	if es.conf.Manifest {
+		content, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			log.Fatal("writeManifestIfComplete: ", err.Error())
+		}
+
+		if err := store.WriteObject(es.manifestObjectName(projectID, es.dateTime()), content); err != nil {
+			return false, err
+		}
+		log.Printf("Manifest of %d files of project ID: %s", len(manifest.Files), projectID)
+	}
+
+	if es.conf.Bundle.Format != "" {
+		if err := es.writeBundle(store, manifest); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Verify re-reads the files listed in the manifests of date, the latest run
+// when empty, and checks their size, rows and SHA-256, for every exporter
+// instance in the destination the project is routed to. Files removed after
+// bundling are read from the bundle.
+func (es ExportService) Verify(ctx context.Context, date, projectID string) (results []VerifyResult) {
+	instances := es.instances()
+	for i := range instances {
+		results = append(results, instances[i].verify(ctx, date, projectID)...)
+	}
+
+	return
+}
+
+func (es ExportService) verify(ctx context.Context, date, projectID string) (results []VerifyResult) {
+	dateTime := es.dateTime()
+	if date != "" {
+		var err error
+		if dateTime, err = time.ParseInLocation("2006-01-02", date, es.client.Location()); err != nil {
+			log.Printf("Verify: invalid date %s", date)
+			return
+		}
+	}
+
+	projectIDs := []string{projectID}
+	if projectID == "" {
+		projectIDs = gcp.GetProjects(ctx, es.conf.Projects)
+	}
+
+	return es.verifyProjects(ctx, projectIDs, dateTime)
+}
+
+// verifyProjects checks each of projectIDs where it is routed, skipping
+// projects routed to an exporter without manifests.
+func (es ExportService) verifyProjects(ctx context.Context, projectIDs []string, dateTime time.Time) (results []VerifyResult) {
+	for i := range projectIDs {
+		routed := es.routed(es.route(ctx, projectIDs[i], &projectInfo{}))
+		store, ok := routed.objectStore()
+		if !ok {
+			continue
+		}
+		results = append(results, routed.verifyProject(store, projectIDs[i], dateTime))
+	}
+
+	return
+}
+
+func (es ExportService) verifyProject(store metric_exporter.ObjectStore, projectID string, dateTime time.Time) VerifyResult {
+	result := VerifyResult{Exporter: es.conf.Name, Route: es.conf.Route, ProjectID: projectID, Date: reportDate(dateTime), Manifest: es.manifestObjectName(projectID, dateTime)}
+
+	content, err := store.ReadObject(result.Manifest)
+	if err == metric_exporter.ErrObjectNotExist {
+		result.Missing = append(result.Missing, result.Manifest)
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		result.Corrupted = append(result.Corrupted, result.Manifest)
+		return result
+	}
+
+	var bundled map[string][]byte
+	for i := range manifest.Files {
+		file := manifest.Files[i]
+
+		content, err := store.ReadObject(file.Name)
+		if err == metric_exporter.ErrObjectNotExist && es.conf.Bundle.Format != "" {
+			if bundled == nil {
+				if bundled, err = es.readProjectBundle(store, projectID, dateTime); err != nil {
+					result.Error = err.Error()
+					return result
+				}
+			}
+			if packed, ok := bundled[file.Name]; ok {
+				content, err = packed, nil
+			}
+		}
+		if err == metric_exporter.ErrObjectNotExist {
+			result.Missing = append(result.Missing, file.Name)
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		if int64(len(content)) != file.Size || metric_exporter.SHA256(content) != file.SHA256 || !rowsMatch(file, content) {
+			result.Corrupted = append(result.Corrupted, file.Name)
+			continue
+		}
+		result.Verified++
+	}
+
+	result.OK = len(result.Missing) == 0 && len(result.Corrupted) == 0
+
+	return result
+}
+
+// readProjectBundle returns the files of the bundle of projectID, none when
+// it is missing or cannot be unpacked.
+func (es ExportService) readProjectBundle(store metric_exporter.ObjectStore, projectID string, dateTime time.Time) (map[string][]byte, error) {
+	name := metric_exporter.NewPathBuilder(es.conf).BundlePath(dateTime, projectID, es.conf.Bundle.Format)
+
+	content, err := store.ReadObject(name)
+	if err == metric_exporter.ErrObjectNotExist {
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := readBundle(content, es.conf.Bundle.Format)
+	if err != nil {
+		log.Printf("Verify: cannot read bundle %s: %v", name, err)
+		return map[string][]byte{}, nil
+	}
+
+	return files, nil
+}
+
+// rowsMatch counts the rows of CSV files after their header, other files
+// are only checked by size and checksum.
+func rowsMatch(file metric_exporter.ExportedFile, content []byte) bool {
+	if !isCSV(file.Name) {
+		return true
+	}
+
+	content, err := metric_exporter.Decompress(content, metric_exporter.CompressionOf(file.Name))
+	if err != nil {
+		return false
+	}
+
+	return metric_exporter.CSVRows(string(content)) == file.Rows
+}
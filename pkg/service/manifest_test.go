@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestManifestObjectName(t *testing.T) {
+	cases := []struct {
+		preset string
+		want   string
+	}{
+		{"", "p/2018/10/18/manifest.json"},
+		{"hive", "project=p/dt=2018-10-18/manifest.json"},
+	}
+
+	for _, c := range cases {
+		es := newTestService(t, utils.Conf{PathPreset: c.preset})
+		if name := es.manifestObjectName("p", testDate); name != c.want {
+			t.Errorf("preset %q: got %s, want %s", c.preset, name, c.want)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	es := newTestService(t, utils.Conf{Manifest: true, RunID: "run"})
+	store := testStore(t, es)
+
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	sda := testSeries("p", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sda")
+	es.writePlan("p", []metric_exporter.Series{cpu, sda})
+
+	cpuFile, _ := es.write(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+	if complete, err := es.Finalize("p", nil); complete || err != nil {
+		t.Fatalf("finalized a project with a series still running: %v", err)
+	}
+	if _, err := store.ReadObject("p/2018/10/18/manifest.json"); err != metric_exporter.ErrObjectNotExist {
+		t.Fatal("manifest written before the project completes")
+	}
+
+	es.write(sda, []string{"60,00:01,2.0"}, []string{"60,00:01,2.0", "120,00:02,3.0"})
+	if complete, err := es.Finalize("p", nil); !complete || err != nil {
+		t.Fatalf("complete project not finalized: %v", err)
+	}
+
+	content, err := store.ReadObject("p/2018/10/18/manifest.json")
+	var manifest Manifest
+	if err != nil || json.Unmarshal(content, &manifest) != nil {
+		t.Fatalf("manifest holds %s", content)
+	}
+	if manifest.RunID != "run" || manifest.Date != "2018-10-18" || len(manifest.Files) != 2 {
+		t.Errorf("got manifest %+v", manifest)
+	}
+
+	ctx := context.Background()
+	verify := func() VerifyResult {
+		t.Helper()
+
+		results := es.Verify(ctx, "2018-10-18", "p")
+		if len(results) != 1 {
+			t.Fatalf("got results %+v", results)
+		}
+		return results[0]
+	}
+
+	if result := verify(); !result.OK || result.Verified != 2 {
+		t.Errorf("got %+v of the written files", result)
+	}
+
+	store.WriteObject(cpuFile.Name, []byte("tampered"))
+	if result := verify(); result.OK || len(result.Corrupted) != 1 || result.Corrupted[0] != cpuFile.Name {
+		t.Errorf("got %+v of a tampered file", result)
+	}
+
+	store.DeleteObject(cpuFile.Name)
+	if result := verify(); result.OK || len(result.Missing) != 1 || result.Missing[0] != cpuFile.Name || result.Verified != 1 {
+		t.Errorf("got %+v of a deleted file", result)
+	}
+
+	if result := es.Verify(ctx, "2018-10-17", "p")[0]; result.OK || len(result.Missing) != 1 {
+		t.Errorf("got %+v of a day without manifest", result)
+	}
+}
+
+func TestVerifyBundled(t *testing.T) {
+	es := newTestService(t, utils.Conf{Manifest: true, Bundle: utils.BundleConf{Format: "zip"}})
+	store := testStore(t, es)
+
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	es.writePlan("p", []metric_exporter.Series{cpu})
+	file, _ := es.write(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+	if complete, err := es.Finalize("p", nil); !complete || err != nil {
+		t.Fatalf("complete project not finalized: %v", err)
+	}
+
+	// Read from the bundle once removed
+	store.DeleteObject(file.Name)
+	if result := es.Verify(context.Background(), "2018-10-18", "p")[0]; !result.OK || result.Verified != 1 {
+		t.Errorf("got %+v of a bundled file", result)
+	}
+}
+
+func TestVerifyMixedRoutes(t *testing.T) {
+	var c utils.Conf
+	err := c.Parse([]byte(`
+exporter: FileExporter
+destination: ` + t.TempDir() + `
+manifest: true
+bigquery: {project: x, endpoint: "http://127.0.0.1:1"}
+routes:
+  - name: warehouse
+    match: {projects: [q]}
+    exporter: BigQueryExporter
+    destination: metrics.series
+  - name: archive
+    match: {projects: [r]}
+    destination: ` + t.TempDir() + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := ExportService{conf: c}
+	es.client.StartTime = testDate
+
+	for _, project := range []struct{ id, route string }{{"p", ""}, {"r", "archive"}} {
+		routed := es.routed(project.route)
+		cpu := testSeries(project.id, "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+		routed.writePlan(project.id, []metric_exporter.Series{cpu})
+		routed.write(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+		if complete, err := routed.Finalize(project.id, nil); !complete || err != nil {
+			t.Fatalf("%s not finalized: %v", project.id, err)
+		}
+	}
+
+	// q is loaded into BigQuery, without manifest, the projects after it
+	// are still checked
+	results := es.verifyProjects(context.Background(), []string{"p", "q", "r"}, testDate)
+	if len(results) != 2 {
+		t.Fatalf("got results %+v, want p and r", results)
+	}
+	for i, want := range []struct{ project, route string }{{"p", ""}, {"r", "archive"}} {
+		if results[i].ProjectID != want.project || results[i].Route != want.route || !results[i].OK || results[i].Verified != 1 {
+			t.Errorf("got result %+v, want %s verified on route %q", results[i], want.project, want.route)
+		}
+	}
+}
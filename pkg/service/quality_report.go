@@ -0,0 +1,160 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+type MetricQuality struct {
+	Metric     string `json:"metric"`
+	Discovered int    `json:"discovered"`
+	Exported   int    `json:"exported"`
+	Empty      int    `json:"empty"`
+	Gaps       int    `json:"gaps"`
+	LongestGap int    `json:"longest_gap"`
+	Failures   int    `json:"failures"`
+}
+
+type ProjectQuality struct {
+	ProjectID string          `json:"project_id"`
+	Metrics   []MetricQuality `json:"metrics"`
+}
+
+type QualityReport struct {
+	Date     string           `json:"date"`
+	Projects []ProjectQuality `json:"projects"`
+}
+
+var qualityReportHTML = template.Must(template.New("quality").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Data quality {{.Date}}</title></head>
+<body>
+<h1>Data quality {{.Date}}</h1>
+{{range .Projects}}
+<h2>{{.ProjectID}}</h2>
+<table border="1" cellpadding="4">
+<tr><th>Metric</th><th>Discovered</th><th>Exported</th><th>Empty</th><th>Gaps</th><th>Longest gap (min)</th><th>Failures</th></tr>
+{{range .Metrics}}<tr><td>{{.Metric}}</td><td>{{.Discovered}}</td><td>{{.Exported}}</td><td>{{.Empty}}</td><td>{{.Gaps}}</td><td>{{.LongestGap}}</td><td>{{.Failures}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// Report summarises the plans and series records of the latest run and
+// writes quality.json and quality.html next to them, for every exporter
+// instance and route destination. It returns the first error of a
+// destination after reporting the others.
+func (es ExportService) Report() (reports []QualityReport, err error) {
+	instances := es.instances()
+	for i := range instances {
+		destinations := instances[i].destinations()
+		for j := range destinations {
+			report, reportErr := destinations[j].report()
+			if reportErr != nil {
+				log.Printf("Report: exporter %s, route %s: %v", destinations[j].conf.Name, destinations[j].conf.Route, reportErr)
+				if err == nil {
+					err = reportErr
+				}
+				continue
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	return
+}
+
+func (es ExportService) report() (QualityReport, error) {
+	report := QualityReport{Date: reportDate(es.dateTime())}
+
+	store, ok := es.objectStore()
+	if !ok {
+		return report, nil
+	}
+
+	planNames, err := store.ListObjects(path.Join(reportFolder, report.Date, "plan") + "/")
+	if err != nil {
+		return report, err
+	}
+	sort.Strings(planNames)
+
+	for i := range planNames {
+		projectID := strings.TrimSuffix(path.Base(planNames[i]), ".json")
+		pq, err := es.projectQuality(store, report.Date, projectID)
+		if err != nil {
+			return report, err
+		}
+		report.Projects = append(report.Projects, pq)
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal("Report: ", err.Error())
+	}
+	if err := store.WriteObject(path.Join(reportFolder, report.Date, "quality.json"), content); err != nil {
+		return report, err
+	}
+
+	var html bytes.Buffer
+	if err := qualityReportHTML.Execute(&html, report); err != nil {
+		log.Fatal("Report: ", err.Error())
+	}
+
+	return report, store.WriteObject(path.Join(reportFolder, report.Date, "quality.html"), html.Bytes())
+}
+
+func (es ExportService) projectQuality(store metric_exporter.ObjectStore, date, projectID string) (ProjectQuality, error) {
+	planned, err := es.readPlan(store, date, projectID)
+	if err != nil {
+		return ProjectQuality{}, err
+	}
+
+	metrics := map[string]*MetricQuality{}
+	var metricNames []string
+	for i := range planned {
+		s := planned[i]
+
+		mq, ok := metrics[s.Metric]
+		if !ok {
+			mq = &MetricQuality{Metric: s.Metric}
+			metrics[s.Metric] = mq
+			metricNames = append(metricNames, s.Metric)
+		}
+		mq.Discovered = mq.Discovered + 1
+
+		record, ok, err := es.readSeriesRecord(store, date, s)
+		if err != nil {
+			return ProjectQuality{}, err
+		}
+		if !ok {
+			mq.Failures = mq.Failures + 1
+			continue
+		}
+
+		if record.Points == 0 {
+			mq.Empty = mq.Empty + 1
+			continue
+		}
+
+		mq.Exported = mq.Exported + 1
+		mq.Gaps = mq.Gaps + record.Gaps
+		if record.LongestGap > mq.LongestGap {
+			mq.LongestGap = record.LongestGap
+		}
+	}
+
+	pq := ProjectQuality{ProjectID: projectID}
+	for i := range metricNames {
+		pq.Metrics = append(pq.Metrics, *metrics[metricNames[i]])
+	}
+
+	return pq, nil
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestReport(t *testing.T) {
+	es := newTestService(t, utils.Conf{})
+
+	cpu := "compute.googleapis.com/instance/cpu/usage_time"
+	disk := "compute.googleapis.com/instance/disk/write_ops_count"
+	exported := testSeries("p", cpu, "web", "1")
+	empty := testSeries("p", cpu, "db", "2")
+	failed := testSeries("p", cpu, "cache", "3")
+	sda := testSeries("p", disk, "web", "1", "disk", "sda")
+	es.writePlan("p", []metric_exporter.Series{exported, empty, failed, sda})
+
+	// Two gaps, the longest of two points
+	es.writeSeriesRecord(exported, []string{"1,a,", "2,b,1", "3,c,", "4,d,", "5,e,2"}, nil)
+	es.writeSeriesRecord(empty, nil, nil)
+	es.writeSeriesRecord(sda, []string{"1,a,3"}, nil)
+
+	reports, err := es.Report()
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1: %v", len(reports), err)
+	}
+
+	want := QualityReport{Date: "2018-10-18", Projects: []ProjectQuality{{
+		ProjectID: "p",
+		Metrics: []MetricQuality{
+			{Metric: cpu, Discovered: 3, Exported: 1, Empty: 1, Gaps: 2, LongestGap: 2, Failures: 1},
+			{Metric: disk, Discovered: 1, Exported: 1},
+		},
+	}}}
+	if !reflect.DeepEqual(reports[0], want) {
+		t.Errorf("got report %+v, want %+v", reports[0], want)
+	}
+
+	store := testStore(t, es)
+	content, err := store.ReadObject("_reports/2018-10-18/quality.json")
+	if err != nil {
+		t.Fatalf("quality.json was not written: %v", err)
+	}
+	var written QualityReport
+	if err := json.Unmarshal(content, &written); err != nil || !reflect.DeepEqual(written, want) {
+		t.Errorf("quality.json holds %s", content)
+	}
+
+	html, err := store.ReadObject("_reports/2018-10-18/quality.html")
+	if err != nil || !strings.Contains(string(html), "<td>"+cpu+"</td><td>3</td><td>1</td><td>1</td><td>2</td><td>2</td><td>1</td>") {
+		t.Errorf("quality.html holds %s", html)
+	}
+}
+
+func TestReportWithoutPlans(t *testing.T) {
+	es := newTestService(t, utils.Conf{})
+
+	reports, err := es.Report()
+	if err != nil || len(reports) != 1 || len(reports[0].Projects) != 0 {
+		t.Errorf("got reports %+v, want one empty report", reports)
+	}
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+// Dates in exported paths: "2018-10-18" in file names and hive partitions,
+// "2018/10/18" in the default folder layout.
+var dashedDatePattern = regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})`)
+var folderDatePattern = regexp.MustCompile(`(^|/)(\d{4})/(\d{2})/(\d{2})(/|$)`)
+
+type PruneResult struct {
+	Exporter string              `json:"exporter,omitempty"`
+	Route    string              `json:"route,omitempty"`
+	DryRun   bool                `json:"dry_run"`
+	Cutoff   string              `json:"cutoff"`
+	Deleted  []string            `json:"deleted"`
+	Rollups  map[string][]string `json:"rollups,omitempty"`
+
+	// Error stops the prune, objects listed in Deleted may be left
+	Error string `json:"error,omitempty"`
+}
+
+// objectDate returns the date an exported object belongs to.
+func objectDate(name string) (time.Time, bool) {
+	var date string
+	if m := folderDatePattern.FindStringSubmatch(name); m != nil {
+		date = m[2] + "-" + m[3] + "-" + m[4]
+	} else if m := dashedDatePattern.FindStringSubmatch(name); m != nil {
+		date = m[0]
+	} else {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse("2006-01-02", date)
+	return t, err == nil
+}
+
+// rollupName is the monthly name of a daily object, the day is dropped from
+// every date of the path.
+func rollupName(name string) string {
+	name = folderDatePattern.ReplaceAllString(name, "$1$2/$3$5")
+	return dashedDatePattern.ReplaceAllString(name, "$1-$2")
+}
+
+// Prune deletes the objects dated before the retention window of the run
+// date, rolling CSV rows up into monthly files first when configured, for
+// every exporter instance and route destination.
+func (es ExportService) Prune(dryRun bool) (results []PruneResult) {
+	instances := es.instances()
+	for i := range instances {
+		destinations := instances[i].destinations()
+		for j := range destinations {
+			results = append(results, destinations[j].prune(dryRun))
+		}
+	}
+
+	return
+}
+
+func (es ExportService) prune(dryRun bool) PruneResult {
+	retention := es.conf.Retention
+	result := PruneResult{Exporter: es.conf.Name, Route: es.conf.Route, DryRun: dryRun || retention.DryRun}
+
+	if retention.KeepDays <= 0 {
+		log.Printf("Prune: no retention configured")
+		return result
+	}
+
+	store, ok := es.objectStore()
+	if !ok {
+		return result
+	}
+
+	runDate := es.dateTime()
+	cutoff := time.Date(runDate.Year(), runDate.Month(), runDate.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-retention.KeepDays)
+	result.Cutoff = cutoff.Format("2006-01-02")
+
+	names, err := es.expiredNames(store, cutoff)
+	if err != nil {
+		return pruneError(result, err)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		di, _ := objectDate(names[i])
+		dj, _ := objectDate(names[j])
+		return di.Before(dj) || di.Equal(dj) && names[i] < names[j]
+	})
+
+	for i := range names {
+		date, ok := objectDate(names[i])
+		if !ok || !date.Before(cutoff) {
+			continue
+		}
+
+		if retention.MonthlyRollups && isCSV(names[i]) {
+			rollup := rollupName(names[i])
+			if result.Rollups == nil {
+				result.Rollups = make(map[string][]string)
+			}
+			result.Rollups[rollup] = append(result.Rollups[rollup], names[i])
+		}
+		result.Deleted = append(result.Deleted, names[i])
+	}
+
+	if result.DryRun {
+		log.Printf("Prune dry run: %d objects before %s", len(result.Deleted), result.Cutoff)
+		return result
+	}
+
+	// Rollups are written before any daily file is deleted
+	rollups := make([]string, 0, len(result.Rollups))
+	for rollup := range result.Rollups {
+		rollups = append(rollups, rollup)
+	}
+	errs := make([]error, len(rollups))
+	es.forEach(len(rollups), func(i int) {
+		errs[i] = appendRollup(store, rollups[i], result.Rollups[rollups[i]])
+	})
+	if err := firstError(errs); err != nil {
+		return pruneError(result, err)
+	}
+
+	errs = make([]error, len(result.Deleted))
+	es.forEach(len(result.Deleted), func(i int) {
+		errs[i] = store.DeleteObject(result.Deleted[i])
+	})
+	if err := firstError(errs); err != nil {
+		return pruneError(result, err)
+	}
+
+	if err := es.writePruneCursor(store, cutoff); err != nil {
+		return pruneError(result, err)
+	}
+	log.Printf("Prune: deleted %d objects before %s", len(result.Deleted), result.Cutoff)
+
+	return result
+}
+
+func pruneError(result PruneResult, err error) PruneResult {
+	log.Printf("Prune: exporter %s, route %s: %v", result.Exporter, result.Route, err)
+	result.Error = err.Error()
+
+	return result
+}
+
+func firstError(errs []error) error {
+	for i := range errs {
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+
+	return nil
+}
+
+// pruneCursorName records the cutoff of the last prune of a destination,
+// every object dated before it is gone.
+var pruneCursorName = path.Join(reportFolder, "prune.json")
+
+type pruneCursor struct {
+	Cutoff string `json:"cutoff"`
+}
+
+// readPruneCursor returns the cutoff of the last prune, false when there is
+// none or it cannot be parsed.
+func (es ExportService) readPruneCursor(store metric_exporter.ObjectStore) (time.Time, bool, error) {
+	content, err := store.ReadObject(pruneCursorName)
+	if err == metric_exporter.ErrObjectNotExist {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var cursor pruneCursor
+	if err := json.Unmarshal(content, &cursor); err != nil {
+		log.Printf("Prune: cannot read %s: %v", pruneCursorName, err)
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse("2006-01-02", cursor.Cutoff)
+	return t, err == nil, nil
+}
+
+func (es ExportService) writePruneCursor(store metric_exporter.ObjectStore, cutoff time.Time) error {
+	last, ok, err := es.readPruneCursor(store)
+	if err != nil {
+		return err
+	}
+	if ok && !last.Before(cutoff) {
+		return nil
+	}
+
+	content, err := json.Marshal(pruneCursor{Cutoff: cutoff.Format("2006-01-02")})
+	if err != nil {
+		log.Fatal("writePruneCursor: ", err.Error())
+	}
+
+	return store.WriteObject(pruneCursorName, content)
+}
+
+// expiredNames lists the objects that may be dated before cutoff. The first
+// prune of a destination lists all of it, later ones only the days since
+// the last cutoff: the run records of a day, and the day folders of the
+// projects they plan.
+func (es ExportService) expiredNames(store metric_exporter.ObjectStore, cutoff time.Time) (names []string, err error) {
+	from, ok, err := es.readPruneCursor(store)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return store.ListObjects("")
+	}
+
+	paths := metric_exporter.NewPathBuilder(es.conf)
+	seen := make(map[string]bool)
+	list := func(prefix string) error {
+		listed, err := store.ListObjects(prefix)
+		if err != nil {
+			return err
+		}
+		for i := range listed {
+			if !seen[listed[i]] {
+				seen[listed[i]] = true
+				names = append(names, listed[i])
+			}
+		}
+		return nil
+	}
+
+	for day := from; day.Before(cutoff); day = day.AddDate(0, 0, 1) {
+		reports := path.Join(reportFolder, reportDate(day))
+		plans, err := store.ListObjects(path.Join(reports, "plan") + "/")
+		if err != nil {
+			return nil, err
+		}
+		if err := list(reports + "/"); err != nil {
+			return nil, err
+		}
+
+		for i := range plans {
+			projectID := strings.TrimSuffix(path.Base(plans[i]), ".json")
+
+			prefixes := paths.DayPrefixes(day, projectID)
+			for j := range prefixes {
+				if prefixes[j] == "" {
+					// The layout does not tell where the day's files are
+					return store.ListObjects("")
+				}
+				if err := list(prefixes[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+func isCSV(name string) bool {
+	compression := metric_exporter.CompressionOf(name)
+	return path.Ext(strings.TrimSuffix(name, metric_exporter.CompressionExt(compression))) == ".csv"
+}
+
+// appendRollup appends the rows of the daily CSV objects to the monthly
+// rollup, keeping the header of the first one and their compression. Rows
+// already in the rollup are not appended again, so a prune re-run after it
+// stopped between writing the rollup and deleting the daily objects does not
+// duplicate them.
+func appendRollup(store metric_exporter.ObjectStore, rollup string, dailyNames []string) error {
+	compression := metric_exporter.CompressionOf(rollup)
+
+	content, err := store.ReadObject(rollup)
+	exists := err == nil
+	if err != nil && err != metric_exporter.ErrObjectNotExist {
+		return err
+	}
+	if content, err = metric_exporter.Decompress(content, compression); err != nil {
+		return fmt.Errorf("rollup %s: %v", rollup, err)
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+
+	rolled := make(map[string]bool)
+	for i := 1; i < len(lines); i++ {
+		rolled[lines[i]] = true
+	}
+
+	for i := range dailyNames {
+		daily, err := store.ReadObject(dailyNames[i])
+		if err == metric_exporter.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if daily, err = metric_exporter.Decompress(daily, compression); err != nil {
+			return fmt.Errorf("%s: %v", dailyNames[i], err)
+		}
+
+		rows := strings.Split(strings.TrimRight(string(daily), "\n"), "\n")
+		if !exists {
+			lines[0] = rows[0]
+			exists = true
+		}
+		for j := 1; j < len(rows); j++ {
+			if rows[j] != "" && !rolled[rows[j]] {
+				rolled[rows[j]] = true
+				lines = append(lines, rows[j])
+			}
+		}
+	}
+
+	return store.WriteObject(rollup, metric_exporter.Compress([]byte(strings.Join(lines, "\n")), compression))
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestObjectDate(t *testing.T) {
+	tests := []struct {
+		name   string
+		date   string
+		rollup string
+	}{
+		{"p/2018/10/18/web_1/2018-10-18[web_1][cpu_usage_time].csv", "2018-10-18", "p/2018/10/web_1/2018-10[web_1][cpu_usage_time].csv"},
+		{"project=p/dt=2018-10-18/metric=cpu_usage_time/web_1.csv.gz", "2018-10-18", "project=p/dt=2018-10/metric=cpu_usage_time/web_1.csv.gz"},
+		{"_reports/2018-10-18/plan/p.json", "2018-10-18", "_reports/2018-10/plan/p.json"},
+		{"p/2018/10/web_1/2018-10[web_1][cpu_usage_time].csv", "", "p/2018/10/web_1/2018-10[web_1][cpu_usage_time].csv"},
+	}
+
+	for _, test := range tests {
+		date, ok := objectDate(test.name)
+		if got := date.Format("2006-01-02"); ok != (test.date != "") || ok && got != test.date {
+			t.Errorf("%s: got date %s, %v, want %q", test.name, got, ok, test.date)
+		}
+		if got := rollupName(test.name); got != test.rollup {
+			t.Errorf("%s: got rollup %s, want %s", test.name, got, test.rollup)
+		}
+	}
+}
+
+func TestAppendRollupTwice(t *testing.T) {
+	es := newTestService(t, utils.Conf{})
+	store := testStore(t, es)
+
+	store.WriteObject("a/2018-10-17.csv", []byte("timestamp,datetime,value\n1,00:01,1.0\n2,00:02,2.0"))
+	store.WriteObject("a/2018-10-18.csv", []byte("timestamp,datetime,value\n3,00:01,3.0"))
+
+	// The second prune stopped before deleting the daily files
+	appendRollup(store, "a/2018-10.csv", []string{"a/2018-10-17.csv"})
+	appendRollup(store, "a/2018-10.csv", []string{"a/2018-10-17.csv", "a/2018-10-18.csv"})
+
+	content, _ := store.ReadObject("a/2018-10.csv")
+	if want := "timestamp,datetime,value\n1,00:01,1.0\n2,00:02,2.0\n3,00:01,3.0"; string(content) != want {
+		t.Errorf("rollup holds\n%s\nwant\n%s", content, want)
+	}
+}
+
+// listingStore records the prefixes listed.
+type listingStore struct {
+	metric_exporter.ObjectStore
+	prefixes []string
+}
+
+func (s *listingStore) ListObjects(prefix string) ([]string, error) {
+	s.prefixes = append(s.prefixes, prefix)
+	return s.ObjectStore.ListObjects(prefix)
+}
+
+func writeTestDay(store metric_exporter.ObjectStore, date string) {
+	day := strings.Replace(date, "-", "/", -1)
+	store.WriteObject("_reports/"+date+"/plan/p.json", []byte("[]"))
+	store.WriteObject("p/"+day+"/web_1/"+date+"[web_1][cpu_usage_time].csv", []byte("timestamp,datetime,value\n"+date+",00:01,1.0"))
+	store.WriteObject("p/"+day+"/instances.json", []byte("[]"))
+}
+
+func TestPrune(t *testing.T) {
+	es := newTestService(t, utils.Conf{Retention: utils.RetentionConf{KeepDays: 1, MonthlyRollups: true}})
+	store := testStore(t, es)
+
+	store.WriteObject("README.txt", []byte("kept"))
+	writeTestDay(store, "2018-10-16")
+	writeTestDay(store, "2018-10-17")
+	writeTestDay(store, "2018-10-18")
+
+	result := es.prune(false)
+	if result.Cutoff != "2018-10-18" || len(result.Deleted) != 6 {
+		t.Fatalf("got prune result %+v", result)
+	}
+	if cutoff, ok, err := es.readPruneCursor(store); err != nil || !ok || !cutoff.Equal(time.Date(2018, 10, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got cursor %v, %v", cutoff, ok)
+	}
+
+	// The next day only lists the day that expires
+	es.client.StartTime = testDate.AddDate(0, 0, 1)
+	listing := &listingStore{ObjectStore: store}
+	names, _ := es.expiredNames(listing, time.Date(2018, 10, 19, 0, 0, 0, 0, time.UTC))
+	if want := []string{"_reports/2018-10-18/plan/", "_reports/2018-10-18/", "p/2018/10/18/"}; !reflect.DeepEqual(listing.prefixes, want) {
+		t.Errorf("listed %q, want %q", listing.prefixes, want)
+	}
+	if len(names) != 3 {
+		t.Errorf("got names %v", names)
+	}
+
+	result = es.prune(false)
+	if len(result.Deleted) != 3 {
+		t.Errorf("got prune result %+v", result)
+	}
+
+	content, _ := store.ReadObject("p/2018/10/web_1/2018-10[web_1][cpu_usage_time].csv")
+	want := "timestamp,datetime,value\n2018-10-16,00:01,1.0\n2018-10-17,00:01,1.0\n2018-10-18,00:01,1.0"
+	if string(content) != want {
+		t.Errorf("rollup holds\n%s\nwant\n%s", content, want)
+	}
+	if _, err := store.ReadObject("README.txt"); err != nil {
+		t.Error("undated object deleted")
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+
+	"stackdriver-monitoring-exporter/pkg/gcp"
+)
+
+// ExportTarget is an exporter instance writing a series, through the route
+// its project took when the run was planned.
+type ExportTarget struct {
+	Exporter string
+	Route    string
+}
+
+// projectInfo is what routes match projects on besides their ID, fetched
+// from Resource Manager once per project and only when a route needs it.
+type projectInfo struct {
+	fetched   bool
+	labels    map[string]string
+	ancestors []string
+}
+
+// route returns the name of the first route of es matching projectID, ""
+// for the default route.
+func (es ExportService) route(ctx context.Context, projectID string, info *projectInfo) string {
+	for i := range es.conf.Routes {
+		match := es.conf.Routes[i].Match
+		if match.NeedsProjectInfo() && !info.fetched {
+			info.labels, info.ancestors = gcp.GetProjectInfo(ctx, projectID)
+			info.fetched = true
+		}
+
+		if match.MatchProject(projectID, info.labels, info.ancestors) {
+			return es.conf.RouteName(i)
+		}
+	}
+
+	return ""
+}
+
+// routed returns es writing to the destination of route.
+func (es ExportService) routed(route string) ExportService {
+	es.conf = es.conf.WithRoute(route)
+	return es
+}
+
+// destinations returns es on the default route and on each of its routes,
+// once per exporter, destination and prefix.
+func (es ExportService) destinations() []ExportService {
+	destinations := []ExportService{es}
+	seen := map[[3]string]bool{{es.conf.ExporterClass, es.conf.Destination, es.conf.Prefix}: true}
+
+	for i := range es.conf.Routes {
+		routed := es.routed(es.conf.RouteName(i))
+		key := [3]string{routed.conf.ExporterClass, routed.conf.Destination, routed.conf.Prefix}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		destinations = append(destinations, routed)
+	}
+
+	return destinations
+}
@@ -0,0 +1,369 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"stackdriver-monitoring-exporter/pkg/gcp/stackdriver"
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+// The run ledger lives in the destination: Do writes the plan of every
+// project, each export task a record of its series. Comparing both tells
+// which series of a project or instance have finished.
+
+const reportFolder = "_reports"
+
+func seriesKey(s metric_exporter.Series) string {
+	key := fmt.Sprintf("%s[%s]", strings.Replace(s.Metric, "/", "_", -1), s.InstanceLabel(false))
+	if len(s.AttendNames) > 0 {
+		key = fmt.Sprintf("%s[%s]", key, strings.Join(s.AttendNames, "-"))
+	}
+	if s.Group != "" {
+		key = fmt.Sprintf("%s[%s]", key, s.Group)
+	}
+
+	return key
+}
+
+// seriesRecord is written by every export task once its series is exported.
+type seriesRecord struct {
+	metric_exporter.Series
+	Points     int `json:"points"`
+	Gaps       int `json:"gaps"`
+	LongestGap int `json:"longest_gap"`
+
+	// Rows are the exported rows, kept when a later step assembles files
+	// from the results of several tasks. They are kept in SealedRows instead,
+	// encrypted like the exported files, when encryption is enabled.
+	Rows       []string `json:"rows,omitempty"`
+	SealedRows []byte   `json:"sealed_rows,omitempty"`
+}
+
+func reportDate(dateTime time.Time) string {
+	return dateTime.Format("2006-01-02")
+}
+
+func planObjectName(date, projectID string) string {
+	return path.Join(reportFolder, date, "plan", projectID+".json")
+}
+
+// instancePlanObjectName is the plan of the series of one instance, so the
+// tasks assembling its wide file do not read the plan of the whole project.
+func instancePlanObjectName(date string, s metric_exporter.Series) string {
+	return path.Join(reportFolder, date, "instance_plans", s.ProjectID, seriesKey(wideSeries(s))+".json")
+}
+
+func seriesRecordObjectName(date string, s metric_exporter.Series) string {
+	return path.Join(reportFolder, date, "series", s.ProjectID, seriesKey(s)+".json")
+}
+
+// fileRecordObjectName is the record of a file written for projectID, key
+// names what it holds: the series key, "consolidated" or the inventory file.
+func fileRecordObjectName(date, projectID, key string) string {
+	return path.Join(reportFolder, date, "files", projectID, key+".json")
+}
+
+// inventoryRecord tells whether Do wrote the inventory of a project, it is
+// skipped when the Compute Engine API or the destination fails.
+type inventoryRecord struct {
+	Written bool `json:"written"`
+}
+
+func inventoryRecordObjectName(date, projectID string) string {
+	return path.Join(reportFolder, date, "inventory", projectID+".json")
+}
+
+func (es ExportService) objectStore() (metric_exporter.ObjectStore, bool) {
+	store, ok := es.newMetricExporter().(metric_exporter.ObjectStore)
+	if !ok {
+		log.Printf("Exporter %s cannot store reports", es.conf.ExporterClass)
+	}
+
+	return store, ok
+}
+
+func (es ExportService) dateTime() time.Time {
+	return es.client.StartTime.In(es.client.Location())
+}
+
+func (es ExportService) writePlan(projectID string, planned []metric_exporter.Series) error {
+	if loader, ok := es.newMetricExporter().(metric_exporter.ProjectLoader); ok {
+		if err := loader.PlanProject(es.dateTime(), projectID, planned); err != nil {
+			return err
+		}
+	}
+
+	store, ok := es.objectStore()
+	if !ok {
+		return nil
+	}
+
+	content, err := json.Marshal(planned)
+	if err != nil {
+		log.Fatal("writePlan: ", err.Error())
+	}
+
+	// Instance plans first, a task finding the plan of its project finds
+	// the plan of its instance
+	if es.conf.WideFormat {
+		if err := es.writeInstancePlans(store, planned); err != nil {
+			return err
+		}
+	}
+
+	return store.WriteObject(planObjectName(reportDate(es.dateTime()), projectID), content)
+}
+
+// writeInstancePlans splits planned by instance, and group with group
+// folders, and writes the plan of each.
+func (es ExportService) writeInstancePlans(store metric_exporter.ObjectStore, planned []metric_exporter.Series) error {
+	var keys []string
+	instances := make(map[string][]metric_exporter.Series)
+	for i := range planned {
+		key := seriesKey(wideSeries(planned[i]))
+		if _, ok := instances[key]; !ok {
+			keys = append(keys, key)
+		}
+		instances[key] = append(instances[key], planned[i])
+	}
+
+	date := reportDate(es.dateTime())
+	for i := range keys {
+		series := instances[keys[i]]
+
+		content, err := json.Marshal(series)
+		if err != nil {
+			log.Fatal("writeInstancePlans: ", err.Error())
+		}
+
+		if err := store.WriteObject(instancePlanObjectName(date, series[0]), content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (es ExportService) writeSeriesRecord(s metric_exporter.Series, metricPoints, rows []string) error {
+	store, ok := es.objectStore()
+	if !ok {
+		return nil
+	}
+
+	record := seriesRecord{Series: s, Points: len(metricPoints)}
+	record.Gaps, record.LongestGap = stackdriver.GapStats(metricPoints)
+	if es.conf.WideFormat || es.conf.Consolidated {
+		record.Rows = rows
+		if encryption := metric_exporter.NewEncryption(es.conf.Encryption); encryption.Enabled() {
+			sealed, err := sealRows(encryption, rows)
+			if err != nil {
+				return err
+			}
+			record.Rows, record.SealedRows = nil, sealed
+		}
+	}
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		log.Fatal("writeSeriesRecord: ", err.Error())
+	}
+
+	return store.WriteObject(seriesRecordObjectName(reportDate(es.dateTime()), s), content)
+}
+
+// writeFileRecord records a file written by the exporter, bundles and
+// manifests list files from these records.
+func (es ExportService) writeFileRecord(projectID, key string, file metric_exporter.ExportedFile) error {
+	store, ok := es.objectStore()
+	if !ok {
+		return nil
+	}
+
+	content, err := json.Marshal(file)
+	if err != nil {
+		log.Fatal("writeFileRecord: ", err.Error())
+	}
+
+	return store.WriteObject(fileRecordObjectName(reportDate(es.dateTime()), projectID, key), content)
+}
+
+// writeInventoryRecord records whether the inventory of projectID was
+// written, so the finalize task only waits for inventory files that were.
+func (es ExportService) writeInventoryRecord(projectID string, written bool) error {
+	store, ok := es.objectStore()
+	if !ok {
+		return nil
+	}
+
+	content, err := json.Marshal(inventoryRecord{Written: written})
+	if err != nil {
+		log.Fatal("writeInventoryRecord: ", err.Error())
+	}
+
+	return store.WriteObject(inventoryRecordObjectName(reportDate(es.dateTime()), projectID), content)
+}
+
+// inventoryWritten reports whether the inventory of projectID was written,
+// true without a record.
+func (es ExportService) inventoryWritten(store metric_exporter.ObjectStore, date, projectID string) (bool, error) {
+	content, err := store.ReadObject(inventoryRecordObjectName(date, projectID))
+	if err == metric_exporter.ErrObjectNotExist {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var record inventoryRecord
+	if err := json.Unmarshal(content, &record); err != nil {
+		return false, fmt.Errorf("cannot read the inventory record of %s: %v", projectID, err)
+	}
+
+	return record.Written, nil
+}
+
+// readFileRecords returns the files recorded for projectID.
+func (es ExportService) readFileRecords(store metric_exporter.ObjectStore, date, projectID string) (files []metric_exporter.ExportedFile, err error) {
+	names, err := store.ListObjects(path.Join(reportFolder, date, "files", projectID) + "/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	for i := range names {
+		content, err := store.ReadObject(names[i])
+		if err == metric_exporter.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var file metric_exporter.ExportedFile
+		if err := json.Unmarshal(content, &file); err != nil {
+			log.Printf("readFileRecords: %v", err)
+			continue
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// readPlan returns the series planned for projectID, none when it has no
+// plan.
+func (es ExportService) readPlan(store metric_exporter.ObjectStore, date, projectID string) (planned []metric_exporter.Series, err error) {
+	content, err := store.ReadObject(planObjectName(date, projectID))
+	if err == metric_exporter.ErrObjectNotExist {
+		log.Printf("readPlan: no plan of %s", projectID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &planned); err != nil {
+		return nil, fmt.Errorf("cannot read plan of %s: %v", projectID, err)
+	}
+
+	return planned, nil
+}
+
+func (es ExportService) readInstancePlan(store metric_exporter.ObjectStore, date string, s metric_exporter.Series) (planned []metric_exporter.Series, err error) {
+	content, err := store.ReadObject(instancePlanObjectName(date, s))
+	if err == metric_exporter.ErrObjectNotExist {
+		log.Printf("readInstancePlan: no plan of %s", seriesKey(wideSeries(s)))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &planned); err != nil {
+		return nil, fmt.Errorf("cannot read plan of %s: %v", seriesKey(wideSeries(s)), err)
+	}
+
+	return planned, nil
+}
+
+// readSeriesRecord returns the record of s, false while its task has not
+// written it.
+func (es ExportService) readSeriesRecord(store metric_exporter.ObjectStore, date string, s metric_exporter.Series) (record seriesRecord, ok bool, err error) {
+	content, err := store.ReadObject(seriesRecordObjectName(date, s))
+	if err == metric_exporter.ErrObjectNotExist {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+
+	if err := json.Unmarshal(content, &record); err != nil {
+		return record, false, fmt.Errorf("cannot read the record of %s: %v", seriesKey(s), err)
+	}
+
+	if len(record.SealedRows) > 0 {
+		rows, err := openRows(metric_exporter.NewEncryption(es.conf.Encryption), record.SealedRows)
+		if err != nil {
+			return record, false, fmt.Errorf("cannot decrypt the rows of %s: %v", seriesKey(s), err)
+		}
+		record.Rows = rows
+	}
+
+	return record, true, nil
+}
+
+func sealRows(encryption metric_exporter.Encryption, rows []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := encryption.Writer(&buf)
+	if _, err := io.WriteString(w, strings.Join(rows, "\n")); err != nil {
+		return nil, fmt.Errorf("cannot seal rows: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot seal rows: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func openRows(encryption metric_exporter.Encryption, sealed []byte) ([]string, error) {
+	content, err := encryption.Decrypt(sealed)
+	if err != nil || len(content) == 0 {
+		return nil, err
+	}
+
+	return strings.Split(string(content), "\n"), nil
+}
+
+// projectComplete reports whether every series planned for projectID has a
+// record. Records are counted first so that only the last tasks read them.
+func (es ExportService) projectComplete(store metric_exporter.ObjectStore, date, projectID string) (planned []metric_exporter.Series, complete bool, err error) {
+	recordNames, err := store.ListObjects(path.Join(reportFolder, date, "series", projectID) + "/")
+	if err != nil {
+		return nil, false, err
+	}
+
+	planned, err = es.readPlan(store, date, projectID)
+	if err != nil || len(planned) == 0 || len(recordNames) < len(planned) {
+		return planned, false, err
+	}
+
+	for i := range planned {
+		_, err := store.ReadObject(seriesRecordObjectName(date, planned[i]))
+		if err == metric_exporter.ErrObjectNotExist {
+			return planned, false, nil
+		}
+		if err != nil {
+			return planned, false, err
+		}
+	}
+
+	return planned, true, nil
+}
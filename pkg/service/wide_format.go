@@ -0,0 +1,202 @@
+package service
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+)
+
+// wideSeries returns the series of the wide file of the instance of s.
+func wideSeries(s metric_exporter.Series) metric_exporter.Series {
+	return metric_exporter.Series{
+		ProjectID:    s.ProjectID,
+		Metric:       metric_exporter.WideMetric,
+		Zone:         s.Zone,
+		InstanceID:   s.InstanceID,
+		InstanceName: s.InstanceName,
+		Labels:       s.Labels,
+		Group:        s.Group,
+	}
+}
+
+// exportWideIfComplete writes the wide file of the series' instance once
+// every metric planned for that instance has a series record. Tasks finishing
+// together may both write it, the content is the same.
+func (es ExportService) exportWideIfComplete(series metric_exporter.Series) error {
+	store, ok := es.objectStore()
+	if !ok {
+		return nil
+	}
+
+	date := reportDate(es.dateTime())
+	planned, err := es.readInstancePlan(store, date, series)
+	if err != nil {
+		return err
+	}
+
+	var records []seriesRecord
+	for i := range planned {
+		record, ok, err := es.readSeriesRecord(store, date, planned[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// Other metrics of the instance are still running
+			return nil
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	wide := wideSeries(series)
+
+	var rows []string
+	wide.ValueColumns, rows = pivotRecords(records)
+
+	file, err := es.newMetricExporter().Export(es.dateTime(), wide, rows)
+	if err != nil {
+		return err
+	}
+
+	return es.writeFileRecord(wide.ProjectID, seriesKey(wide), file)
+}
+
+// pivotColumn is a column of the wide file: the rows of a record carrying
+// the given label values.
+type pivotColumn struct {
+	record int
+	labels string
+}
+
+// pivotRecords aligns the points of every record on their timestamps and
+// returns one column per record. Long rows of a record holding several
+// series, e.g. one per memory state, get a column per series, named after
+// the labels telling them apart. Slots missing from a series stay empty.
+func pivotRecords(records []seriesRecord) (columns []string, rows []string) {
+	var pivotColumns []pivotColumn
+	index := make(map[pivotColumn]int)
+	values := make(map[int64]map[int]string)
+	datetimes := make(map[int64]string)
+
+	for i := range records {
+		labelColumns := recordLabelColumns(records[i])
+
+		var recordColumns []pivotColumn
+		var recordLabels [][]string
+		for j := range records[i].Rows {
+			fields := strings.Split(records[i].Rows[j], ",")
+			if len(fields) < 3 {
+				continue
+			}
+
+			timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			// Long rows carry the metric type then the label columns
+			var labels []string
+			if len(fields) > 4 {
+				labels = fields[4:]
+			}
+			column := pivotColumn{i, strings.Join(labels, ",")}
+			if _, ok := index[column]; !ok {
+				index[column] = len(pivotColumns)
+				pivotColumns = append(pivotColumns, column)
+				recordColumns = append(recordColumns, column)
+				recordLabels = append(recordLabels, labels)
+			}
+
+			if _, ok := values[timestamp]; !ok {
+				values[timestamp] = make(map[int]string)
+				datetimes[timestamp] = fields[1]
+			}
+			values[timestamp][index[column]] = fields[2]
+		}
+
+		names := pivotColumnNames(records[i].Series.ColumnName(), labelColumns, recordLabels)
+		for j := range recordColumns {
+			columns = append(columns, names[j])
+		}
+		if len(recordColumns) == 0 {
+			// A record without points still gets its column
+			column := pivotColumn{record: i}
+			index[column] = len(pivotColumns)
+			pivotColumns = append(pivotColumns, column)
+			columns = append(columns, records[i].Series.ColumnName())
+		}
+	}
+
+	timestamps := make([]int64, 0, len(values))
+	for timestamp := range values {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	rows = make([]string, len(timestamps))
+	for i := range timestamps {
+		row := make([]string, len(pivotColumns))
+		for j := range row {
+			row[j] = values[timestamps[i]][j]
+		}
+		rows[i] = strconv.FormatInt(timestamps[i], 10) + "," + datetimes[timestamps[i]] + "," + strings.Join(row, ",")
+	}
+
+	return
+}
+
+// recordLabelColumns returns the label columns following the metric type in
+// the long rows of record.
+func recordLabelColumns(record seriesRecord) []string {
+	if len(record.Series.Columns) < 2 {
+		return nil
+	}
+
+	return record.Series.Columns[1:]
+}
+
+// pivotColumnNames names the columns of one record, name alone when it has
+// a single series, else followed by the labels whose values differ between
+// its series, e.g. "memory_bytes_used[state=used]".
+func pivotColumnNames(name string, labelColumns []string, labels [][]string) (names []string) {
+	names = make([]string, len(labels))
+	if len(labels) < 2 {
+		for i := range names {
+			names[i] = name
+		}
+		return
+	}
+
+	var varying []int
+	for k := range labelColumns {
+		for i := 1; i < len(labels); i++ {
+			if labelValue(labels[i], k) != labelValue(labels[0], k) {
+				varying = append(varying, k)
+				break
+			}
+		}
+	}
+
+	for i := range labels {
+		pairs := make([]string, len(varying))
+		for j, k := range varying {
+			pairs[j] = labelColumns[k] + "=" + labelValue(labels[i], k)
+		}
+		names[i] = name + "[" + strings.Join(pairs, ";") + "]"
+	}
+
+	return
+}
+
+func labelValue(labels []string, k int) string {
+	if k < len(labels) {
+		return labels[k]
+	}
+
+	return ""
+}
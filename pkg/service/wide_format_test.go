@@ -0,0 +1,87 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"stackdriver-monitoring-exporter/pkg/metric_exporter"
+	"stackdriver-monitoring-exporter/pkg/utils"
+)
+
+func TestPivotRecords(t *testing.T) {
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	sda := testSeries("p", "compute.googleapis.com/instance/disk/write_ops_count", "web", "1", "disk", "sda")
+
+	columns, rows := pivotRecords([]seriesRecord{
+		{Series: cpu, Rows: []string{"60,00:01,1.0", "120,00:02,2.0"}},
+		{Series: sda, Rows: []string{"120,00:02,3.0", "180,00:03,4.0"}},
+	})
+	if want := []string{"cpu_usage_time", "disk_sda_write_ops_count"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("got columns %v, want %v", columns, want)
+	}
+	if want := []string{"60,00:01,1.0,", "120,00:02,2.0,3.0", "180,00:03,,4.0"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, want %v", rows, want)
+	}
+}
+
+func TestPivotRecordsLong(t *testing.T) {
+	memory := testSeries("p", "agent.googleapis.com/memory/bytes_used", "web", "1")
+	memory.Columns = []string{"metric", "zone", "state"}
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	cpu.Columns = memory.Columns
+
+	// Every memory state is a series of its own sharing the timestamps
+	columns, rows := pivotRecords([]seriesRecord{
+		{Series: memory, Rows: []string{
+			"60,00:01,10.0,agent.googleapis.com/memory/bytes_used,asia-east1-a,used",
+			"120,00:02,11.0,agent.googleapis.com/memory/bytes_used,asia-east1-a,used",
+			"60,00:01,20.0,agent.googleapis.com/memory/bytes_used,asia-east1-a,free",
+			"120,00:02,21.0,agent.googleapis.com/memory/bytes_used,asia-east1-a,free",
+		}},
+		{Series: cpu, Rows: []string{
+			"60,00:01,0.5,compute.googleapis.com/instance/cpu/usage_time,asia-east1-a,",
+		}},
+	})
+	if want := []string{"memory_bytes_used[state=used]", "memory_bytes_used[state=free]", "cpu_usage_time"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("got columns %v, want %v", columns, want)
+	}
+	if want := []string{"60,00:01,10.0,20.0,0.5", "120,00:02,11.0,21.0,"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, want %v", rows, want)
+	}
+}
+
+func TestExportWideIfComplete(t *testing.T) {
+	es := newTestService(t, utils.Conf{WideFormat: true})
+	store := testStore(t, es)
+
+	cpu := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "web", "1")
+	sent := testSeries("p", "compute.googleapis.com/instance/network/sent_bytes_count", "web", "1")
+	db := testSeries("p", "compute.googleapis.com/instance/cpu/usage_time", "db", "2")
+	es.writePlan("p", []metric_exporter.Series{cpu, db, sent})
+
+	if planned, _ := es.readInstancePlan(store, "2018-10-18", cpu); !reflect.DeepEqual(planned, []metric_exporter.Series{cpu, sent}) {
+		t.Errorf("got the plan %+v of web", planned)
+	}
+
+	es.writeSeriesRecord(cpu, []string{"60,00:01,1.0"}, []string{"60,00:01,1.0"})
+	es.exportWideIfComplete(cpu)
+	if files, _ := es.readFileRecords(store, "2018-10-18", "p"); len(files) != 0 {
+		t.Fatalf("wide file written before the last metric: %+v", files)
+	}
+
+	// db does not hold web back
+	es.writeSeriesRecord(sent, []string{"60,00:01,2.0"}, []string{"60,00:01,2.0"})
+	if err := es.exportWideIfComplete(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := es.readFileRecords(store, "2018-10-18", "p")
+	if len(files) != 1 || !strings.Contains(files[0].Name, "[wide]") {
+		t.Fatalf("got file records %+v, want the wide file of web", files)
+	}
+	content, _ := store.ReadObject(files[0].Name)
+	if !strings.Contains(string(content), "cpu_usage_time,network_sent_bytes_count\n60,00:01,1.0,2.0") {
+		t.Errorf("wide file holds\n%s", content)
+	}
+}
@@ -1,27 +1,439 @@
 package utils
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Conf struct {
-	Timezone      int           `yaml:"timezone"`
-	ExporterClass string        `yaml:"exporter"`
-	Destination   string        `yaml:"destination"`
+	// Name identifies the exporter instance in logs and results.
+	Name string `yaml:"name"`
+
+	Timezone      int    `yaml:"timezone"`
+	ExporterClass string `yaml:"exporter"`
+	Destination   string `yaml:"destination"`
+
+	// Prefix roots every exported file under a folder of the destination.
+	Prefix string `yaml:"prefix"`
+
+	// Routes send the projects they match to their own exporter,
+	// destination or prefix, the first matching route wins. Other projects
+	// take the default route, the exporter and destination above.
+	Routes []Route `yaml:"routes"`
+
+	// LegacyPaths names instance folders and files by instance name only,
+	// as before instance IDs were part of the layout.
+	LegacyPaths bool `yaml:"legacy_paths"`
+
+	// PathPreset picks the "default" or "hive" layout of exported files,
+	// PathTemplate, ProjectPathTemplate and BundlePathTemplate override its
+	// Go templates.
+	PathPreset          string `yaml:"path_preset"`
+	PathTemplate        string `yaml:"path_template"`
+	ProjectPathTemplate string `yaml:"project_path_template"`
+	BundlePathTemplate  string `yaml:"bundle_path_template"`
+
+	// ProjectFilePathTemplate places the inventory and manifest of a
+	// project and day, named by .Name.
+	ProjectFilePathTemplate string `yaml:"project_file_path_template"`
+
+	// Compression of exported files: "" (none), "gzip" or "zstd".
+	Compression string `yaml:"compression"`
+
+	Encryption EncryptionConf `yaml:"encryption"`
+
+	// Overwrite decides what happens to exported files that already exist:
+	// "always" (default), "never", "if-more-complete" or "versioned".
+	Overwrite string `yaml:"overwrite"`
+
+	// Inventory writes instances.csv and instances.json from the Compute
+	// Engine API next to each project's daily metrics. ComputeEndpoint
+	// sends its requests to another server, without credentials.
+	Inventory       bool   `yaml:"inventory"`
+	ComputeEndpoint string `yaml:"compute_endpoint"`
+
+	// OutputFormat "long" writes every matching series into one file, each
+	// row carrying the metric type and LongColumns.
+	OutputFormat string   `yaml:"output_format"`
+	LongColumns  []string `yaml:"long_columns"`
+
+	// WideFormat also writes one file per instance and day with a column
+	// per metric, once all metrics of the instance are exported.
+	WideFormat bool `yaml:"wide_format"`
+
+	// Consolidated also writes one long-format file per project and day
+	// holding every instance and metric, once all its tasks are done.
+	Consolidated bool `yaml:"consolidated"`
+
+	// LabelColumns are instance labels appended as columns to every metric file.
+	LabelColumns []string `yaml:"label_columns"`
+
+	Projects ProjectsConf `yaml:"projects"`
+
+	// Metrics are the metric types to export, glob patterns, empty exports
+	// every supported metric.
+	Metrics []string `yaml:"metrics"`
+
+	// Exporters fan the exported series out to several exporter instances,
+	// each a block of top-level keys replacing those of config.yaml. Keys
+	// read when the series are planned are only set at the top level.
+	Exporters []map[string]interface{} `yaml:"exporters"`
+
+	Retention RetentionConf `yaml:"retention"`
+
+	// Manifest writes manifest.json per project and day listing every
+	// exported file with its size, rows and SHA-256.
+	Manifest bool `yaml:"manifest"`
+
+	Bundle BundleConf `yaml:"bundle"`
+
+	// Groups are Monitoring group IDs or display names. When set only
+	// members of these groups are exported.
+	Groups       []string `yaml:"groups"`
+	GroupFolders bool     `yaml:"group_folders"`
+
+	// InstanceSelectors is keyed by metric type, "default" applies to metrics
+	// without their own selector.
+	InstanceSelectors map[string]InstanceSelector `yaml:"instance_selectors"`
+
+	// Blocks holds every top-level block of config.yaml as read. Each
+	// exporter decodes its own block, e.g. "gcs" for the GCSExporter,
+	// with the schema it registers.
+	Blocks map[string]interface{} `yaml:"-"`
+
+	// Route is the route applied by WithRoute, empty for the default route.
+	Route string `yaml:"-"`
+
+	// RunID is set per export run, it identifies the run in exported objects.
+	RunID string `yaml:"-"`
 }
 
-func (c *Conf) LoadConfig() *Conf {
+const DefaultInstanceSelector = "default"
+
+const OutputFormatLong = "long"
+
+// InstanceSelector restricts the instances exported for a metric.
+// Every non-empty field must match.
+type InstanceSelector struct {
+	UserLabels   map[string]string `yaml:"user_labels"`
+	Zones        []string          `yaml:"zones"`
+	Regions      []string          `yaml:"regions"`
+	MachineTypes []string          `yaml:"machine_types"`
+	NameRegex    string            `yaml:"name_regex"`
+
+	ExcludeNameRegex string `yaml:"exclude_name_regex"`
+
+	// GroupID is set per export run from Conf.Groups.
+	GroupID string `yaml:"-"`
+
+	// The name regexes compiled by Compile
+	nameRegex        *regexp.Regexp
+	excludeNameRegex *regexp.Regexp
+}
+
+// Compile compiles the name regexes of s, LoadConfig compiles those of
+// every selector.
+func (s *InstanceSelector) Compile() (err error) {
+	if s.NameRegex != "" {
+		if s.nameRegex, err = regexp.Compile(s.NameRegex); err != nil {
+			return fmt.Errorf("name_regex: %v", err)
+		}
+	}
+	if s.ExcludeNameRegex != "" {
+		if s.excludeNameRegex, err = regexp.Compile(s.ExcludeNameRegex); err != nil {
+			return fmt.Errorf("exclude_name_regex: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// MatchName reports whether instanceName passes the name regexes of s.
+func (s InstanceSelector) MatchName(instanceName string) bool {
+	if s.nameRegex != nil && !s.nameRegex.MatchString(instanceName) {
+		return false
+	}
+
+	return s.excludeNameRegex == nil || !s.excludeNameRegex.MatchString(instanceName)
+}
+
+// InstanceSelector returns the selector configured for metric.
+func (c Conf) InstanceSelector(metric string) InstanceSelector {
+	if selector, ok := c.InstanceSelectors[metric]; ok {
+		return selector
+	}
+
+	return c.InstanceSelectors[DefaultInstanceSelector]
+}
+
+// Route overrides the exporter, destination and prefix of the projects it
+// matches, empty fields are kept.
+type Route struct {
+	Name  string     `yaml:"name"`
+	Match RouteMatch `yaml:"match"`
+
+	ExporterClass string `yaml:"exporter"`
+	Destination   string `yaml:"destination"`
+	Prefix        string `yaml:"prefix"`
+}
+
+// RouteMatch selects projects, every non-empty field must match.
+type RouteMatch struct {
+	// Projects are project IDs or glob patterns.
+	Projects []string          `yaml:"projects"`
+	Labels   map[string]string `yaml:"labels"`
+
+	// Folders are folder IDs, projects anywhere below one of them match.
+	Folders []string `yaml:"folders"`
+}
+
+// NeedsProjectInfo reports whether matching needs the labels or ancestry of
+// projects from Resource Manager.
+func (m RouteMatch) NeedsProjectInfo() bool {
+	return len(m.Labels) > 0 || len(m.Folders) > 0
+}
+
+// MatchProject reports whether the project with labels and ancestor
+// resource names ("folders/123") passes m.
+func (m RouteMatch) MatchProject(projectID string, labels map[string]string, ancestors []string) bool {
+	if len(m.Projects) > 0 && !matchAny(m.Projects, projectID) {
+		return false
+	}
+
+	for key, value := range m.Labels {
+		if labels[key] != value {
+			return false
+		}
+	}
+
+	if len(m.Folders) == 0 {
+		return true
+	}
+	for i := range m.Folders {
+		folder := "folders/" + strings.TrimPrefix(m.Folders[i], "folders/")
+		for j := range ancestors {
+			if ancestors[j] == folder {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RouteName returns the name of routes[i], "route-<i+1>" when unnamed.
+func (c Conf) RouteName(i int) string {
+	if c.Routes[i].Name != "" {
+		return c.Routes[i].Name
+	}
+
+	return fmt.Sprintf("route-%d", i+1)
+}
+
+// WithRoute returns c with the named route applied, c itself for the
+// default route "".
+func (c Conf) WithRoute(name string) Conf {
+	for i := range c.Routes {
+		if c.RouteName(i) != name {
+			continue
+		}
+
+		route := c.Routes[i]
+		if route.ExporterClass != "" {
+			c.ExporterClass = route.ExporterClass
+		}
+		if route.Destination != "" {
+			c.Destination = route.Destination
+		}
+		if route.Prefix != "" {
+			c.Prefix = route.Prefix
+		}
+		c.Route = name
+		return c
+	}
+
+	return c
+}
+
+// MatchMetric reports whether metric passes the Metrics patterns.
+func (c Conf) MatchMetric(metric string) bool {
+	return len(c.Metrics) == 0 || matchAny(c.Metrics, metric)
+}
+
+// ExporterInstances returns the conf of every instance of Exporters, or c
+// alone when none is listed. Keys of an instance that are not fields of
+// Conf are kept in its Blocks, for its exporter to decode.
+func (c Conf) ExporterInstances() ([]Conf, error) {
+	if len(c.Exporters) == 0 {
+		return []Conf{c}, nil
+	}
+
+	instances := make([]Conf, len(c.Exporters))
+	for i := range c.Exporters {
+		name := fmt.Sprintf("exporter-%d", i+1)
+		if s, ok := c.Exporters[i]["name"].(string); ok && s != "" {
+			name = s
+		}
+
+		blocks := make(map[string]interface{})
+		for key, value := range c.Blocks {
+			if key != "exporters" {
+				blocks[key] = value
+			}
+		}
+		for key, value := range c.Exporters[i] {
+			blocks[key] = value
+		}
+
+		content, err := yaml.Marshal(blocks)
+		if err != nil {
+			return nil, fmt.Errorf("exporter %s: %v", name, err)
+		}
+		if err := yaml.Unmarshal(content, &instances[i]); err != nil {
+			return nil, fmt.Errorf("exporter %s: %v", name, err)
+		}
+		for metric, selector := range instances[i].InstanceSelectors {
+			if err := selector.Compile(); err != nil {
+				return nil, fmt.Errorf("exporter %s: instance_selectors.%s: %v", name, metric, err)
+			}
+			instances[i].InstanceSelectors[metric] = selector
+		}
+		instances[i].Blocks = blocks
+		instances[i].RunID = c.RunID
+		if instances[i].Name == "" {
+			instances[i].Name = fmt.Sprintf("exporter-%d", i+1)
+		}
+	}
+
+	return instances, nil
+}
+
+// ConfKey reports whether key is a top-level key of config.yaml decoded
+// into Conf, rather than the block of an exporter.
+func ConfKey(key string) bool {
+	t := reflect.TypeOf(Conf{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; tag == key && tag != "-" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProjectsConf narrows down the projects discovered through Resource Manager.
+// An empty ProjectsConf keeps every active project the service account can see.
+type ProjectsConf struct {
+	Organization    string            `yaml:"organization"`
+	Folders         []string          `yaml:"folders"`
+	Recursive       bool              `yaml:"recursive"`
+	LifecycleStates []string          `yaml:"lifecycle_states"`
+	Labels          map[string]string `yaml:"labels"`
+	Include         []string          `yaml:"include"`
+	Exclude         []string          `yaml:"exclude"`
+}
+
+// RetentionConf is enforced by the prune job over the exporter destination.
+// Files are dated by the date in their path.
+type RetentionConf struct {
+	// KeepDays keeps the daily files of the last days, zero keeps everything.
+	KeepDays int `yaml:"keep_days"`
+
+	// MonthlyRollups appends the rows of expiring daily CSV files to one
+	// file per month before deleting them.
+	MonthlyRollups bool `yaml:"monthly_rollups"`
+
+	// DryRun only lists what would be rolled up and deleted.
+	DryRun bool `yaml:"dry_run"`
+}
+
+// EncryptionConf encrypts exported files before they leave the exporter.
+type EncryptionConf struct {
+	// Mode is "age", "openpgp" or "envelope", empty writes plain files.
+	Mode string `yaml:"mode"`
+
+	// Recipients are age public keys (age1...) or files holding armored
+	// OpenPGP public keys.
+	Recipients []string `yaml:"recipients"`
+
+	// KEKFile holds the age X25519 identity used as key-encryption key of
+	// envelope encryption, as written by age-keygen; KEKID names it in
+	// object metadata.
+	KEKFile string `yaml:"kek_file"`
+	KEKID   string `yaml:"kek_id"`
+
+	// IdentityFile holds age secret keys or an armored OpenPGP secret key
+	// ring, used to decrypt.
+	IdentityFile string `yaml:"identity_file"`
+}
+
+// Bundle formats
+const BundleTarGz = "tar.gz"
+const BundleZip = "zip"
+
+// BundleConf packs the files of a project and day into one archive once all
+// its export tasks are done.
+type BundleConf struct {
+	// Format is "tar.gz" or "zip", empty disables bundles.
+	Format string `yaml:"format"`
+
+	// RemoveFiles deletes the bundled files once the archive is written.
+	RemoveFiles bool `yaml:"remove_files"`
+}
+
+// MatchProjectID reports whether projectID passes the include and exclude
+// lists. Both lists accept exact project IDs and glob patterns.
+func (p ProjectsConf) MatchProjectID(projectID string) bool {
+	if len(p.Include) > 0 && !matchAny(p.Include, projectID) {
+		return false
+	}
+
+	return !matchAny(p.Exclude, projectID)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for i := range patterns {
+		if matched, _ := path.Match(patterns[i], name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadConfig reads config.yaml into c and compiles its instance selectors.
+func (c *Conf) LoadConfig() error {
 	yamlFile, err := ioutil.ReadFile("config.yaml")
 	if err != nil {
 		log.Printf("yamlFile.Get err   #%v ", err)
 	}
-	err = yaml.Unmarshal(yamlFile, c)
-	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+
+	return c.Parse(yamlFile)
+}
+
+// Parse reads the YAML content of config.yaml into c and compiles its
+// instance selectors.
+func (c *Conf) Parse(content []byte) error {
+	if err := yaml.Unmarshal(content, c); err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
+	}
+	if err := yaml.Unmarshal(content, &c.Blocks); err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
 	}
 
-	return c
+	for metric, selector := range c.InstanceSelectors {
+		if err := selector.Compile(); err != nil {
+			return fmt.Errorf("instance_selectors.%s: %v", metric, err)
+		}
+		c.InstanceSelectors[metric] = selector
+	}
+
+	return nil
 }
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchProjectID(t *testing.T) {
+	conf := ProjectsConf{Include: []string{"web-*", "db"}, Exclude: []string{"web-test"}}
+
+	tests := map[string]bool{
+		"web-prod": true,
+		"db":       true,
+		"db-prod":  false,
+		"web-test": false,
+		"cache":    false,
+	}
+	for projectID, want := range tests {
+		if got := conf.MatchProjectID(projectID); got != want {
+			t.Errorf("MatchProjectID(%q) = %v, want %v", projectID, got, want)
+		}
+	}
+
+	if !(ProjectsConf{}).MatchProjectID("any") {
+		t.Error("an empty ProjectsConf rejects projects")
+	}
+}
+
+func TestParseInstanceSelectors(t *testing.T) {
+	var c Conf
+	err := c.Parse([]byte(`
+instance_selectors:
+  default:
+    name_regex: "^web-"
+    exclude_name_regex: "-canary$"
+  compute.googleapis.com/instance/cpu/usage_time:
+    zones: [asia-east1-a]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector := c.InstanceSelector("agent.googleapis.com/memory/bytes_used")
+	tests := map[string]bool{
+		"web-1":      true,
+		"web-canary": false,
+		"db-1":       false,
+	}
+	for name, want := range tests {
+		if got := selector.MatchName(name); got != want {
+			t.Errorf("MatchName(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	if !c.InstanceSelector("compute.googleapis.com/instance/cpu/usage_time").MatchName("db-1") {
+		t.Error("a selector without name regexes rejects names")
+	}
+}
+
+func TestParseInvalidNameRegex(t *testing.T) {
+	var c Conf
+	err := c.Parse([]byte(`
+instance_selectors:
+  default:
+    exclude_name_regex: "(web"
+`))
+	if err == nil || !strings.Contains(err.Error(), "instance_selectors.default: exclude_name_regex") {
+		t.Errorf("got error %v, want an exclude_name_regex error", err)
+	}
+}